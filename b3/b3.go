@@ -0,0 +1,93 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package b3 propagates monkit Traces across process boundaries using the
+// Zipkin B3 HTTP headers.
+package b3 // import "gopkg.in/spacemonkeygo/monkit.v2/b3"
+
+import (
+	"net/http"
+	"strconv"
+
+	"gopkg.in/spacemonkeygo/monkit.v2"
+)
+
+// The B3 header names.
+const (
+	TraceIdHeader      = "X-B3-TraceId"
+	SpanIdHeader       = "X-B3-SpanId"
+	ParentSpanIdHeader = "X-B3-ParentSpanId"
+	SampledHeader      = "X-B3-Sampled"
+	FlagsHeader        = "X-B3-Flags"
+)
+
+// Inject sets the B3 headers on h for an outgoing request made from Span s.
+// A new span id is allocated for the remote side, with s as its parent. If
+// s's Trace has a positive sampling priority, the debug flag is set.
+func Inject(s *monkit.Span, h http.Header) {
+	trace := s.Trace()
+	h.Set(TraceIdHeader, trace.FormatId(monkit.Hex64))
+	h.Set(SpanIdHeader, monkit.FormatId(monkit.NewId(), monkit.Hex64))
+	h.Set(ParentSpanIdHeader, monkit.FormatId(s.Id(), monkit.Hex64))
+	switch {
+	case trace.SamplingPriority() > 0:
+		// the debug flag implies sampling
+		h.Set(FlagsHeader, "1")
+	case trace.Sampled():
+		h.Set(SampledHeader, "1")
+	default:
+		h.Set(SampledHeader, "0")
+	}
+}
+
+// Extract reads the B3 headers from h, returning a Trace and span id suitable
+// for Func.RemoteTrace. ok is false if h has no valid B3 trace and span ids.
+// If the debug flag is set, the Trace's sampling priority is set to 1.
+//
+//   func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+//     ctx := req.Context()
+//     if trace, spanId, ok := b3.Extract(req.Header); ok {
+//       defer mon.Func().RemoteTrace(&ctx, spanId, trace)(nil)
+//     } else {
+//       defer mon.Task()(&ctx)(nil)
+//     }
+//     ...
+//   }
+func Extract(h http.Header) (trace *monkit.Trace, spanId int64, ok bool) {
+	traceId, err := parseId(h.Get(TraceIdHeader))
+	if err != nil {
+		return nil, 0, false
+	}
+	spanId, err = parseId(h.Get(SpanIdHeader))
+	if err != nil {
+		return nil, 0, false
+	}
+	trace = monkit.NewTrace(traceId)
+	switch {
+	case h.Get(FlagsHeader) == "1":
+		trace.SetSamplingPriority(1)
+	case h.Get(SampledHeader) == "1" || h.Get(SampledHeader) == "true":
+		trace.SetSampled(true)
+	}
+	return trace, spanId, true
+}
+
+func parseId(val string) (int64, error) {
+	// 128 bit trace ids are truncated to their lower 64 bits
+	if len(val) > 16 {
+		val = val[len(val)-16:]
+	}
+	id, err := strconv.ParseUint(val, 16, 64)
+	return int64(id), err
+}
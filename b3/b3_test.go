@@ -0,0 +1,59 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b3
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"gopkg.in/spacemonkeygo/monkit.v2"
+)
+
+func TestExtractDebug(t *testing.T) {
+	h := http.Header{}
+	h.Set(TraceIdHeader, "80f198ee56343ba864fe8b2a57d3eff7")
+	h.Set(SpanIdHeader, "e457b5a2e4d86bd1")
+	h.Set(FlagsHeader, "1")
+
+	trace, spanId, ok := Extract(h)
+	if !ok {
+		t.Fatal("expected valid b3 headers")
+	}
+	if trace.Id() != 0x64fe8b2a57d3eff7 || spanId != int64(-0x1ba84a5d1b27942f) {
+		t.Fatalf("unexpected ids %x, %x", trace.Id(), spanId)
+	}
+	if !trace.Sampled() || trace.SamplingPriority() != 1 {
+		t.Fatal("debug flag should force sampling")
+	}
+}
+
+func TestInjectDebug(t *testing.T) {
+	f := monkit.NewRegistry().ScopeNamed("b3").FuncNamed("client")
+	ctx := context.Background()
+	defer f.Task(&ctx)(nil)
+	s := monkit.SpanFromCtx(ctx)
+	s.SetSamplingPriority(1)
+
+	h := http.Header{}
+	Inject(s, h)
+	if h.Get(FlagsHeader) != "1" {
+		t.Fatal("expected debug flag")
+	}
+	trace, _, ok := Extract(h)
+	if !ok || trace.Id() != s.Trace().Id() || trace.SamplingPriority() != 1 {
+		t.Fatal("expected trace to round trip")
+	}
+}
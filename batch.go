@@ -0,0 +1,233 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BatchExporter buffers SpanData and hands it off to a flush function in
+// batches, either once a batch fills up or once the flush interval passes.
+// Failed flushes are retried with exponential backoff, and the batch is
+// dropped only once the retries are exhausted. If spans are added faster
+// than they can be flushed, new spans are dropped once the buffer holds
+// MaxPending spans. Both kinds of drops are counted (see DroppedCount).
+//
+// BatchExporter implements SpanObserver, so exporters can embed it and only
+// provide the flush function:
+//
+//   type myExporter struct {
+//     *monkit.BatchExporter
+//   }
+//
+//   func newMyExporter() *myExporter {
+//     e := &myExporter{}
+//     e.BatchExporter = monkit.NewBatchExporter(e.send, 100, time.Second)
+//     return e
+//   }
+type BatchExporter struct {
+	// sync/atomic things
+	dropped int64
+
+	// construction
+	flush    func([]SpanData) error
+	size     int
+	interval time.Duration
+	kick     chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+
+	// protected by mtx
+	mtx        sync.Mutex
+	pending    []SpanData
+	inflight   int
+	maxPending int
+	retries    int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// Defaults NewBatchExporter uses in place of a size or interval that isn't
+// positive.
+const (
+	DefaultBatchSize     = 100
+	DefaultBatchInterval = 5 * time.Second
+)
+
+// NewBatchExporter creates a BatchExporter that calls flush with batches of
+// up to size spans at least every interval. A size or interval of zero or
+// less means DefaultBatchSize or DefaultBatchInterval. By default, failed
+// flushes are retried 5 times with backoff starting at 100ms and capped at
+// 10s, and up to 100 batches worth of spans are buffered. See SetRetries
+// and SetMaxPending. Call Stop when done with the BatchExporter.
+func NewBatchExporter(flush func([]SpanData) error, size int,
+	interval time.Duration) *BatchExporter {
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+	if interval <= 0 {
+		interval = DefaultBatchInterval
+	}
+	e := &BatchExporter{
+		flush:      flush,
+		size:       size,
+		interval:   interval,
+		kick:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+		maxPending: 100 * size,
+		retries:    5,
+		minBackoff: 100 * time.Millisecond,
+		maxBackoff: 10 * time.Second,
+	}
+	go e.run()
+	return e
+}
+
+// SetRetries changes how many times a failed flush is retried before its
+// batch is dropped, and the bounds of the exponential backoff between
+// retries.
+func (e *BatchExporter) SetRetries(retries int,
+	minBackoff, maxBackoff time.Duration) {
+	e.mtx.Lock()
+	e.retries = retries
+	e.minBackoff = minBackoff
+	e.maxBackoff = maxBackoff
+	e.mtx.Unlock()
+}
+
+// SetMaxPending changes how many spans can be buffered before new spans are
+// dropped.
+func (e *BatchExporter) SetMaxPending(max int) {
+	e.mtx.Lock()
+	e.maxPending = max
+	e.mtx.Unlock()
+}
+
+// Add buffers a span for export.
+func (e *BatchExporter) Add(data SpanData) {
+	e.mtx.Lock()
+	if len(e.pending) >= e.maxPending {
+		e.mtx.Unlock()
+		atomic.AddInt64(&e.dropped, 1)
+		return
+	}
+	e.pending = append(e.pending, data)
+	full := len(e.pending) >= e.size
+	e.mtx.Unlock()
+	if full {
+		e.kickFlush()
+	}
+}
+
+func (e *BatchExporter) kickFlush() {
+	select {
+	case e.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Start implements the SpanObserver interface.
+func (e *BatchExporter) Start(s *Span) {}
+
+// Finish implements the SpanObserver interface. Spans of Traces that
+// requested a flush (see Trace.FlushRequested) are flushed right away
+// rather than waiting for a full batch or the flush interval.
+func (e *BatchExporter) Finish(s *Span, err error, panicked bool,
+	finish time.Time) {
+	e.Add(*NewSpanData(s, err, panicked, finish))
+	if s.Trace().FlushRequested() {
+		e.kickFlush()
+	}
+}
+
+// PendingCount returns how many spans are buffered or being flushed.
+func (e *BatchExporter) PendingCount() int {
+	e.mtx.Lock()
+	count := len(e.pending) + e.inflight
+	e.mtx.Unlock()
+	return count
+}
+
+// DroppedCount returns how many spans have been dropped, either because the
+// buffer was full or because their batch could not be flushed.
+func (e *BatchExporter) DroppedCount() int64 {
+	return atomic.LoadInt64(&e.dropped)
+}
+
+// Stop flushes any buffered spans and stops the BatchExporter. It blocks
+// until the final flush, including retries, is done.
+func (e *BatchExporter) Stop() {
+	e.stopOnce.Do(func() { close(e.done) })
+	<-e.stopped
+}
+
+func (e *BatchExporter) run() {
+	defer close(e.stopped)
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.done:
+			for e.flushBatch() {
+			}
+			return
+		case <-ticker.C:
+			for e.flushBatch() {
+			}
+		case <-e.kick:
+			e.flushBatch()
+		}
+	}
+}
+
+// flushBatch flushes up to one batch of pending spans, and returns false if
+// there was nothing to flush.
+func (e *BatchExporter) flushBatch() bool {
+	e.mtx.Lock()
+	n := len(e.pending)
+	if n == 0 {
+		e.mtx.Unlock()
+		return false
+	}
+	if n > e.size {
+		n = e.size
+	}
+	batch := append([]SpanData(nil), e.pending[:n]...)
+	e.pending = append(e.pending[:0], e.pending[n:]...)
+	e.inflight = n
+	retries, backoff, maxBackoff := e.retries, e.minBackoff, e.maxBackoff
+	e.mtx.Unlock()
+
+	for attempt := 0; e.flush(batch) != nil; attempt++ {
+		if attempt >= retries {
+			atomic.AddInt64(&e.dropped, int64(len(batch)))
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+
+	e.mtx.Lock()
+	e.inflight = 0
+	e.mtx.Unlock()
+	return true
+}
@@ -0,0 +1,120 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBatchExporterRetries(t *testing.T) {
+	var mtx sync.Mutex
+	var failures, flushed int
+	e := NewBatchExporter(func(batch []SpanData) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if failures < 2 {
+			failures++
+			return errors.New("network hiccup")
+		}
+		flushed += len(batch)
+		return nil
+	}, 3, time.Hour)
+	e.SetRetries(3, time.Millisecond, 10*time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		e.Add(SpanData{Id: int64(i)})
+	}
+	e.Stop()
+
+	if flushed != 3 {
+		t.Fatalf("expected 3 flushed spans, got %d", flushed)
+	}
+	if e.PendingCount() != 0 || e.DroppedCount() != 0 {
+		t.Fatalf("expected nothing pending or dropped, got %d and %d",
+			e.PendingCount(), e.DroppedCount())
+	}
+}
+
+func TestBatchExporterDrops(t *testing.T) {
+	e := NewBatchExporter(func(batch []SpanData) error {
+		return errors.New("down")
+	}, 2, time.Hour)
+	e.SetRetries(1, time.Millisecond, time.Millisecond)
+	e.Add(SpanData{})
+	e.Add(SpanData{})
+	e.Stop()
+	if e.DroppedCount() != 2 {
+		t.Fatalf("expected 2 dropped spans, got %d", e.DroppedCount())
+	}
+}
+
+func TestBatchExporterDefaults(t *testing.T) {
+	var flushed int
+	e := NewBatchExporter(func(batch []SpanData) error {
+		flushed += len(batch)
+		return nil
+	}, 0, -time.Second)
+	if e.size != DefaultBatchSize || e.interval != DefaultBatchInterval {
+		t.Fatalf("expected defaults, got %d and %v", e.size, e.interval)
+	}
+	e.Add(SpanData{})
+	e.Stop()
+	if flushed != 1 || e.DroppedCount() != 0 {
+		t.Fatalf("expected 1 flushed span, got %d", flushed)
+	}
+}
+
+func TestRegistryFlushOnAnnotation(t *testing.T) {
+	r := NewRegistry()
+	r.SetFlushOnAnnotation("slo.breach")
+	flushed := make(chan []SpanData, 1)
+	e := NewBatchExporter(func(batch []SpanData) error {
+		flushed <- batch
+		return nil
+	}, 100, time.Hour)
+	defer e.Stop()
+	r.ObserveTraces(func(t *Trace) { t.ObserveSpans(e) })
+	f := r.ScopeNamed("flush").FuncNamed("work")
+
+	ctx := context.Background()
+	f.Task(&ctx)(nil)
+	if trace := SpanFromCtx(ctx).Trace(); trace.FlushRequested() ||
+		trace.Sampled() {
+		t.Fatal("trace shouldn't be flagged without the annotation")
+	}
+
+	ctx = context.Background()
+	done := f.Task(&ctx)
+	SpanFromCtx(ctx).Annotate("slo.breach", "p99")
+	trace := SpanFromCtx(ctx).Trace()
+	if !trace.FlushRequested() || !trace.Sampled() ||
+		trace.SamplingPriority() <= 0 {
+		t.Fatal("trace should be force sampled and flagged for flushing")
+	}
+	done(nil)
+
+	select {
+	case batch := <-flushed:
+		if len(batch) != 2 || batch[1].TraceId != trace.Id() {
+			t.Fatalf("unexpected batch %v", batch)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("flagged trace wasn't flushed right away")
+	}
+}
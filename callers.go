@@ -19,6 +19,16 @@ import (
 	"strings"
 )
 
+// callerStack returns up to depth program counters of the call stack,
+// skipping frames frames above the caller of callerStack.
+func callerStack(frames, depth int) []uintptr {
+	if depth <= 0 {
+		return nil
+	}
+	pcs := make([]uintptr, depth)
+	return pcs[:runtime.Callers(frames+2, pcs)]
+}
+
 func callerPackage(frames int) string {
 	pc, _, _, ok := runtime.Caller(frames + 1)
 	if !ok {
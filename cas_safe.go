@@ -29,6 +29,12 @@ func loadFunc(addr **Func) (s *Func) {
 	return s
 }
 
+func storeFunc(addr **Func, val *Func) {
+	bigHonkinMutex.Lock()
+	*addr = val
+	bigHonkinMutex.Unlock()
+}
+
 func compareAndSwapFunc(addr **Func, old, new *Func) bool {
 	bigHonkinMutex.Lock()
 	val := *addr
@@ -54,6 +60,21 @@ func storeTraceWatcherRef(addr **traceWatcherRef, val *traceWatcherRef) {
 	bigHonkinMutex.Unlock()
 }
 
+func loadDefaultAnnotationsRef(
+	addr **defaultAnnotationsRef) (val *defaultAnnotationsRef) {
+	bigHonkinMutex.Lock()
+	val = *addr
+	bigHonkinMutex.Unlock()
+	return val
+}
+
+func storeDefaultAnnotationsRef(addr **defaultAnnotationsRef,
+	val *defaultAnnotationsRef) {
+	bigHonkinMutex.Lock()
+	*addr = val
+	bigHonkinMutex.Unlock()
+}
+
 func compareAndSwapSpanObserverTuple(addr **spanObserverTuple,
 	old, new *spanObserverTuple) bool {
 	bigHonkinMutex.Lock()
@@ -30,6 +30,12 @@ func loadFunc(addr **Func) (val *Func) {
 		(*unsafe.Pointer)(unsafe.Pointer(addr))))
 }
 
+func storeFunc(addr **Func, val *Func) {
+	atomic.StorePointer(
+		(*unsafe.Pointer)(unsafe.Pointer(addr)),
+		unsafe.Pointer(val))
+}
+
 func compareAndSwapFunc(addr **Func, old, new *Func) bool {
 	return atomic.CompareAndSwapPointer(
 		(*unsafe.Pointer)(unsafe.Pointer(addr)),
@@ -52,6 +58,23 @@ func storeTraceWatcherRef(addr **traceWatcherRef, val *traceWatcherRef) {
 		unsafe.Pointer(val))
 }
 
+//
+// *defaultAnnotationsRef atomic functions
+//
+
+func loadDefaultAnnotationsRef(
+	addr **defaultAnnotationsRef) (val *defaultAnnotationsRef) {
+	return (*defaultAnnotationsRef)(atomic.LoadPointer(
+		(*unsafe.Pointer)(unsafe.Pointer(addr))))
+}
+
+func storeDefaultAnnotationsRef(addr **defaultAnnotationsRef,
+	val *defaultAnnotationsRef) {
+	atomic.StorePointer(
+		(*unsafe.Pointer)(unsafe.Pointer(addr)),
+		unsafe.Pointer(val))
+}
+
 //
 // *spanObserverTuple atomic functons
 //
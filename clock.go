@@ -0,0 +1,110 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/spacemonkeygo/monotime"
+)
+
+// SetTimeResolution trades Span timing precision for speed. With a positive
+// resolution, Spans read their start and finish times from a cached clock
+// that a background goroutine updates every d, instead of reading the
+// precise clock on every start and finish. Durations are then only accurate
+// to within about d. Zero (the default) uses the precise clock. The
+// background goroutine is stopped by Shutdown or by setting the resolution
+// back to zero.
+func (r *Registry) SetTimeResolution(d time.Duration) {
+	r.clockMtx.Lock()
+	defer r.clockMtx.Unlock()
+	if r.clockStop != nil {
+		close(r.clockStop)
+		r.clockStop = nil
+	}
+	if d <= 0 {
+		atomic.StoreInt64(&r.timeResolution, 0)
+		return
+	}
+	r.coarseNow.Store(monotime.Now())
+	atomic.StoreInt64(&r.timeResolution, int64(d))
+
+	stop := make(chan struct{})
+	r.clockStop = stop
+	go func() {
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				r.coarseNow.Store(monotime.Now())
+			}
+		}
+	}()
+	if !r.clockHooked {
+		r.clockHooked = true
+		r.onShutdown(func() {
+			r.clockMtx.Lock()
+			if r.clockStop != nil {
+				close(r.clockStop)
+				r.clockStop = nil
+				atomic.StoreInt64(&r.timeResolution, 0)
+			}
+			r.clockMtx.Unlock()
+		})
+	}
+}
+
+// TimeResolution returns the resolution set with SetTimeResolution.
+func (r *Registry) TimeResolution() time.Duration {
+	return time.Duration(atomic.LoadInt64(&r.timeResolution))
+}
+
+// SetWallClock replaces the clock that Spans read their absolute start
+// times from (see Span.WallStart), which exporters use for timestamps, so
+// tests can produce deterministic output. Durations keep coming from the
+// monotonic clock, configured separately with SetTimeResolution. A nil now
+// restores the default of time.Now.
+func (r *Registry) SetWallClock(now func() time.Time) {
+	r.wallClock.Store(wallClockRef{now: now})
+}
+
+type wallClockRef struct {
+	now func() time.Time
+}
+
+// wallNow returns the current time from the clock set with SetWallClock.
+func (r *Registry) wallNow() time.Time {
+	if ref, _ := r.wallClock.Load().(wallClockRef); ref.now != nil {
+		return ref.now()
+	}
+	return time.Now()
+}
+
+// now returns the current time for Span timing. See SetTimeResolution.
+func (r *Registry) now() time.Time {
+	if r.testClock != nil {
+		return r.testClock()
+	}
+	if atomic.LoadInt64(&r.timeResolution) > 0 {
+		if now, ok := r.coarseNow.Load().(time.Time); ok {
+			return now
+		}
+	}
+	return monotime.Now()
+}
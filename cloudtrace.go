@@ -0,0 +1,188 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CloudTraceEndpoint is the default Google Cloud Trace API endpoint.
+const CloudTraceEndpoint = "https://cloudtrace.googleapis.com"
+
+// CloudTraceObserver is a SpanObserver that exports finished Spans on
+// sampled Traces (see Trace.Sampled) to Google Cloud Trace, through the v2
+// projects.traces.batchWrite API. Spans are named after their Func, and
+// their annotations become span attributes.
+//
+// Requests are sent with the given http.Client, which is expected to take
+// care of authentication. monkit doesn't depend on the Google client
+// libraries, so use something like golang.org/x/oauth2/google, which walks
+// the standard credentials chain:
+//
+//   client, err := google.DefaultClient(ctx,
+//     "https://www.googleapis.com/auth/trace.append")
+//   ...
+//   o := monkit.NewCloudTraceObserver(client, "", "my-project")
+//   defer o.Stop()
+//   monkit.Default.ObserveTraces(func(t *monkit.Trace) { t.ObserveSpans(o) })
+//
+// CloudTraceObserver is a BatchExporter underneath, so see BatchExporter for
+// how batching, retries and drops work.
+type CloudTraceObserver struct {
+	*BatchExporter
+	client   *http.Client
+	endpoint string
+	project  string
+}
+
+// NewCloudTraceObserver creates a CloudTraceObserver that writes Spans into
+// the given Google Cloud project. An empty endpoint means
+// CloudTraceEndpoint, and a nil client means http.DefaultClient. Call Stop
+// when done.
+func NewCloudTraceObserver(client *http.Client, endpoint,
+	project string) *CloudTraceObserver {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if endpoint == "" {
+		endpoint = CloudTraceEndpoint
+	}
+	o := &CloudTraceObserver{
+		client:   client,
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		project:  project,
+	}
+	o.BatchExporter = NewBatchExporter(o.send, DefaultBatchSize,
+		DefaultBatchInterval)
+	return o
+}
+
+// Finish implements the SpanObserver interface. Spans on Traces that aren't
+// sampled are skipped.
+func (o *CloudTraceObserver) Finish(s *Span, err error, panicked bool,
+	finish time.Time) {
+	if !s.Trace().Sampled() {
+		return
+	}
+	o.BatchExporter.Finish(s, err, panicked, finish)
+}
+
+type cloudTraceString struct {
+	Value string `json:"value"`
+}
+
+type cloudTraceAttribute struct {
+	StringValue cloudTraceString `json:"stringValue"`
+}
+
+type cloudTraceAttributes struct {
+	AttributeMap map[string]cloudTraceAttribute `json:"attributeMap"`
+}
+
+type cloudTraceStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type cloudTraceSpan struct {
+	Name         string                `json:"name"`
+	SpanId       string                `json:"spanId"`
+	ParentSpanId string                `json:"parentSpanId,omitempty"`
+	DisplayName  cloudTraceString      `json:"displayName"`
+	StartTime    string                `json:"startTime"`
+	EndTime      string                `json:"endTime"`
+	Attributes   *cloudTraceAttributes `json:"attributes,omitempty"`
+	Status       *cloudTraceStatus     `json:"status,omitempty"`
+}
+
+// cloudTraceUnknown is the google.rpc.Code Cloud Trace expects for failed
+// Spans.
+const cloudTraceUnknown = 2
+
+func (o *CloudTraceObserver) convert(data *SpanData) cloudTraceSpan {
+	start, finish := data.WallTimes()
+	span := cloudTraceSpan{
+		Name: fmt.Sprintf("projects/%s/traces/%s/spans/%s", o.project,
+			FormatId(data.TraceId, Hex128), FormatId(data.Id, Hex64)),
+		SpanId:      FormatId(data.Id, Hex64),
+		DisplayName: cloudTraceString{Value: data.FullName()},
+		StartTime:   start.UTC().Format(time.RFC3339Nano),
+		EndTime:     finish.UTC().Format(time.RFC3339Nano),
+	}
+	if data.ParentId != 0 {
+		span.ParentSpanId = FormatId(data.ParentId, Hex64)
+	}
+	if len(data.Annotations) > 0 || len(data.Tags) > 0 {
+		span.Attributes = &cloudTraceAttributes{
+			AttributeMap: map[string]cloudTraceAttribute{}}
+		for _, annotation := range data.Annotations {
+			span.Attributes.AttributeMap[annotation.Name] = cloudTraceAttribute{
+				StringValue: cloudTraceString{Value: annotation.Value}}
+		}
+		// tags are meant for indexing, so they win over annotations
+		for key, val := range data.Tags {
+			span.Attributes.AttributeMap[key] = cloudTraceAttribute{
+				StringValue: cloudTraceString{Value: val}}
+		}
+	}
+	switch {
+	case data.Status == StatusCodeOk:
+	case data.Status == StatusCodeError:
+		span.Status = &cloudTraceStatus{Code: cloudTraceUnknown,
+			Message: data.StatusMessage}
+	case data.Panicked:
+		span.Status = &cloudTraceStatus{Code: cloudTraceUnknown,
+			Message: "panic"}
+	case data.Err != nil:
+		span.Status = &cloudTraceStatus{Code: cloudTraceUnknown,
+			Message: data.Err.Error()}
+	}
+	return span
+}
+
+func (o *CloudTraceObserver) send(batch []SpanData) error {
+	req := struct {
+		Spans []cloudTraceSpan `json:"spans"`
+	}{Spans: make([]cloudTraceSpan, 0, len(batch))}
+	for i := range batch {
+		req.Spans = append(req.Spans, o.convert(&batch[i]))
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := o.client.Post(
+		fmt.Sprintf("%s/v2/projects/%s/traces:batchWrite", o.endpoint,
+			o.project),
+		"application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("cloud trace: %s: %s", resp.Status,
+			bytes.TrimSpace(msg))
+	}
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	return err
+}
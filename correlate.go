@@ -0,0 +1,169 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"container/list"
+	"time"
+)
+
+const (
+	// DefaultCorrelationTTL is how long a correlation key is remembered
+	// after a Span was last linked to it. See Registry.LinkByKey.
+	DefaultCorrelationTTL = time.Hour
+
+	// DefaultMaxCorrelationKeys is how many correlation keys a Registry
+	// remembers at most. See Registry.LinkByKey.
+	DefaultMaxCorrelationKeys = 10000
+
+	// MaxSpansPerCorrelationKey is how many Spans are remembered per
+	// correlation key. Older Spans are forgotten first.
+	MaxSpansPerCorrelationKey = 100
+)
+
+type correlation struct {
+	key    string
+	linked time.Time
+	spans  []correlatedSpan
+}
+
+// correlatedSpan holds a running Span until it finishes, and then only its
+// SpanData, so the Span tree can be garbage collected.
+type correlatedSpan struct {
+	span *Span
+	data *SpanData
+}
+
+type correlations struct {
+	ttl     time.Duration
+	maxKeys int
+	keys    map[string]*list.Element
+	lru     list.List // of *correlation, most recently linked first
+}
+
+// SetCorrelationLimits changes how long correlation keys are remembered
+// after a Span was last linked to them, and how many are remembered at
+// most, least recently linked keys being forgotten first. See LinkByKey.
+func (r *Registry) SetCorrelationLimits(ttl time.Duration, maxKeys int) {
+	r.correlationMtx.Lock()
+	r.correlations.ttl = ttl
+	r.correlations.maxKeys = maxKeys
+	r.correlations.expire(time.Now())
+	r.correlationMtx.Unlock()
+}
+
+// LinkByKey records that s relates to a business key, such as an order id,
+// so that operations that don't share a Trace, because there was no
+// context to propagate between them, can still be found together with
+// SpansForKey. A Span can be linked to more than one key. Keys are
+// remembered for DefaultCorrelationTTL after they were last linked to, up
+// to DefaultMaxCorrelationKeys keys and MaxSpansPerCorrelationKey Spans per
+// key; see SetCorrelationLimits.
+func (r *Registry) LinkByKey(key string, s *Span) {
+	if s.noop {
+		return
+	}
+	now := time.Now()
+	// hold correlationMtx so s can't finish before it's linked below
+	r.correlationMtx.Lock()
+	defer r.correlationMtx.Unlock()
+
+	s.mtx.Lock()
+	done, finish := s.done, s.finished()
+	if !done {
+		ext := s.setExt()
+		ext.correlationKeys = append(ext.correlationKeys, key)
+	}
+	s.mtx.Unlock()
+	linked := correlatedSpan{span: s}
+	if done {
+		// too late to hear about s finishing
+		linked = correlatedSpan{data: NewSpanData(s, nil, false, finish)}
+	}
+
+	c := &r.correlations
+	if c.keys == nil {
+		c.keys = map[string]*list.Element{}
+	}
+	elem := c.keys[key]
+	if elem == nil {
+		elem = c.lru.PushFront(&correlation{key: key})
+		c.keys[key] = elem
+	} else {
+		c.lru.MoveToFront(elem)
+	}
+	corr := elem.Value.(*correlation)
+	corr.linked = now
+	corr.spans = append(corr.spans, linked)
+	if len(corr.spans) > MaxSpansPerCorrelationKey {
+		corr.spans = append(corr.spans[:0],
+			corr.spans[len(corr.spans)-MaxSpansPerCorrelationKey:]...)
+	}
+	c.expire(now)
+}
+
+// SpansForKey returns the Spans linked to key with LinkByKey, oldest link
+// first. Spans that are still running are included as snapshots with a
+// zero Finish time.
+func (r *Registry) SpansForKey(key string) []SpanData {
+	r.correlationMtx.Lock()
+	r.correlations.expire(time.Now())
+	var linked []correlatedSpan
+	if elem := r.correlations.keys[key]; elem != nil {
+		linked = append(linked, elem.Value.(*correlation).spans...)
+	}
+	r.correlationMtx.Unlock()
+
+	rv := make([]SpanData, 0, len(linked))
+	for _, l := range linked {
+		if l.data != nil {
+			rv = append(rv, *l.data)
+		} else {
+			rv = append(rv, *NewSpanData(l.span, nil, false, time.Time{}))
+		}
+	}
+	return rv
+}
+
+// finishCorrelated swaps s for its final SpanData under each of its keys.
+func (r *Registry) finishCorrelated(s *Span, keys []string, data *SpanData) {
+	r.correlationMtx.Lock()
+	for _, key := range keys {
+		elem := r.correlations.keys[key]
+		if elem == nil {
+			continue
+		}
+		corr := elem.Value.(*correlation)
+		for i := range corr.spans {
+			if corr.spans[i].span == s {
+				corr.spans[i] = correlatedSpan{data: data}
+			}
+		}
+	}
+	r.correlationMtx.Unlock()
+}
+
+// expire forgets keys past the TTL or the key limit. It expects the
+// Registry's correlationMtx to be held.
+func (c *correlations) expire(now time.Time) {
+	for elem := c.lru.Back(); elem != nil; elem = c.lru.Back() {
+		corr := elem.Value.(*correlation)
+		if c.lru.Len() <= c.maxKeys && now.Sub(corr.linked) <= c.ttl {
+			return
+		}
+		c.lru.Remove(elem)
+		delete(c.keys, corr.key)
+	}
+}
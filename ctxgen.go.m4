@@ -34,21 +34,30 @@ import (
 type Span struct {
 	// sync/atomic things
 	mtx spinLock
+	// these share mtx's word. noop is immutable, the rest are protected by
+	// mtx.
+	noop     bool
+	done     bool
+	orphaned bool
+	moved    *Func // see SetFunc
 
-	// immutable things from construction
-	id     int64
-	start  time.Time
-	f      *Func
-	trace  *Trace
-	parent *Span
-	args   []interface{}
+	// immutable things from construction. accessors for these must never
+	// take mtx. see Summary.
+	id       int64
+	start    time.Time
+	wall     time.Time // see WallStart
+	f        *Func     // the original Func, see Func
+	trace    *Trace
+	parent   *Span
+	args     []interface{}
+	observer SpanObserver
 	context.Context
 
 	// protected by mtx
-	done        bool
-	orphaned    bool
-	children    spanBag
+	elapsed     time.Duration // how long after start it finished, see finished
+	children    SpanBag       // nil until the first child is added
 	annotations []Annotation
+	ext         *spanExt // nil until needed, see spanExt
 }
 
 // SpanFromCtx loads the current Span from the given context. This assumes
@@ -62,90 +71,190 @@ func SpanFromCtx(ctx context.Context) *Span {
 	return nil
 }
 
+// UnderlyingContext returns the context.Context the Span wraps, as opposed to
+// the Span itself acting as a context.Context. If the Span was started from a
+// context that was itself a Span, this is that parent Span's underlying
+// context.
+func (s *Span) UnderlyingContext() context.Context {
+	return s.Context
+}
+
+// TraceIdFromCtx returns the id of the Trace of the current Span in the given
+// context, if there is one. See SpanFromCtx.
+func TraceIdFromCtx(ctx context.Context) (id int64, ok bool) {
+	if s := SpanFromCtx(ctx); s != nil {
+		return s.Trace().Id(), true
+	}
+	return 0, false
+}
+
+// SpanIdFromCtx returns the id of the current Span in the given context, if
+// there is one. See SpanFromCtx.
+func SpanIdFromCtx(ctx context.Context) (id int64, ok bool) {
+	if s := SpanFromCtx(ctx); s != nil {
+		return s.Id(), true
+	}
+	return 0, false
+}
+
+// BaggageContext returns a context for work that outlives the Span, such as
+// a fire-and-forget goroutine, that carries a snapshot of the Trace's
+// current baggage items (see BaggageFromCtx) but neither the Span nor the
+// Span's deadline, cancellation, or values.
+func (s *Span) BaggageContext() context.Context {
+	return context.WithValue(context.Background(), baggageKey,
+		s.trace.Baggage())
+}
+
+// BaggageFromCtx returns a copy of the baggage items of the current Span's
+// Trace in the given context, or of the snapshot taken by
+// Span.BaggageContext if there's no current Span.
+func BaggageFromCtx(ctx context.Context) map[string]string {
+	if s := SpanFromCtx(ctx); s != nil {
+		return s.trace.Baggage()
+	}
+	baggage, _ := ctx.Value(baggageKey).(map[string]string)
+	rv := map[string]string{}
+	for key, val := range baggage {
+		rv[key] = val
+	}
+	return rv
+}
+
 func newSpan(ctx context.Context, f *Func, args []interface{},
-	id int64, trace *Trace) (s *Span, exit func(*error)) {
+	id int64, trace *Trace) (s *Span) {
+	return newSpanWith(ctx, f, args, id, trace, spanOptions{})
+}
+
+// spanOptions are the optional parts of a new Span, which have to be in
+// place before any SpanObserver hears about the Span.
+type spanOptions struct {
+	start         time.Time // overrides the start time if set, see TaskAt
+	argNames      []string
+	creationStack []uintptr
+	cancel        func()
+}
+
+// newSpanWith is like newSpan, but with options.
+func newSpanWith(ctx context.Context, f *Func, args []interface{},
+	id int64, trace *Trace, opts spanOptions) (s *Span) {
+
+	if f.scope.isClosed() {
+		// the scope has been torn down. hand back a span that isn't attached
+		// to anything so we never touch registry, trace, or func state.
+		f.scope.r.lateSpan()
+		if trace == nil {
+			if parent := SpanFromCtx(ctx); parent != nil {
+				trace = parent.trace
+			} else {
+				trace = NewTrace(id)
+			}
+		}
+		return &Span{
+			id:      id,
+			start:   monotime.Now(),
+			f:       f,
+			trace:   trace,
+			args:    args,
+			noop:    true,
+			Context: ctx}
+	}
 
 	var parent *Span
-	if s, ok := ctx.(*Span); ok && s != nil {
+	if s, ok := ctx.(*Span); ok && s != nil && !s.noop {
 		ctx = s.Context
 		if trace == nil {
 			parent = s
 			trace = parent.trace
+		} else {
+			trace.inheritSampled(s.trace)
 		}
 	} else if s, ok := ctx.Value(spanKey).(*Span); ok && s != nil {
 		if trace == nil {
 			parent = s
 			trace = parent.trace
+		} else {
+			trace.inheritSampled(s.trace)
 		}
 	} else if trace == nil {
-		trace = NewTrace(id)
-		f.scope.r.observeTrace(trace)
+		if s := f.scope.r.CurrentSpan(); s != nil && !s.noop {
+			// see SetCurrentSpan
+			parent = s
+			trace = parent.trace
+		} else if trace = f.scope.r.adopted(); trace == nil {
+			trace = NewTrace(id)
+			f.scope.r.startTrace(trace)
+		}
 	}
 
-	observer := trace.getObserver()
+	var finishedParent *Span
+	if parent != nil && parent.isDone() {
+		// usually a goroutine that outlived the task that started it.
+		finishedParent = parent
+		if f.scope.r.FinishedParentPolicy() == DetachFinishedParent {
+			parent = nil
+		}
+	}
+
+	start, wallStart := opts.start, opts.start
+	if start.IsZero() {
+		start = f.scope.r.now()
+		wallStart = f.scope.r.wallNow()
+	}
 
 	s = &Span{
-		id:      id,
-		start:   monotime.Now(),
-		f:       f,
-		trace:   trace,
-		parent:  parent,
-		args:    args,
-		Context: ctx}
+		id:       id,
+		start:    start,
+		wall:     wallStart,
+		f:        f,
+		trace:    trace,
+		parent:   parent,
+		args:     args,
+		observer: trace.getObserver(),
+		Context:  ctx}
 
-	if parent != nil {
-		f.start(parent.f)
-		parent.addChild(s)
-	} else {
-		f.start(nil)
-		f.scope.r.rootSpanStart(s)
+	if opts.argNames != nil || opts.creationStack != nil ||
+		opts.cancel != nil {
+		s.ext = &spanExt{
+			argNames:      opts.argNames,
+			creationStack: opts.creationStack,
+			cancel:        opts.cancel}
 	}
 
-	if observer != nil {
-		observer.Start(s)
+	if _, ok := ctx.Deadline(); ok {
+		// deadlines are real time, whatever the Registry's clocks say. see
+		// annotateBudget.
+		budgetStart := opts.start
+		if budgetStart.IsZero() {
+			budgetStart = time.Now()
+		}
+		s.setExt().budgetStart = budgetStart
 	}
 
-	return s, func(errptr *error) {
-		rec := recover()
-		panicked := rec != nil
+	if finishedParent != nil {
+		s.annotations = []Annotation{finishedParentAnnotation(finishedParent)}
+	}
 
-		finish := monotime.Now()
+	s.limitArgs()
 
-		var err error
-		if errptr != nil {
-			err = *errptr
-		}
-		s.f.end(err, panicked, finish.Sub(s.start))
-
-		var children []*Span
-		s.mtx.Lock()
-		s.done = true
-		orphaned := s.orphaned
-		s.children.Iterate(func(child *Span) {
-			children = append(children, child)
-		})
-		s.mtx.Unlock()
-		for _, child := range children {
-			child.orphan()
-		}
+	trace.spanStarted()
 
-		if s.parent != nil {
-			s.parent.removeChild(s)
-			if orphaned {
-				s.f.scope.r.orphanEnd(s)
-			}
-		} else {
-			s.f.scope.r.rootSpanEnd(s)
-		}
+	if parent != nil {
+		f.start(parent.Func())
+		parent.addChild(s)
+	} else {
+		f.start(nil)
+		f.scope.r.rootSpanStart(s)
+		f.scope.r.sampleRoot(s)
+	}
 
-		if observer != nil {
-			observer.Finish(s, err, panicked, finish)
-		}
+	f.scope.r.annotateDefaults(s)
 
-		if panicked {
-			panic(rec)
-		}
+	if s.observer != nil {
+		observeStart(s.observer, s)
 	}
+
+	return s
 }
 
 var taskSecret context.Context = &taskSecretT{}
@@ -197,9 +306,9 @@ func (s *Scope) Task() Task {
 			return nil
 		}
 		initOnce.Do(init)
-		s, exit := newSpan(*ctx, f, args, NewId(), nil)
+		s := newSpan(*ctx, f, args, f.scope.r.newId(), nil)
 		*ctx = s
-		return exit
+		return s.taskExit()
 	})
 }
 
@@ -221,9 +330,122 @@ func (f *Func) Task(ctx *context.Context, args ...interface{}) func(*error) {
 	if ctx == &taskSecret && taskArgs(f, args) {
 		return nil
 	}
-	s, exit := newSpan(*ctx, f, args, NewId(), nil)
+	s := newSpan(*ctx, f, args, f.scope.r.newId(), nil)
 	*ctx = s
-	return exit
+	return s.taskExit()
+}
+
+// TaskNamed is like Func.Task, except each argument is paired with the
+// parameter name at the same position in names, so traces can show labeled
+// arguments. See Span.NamedArgs.
+//
+//   var getArgNames = []string{"bucket", "key"}
+//
+//   func Get(ctx context.Context, bucket, key string) (err error) {
+//     defer mon.Func().TaskNamed(&ctx, getArgNames, bucket, key)(&err)
+//     ...
+//   }
+func (f *Func) TaskNamed(ctx *context.Context, names []string,
+	args ...interface{}) func(*error) {
+	ctx = cleanCtx(ctx)
+	if ctx == &taskSecret && taskArgs(f, args) {
+		return nil
+	}
+	s := newSpanWith(*ctx, f, args, f.scope.r.newId(), nil,
+		spanOptions{argNames: names})
+	*ctx = s
+	return s.taskExit()
+}
+
+// TaskWithCaller is like Func.Task, but also captures up to depth frames of
+// the call stack that started the Span, starting with the caller of
+// TaskWithCaller, for tracking down which code path creates problematic
+// Spans. Capturing stacks is relatively expensive, so it's opt in per call.
+// See Span.CreationStack.
+func (f *Func) TaskWithCaller(ctx *context.Context, depth int,
+	args ...interface{}) func(*error) {
+	ctx = cleanCtx(ctx)
+	if ctx == &taskSecret && taskArgs(f, args) {
+		return nil
+	}
+	stack := callerStack(1, depth)
+	s := newSpanWith(*ctx, f, args, f.scope.r.newId(), nil,
+		spanOptions{creationStack: stack})
+	*ctx = s
+	return s.taskExit()
+}
+
+// TaskRecover is like Func.Task, except the returned function won't re-panic
+// if the task panics. Instead, the panic is recorded on the Span and Func as
+// usual, and a *PanicError holding the recovered value is stored in the given
+// error pointer (if there is one). This is useful for supervised background
+// workers that shouldn't bring down the process.
+//
+//   func worker(ctx context.Context) (err error) {
+//     defer mon.Func().TaskRecover(&ctx)(&err)
+//     ...
+//   }
+func (f *Func) TaskRecover(ctx *context.Context,
+	args ...interface{}) func(*error) {
+	ctx = cleanCtx(ctx)
+	if ctx == &taskSecret && taskArgs(f, args) {
+		return nil
+	}
+	s := newSpan(*ctx, f, args, f.scope.r.newId(), nil)
+	*ctx = s
+	return s.recoverExit()
+}
+
+// TaskWithDeadline is like Func.Task, except the Span's context is derived with
+// context.WithDeadline, so the body of the task sees the deadline through
+// ctx. If the deadline passed by the time the Span finishes, the Span is
+// annotated with "deadline: exceeded". The derived context is canceled when
+// the Span finishes.
+//
+//   func MyFunc(ctx context.Context, deadline time.Time) (err error) {
+//     defer mon.Func().TaskWithDeadline(&ctx, deadline)(&err)
+//     ...
+//   }
+func (f *Func) TaskWithDeadline(ctx *context.Context, deadline time.Time,
+	args ...interface{}) func(*error) {
+	ctx = cleanCtx(ctx)
+	if ctx == &taskSecret && taskArgs(f, args) {
+		return nil
+	}
+	deadlineCtx, cancel := context.WithDeadline(*ctx, deadline)
+	s := newSpanWith(deadlineCtx, f, args, f.scope.r.newId(), nil,
+		spanOptions{cancel: cancel})
+	*ctx = s
+	return s.taskExit()
+}
+
+// TaskAt is like Func.Task, except the Span starts at the given time instead
+// of now. It's meant for building Spans out of historical data, such as
+// replayed logs. Finish the Span with Span.FinishAt to give it a matching
+// finish time:
+//
+//   ctx := context.Background()
+//   f.TaskAt(&ctx, entry.Start)
+//   monkit.SpanFromCtx(ctx).FinishAt(entry.Err, entry.Finish)
+//
+// Spans are normally timed with a monotonic clock, but a TaskAt Span's
+// duration depends entirely on the wall clock times it's given, so it's
+// meaningless to finish it with the returned function, which uses the
+// current time.
+func (f *Func) TaskAt(ctx *context.Context, start time.Time,
+	args ...interface{}) func(*error) {
+	ctx = cleanCtx(ctx)
+	if ctx == &taskSecret && taskArgs(f, args) {
+		return nil
+	}
+	s := newSpanWith(*ctx, f, args, f.scope.r.newId(), nil,
+		spanOptions{start: start})
+	*ctx = s
+	return s.taskExit()
+}
+
+func (s *Span) deadlineExceeded() bool {
+	return s.Context.Err() == context.DeadlineExceeded
 }
 
 // RemoteTrace is like Func.Task, except you can specify the trace and span id.
@@ -234,23 +456,25 @@ func (f *Func) RemoteTrace(ctx *context.Context, spanId int64, trace *Trace,
 	if trace != nil {
 		f.scope.r.observeTrace(trace)
 	}
-	s, exit := newSpan(*ctx, f, args, spanId, trace)
+	s := newSpan(*ctx, f, args, spanId, trace)
 	*ctx = s
-	return exit
+	return s.taskExit()
 }
 
-// ResetTrace is like Func.Task, except it always creates a new Trace.
+// ResetTrace is like Func.Task, except it always creates a new Trace. If the
+// given ctx already has a Span on a sampled Trace, the new Trace starts out
+// sampled too (see Trace.SetSampled to override that).
 func (f *Func) ResetTrace(ctx *context.Context,
 	args ...interface{}) func(*error) {
 	ctx = cleanCtx(ctx)
 	if ctx == &taskSecret && taskArgs(f, args) {
 		return nil
 	}
-	trace := NewTrace(NewId())
-	f.scope.r.observeTrace(trace)
-	s, exit := newSpan(*ctx, f, args, trace.Id(), trace)
+	trace := NewTrace(f.scope.r.newId())
+	f.scope.r.startTrace(trace)
+	s := newSpan(*ctx, f, args, trace.Id(), trace)
 	*ctx = s
-	return exit
+	return s.taskExit()
 }
 
 func cleanCtx(ctx *context.Context) *context.Context {
@@ -0,0 +1,124 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Environment variables read by ConfigureFromEnv.
+const (
+	EnvExporter   = "MONKIT_EXPORTER"
+	EnvEndpoint   = "MONKIT_ENDPOINT"
+	EnvSampleRate = "MONKIT_SAMPLE_RATE"
+)
+
+// ConfigureFromEnv sets up span exporting from environment variables, so
+// deployments can turn on tracing without code changes:
+//
+//   MONKIT_EXPORTER     which exporter to use: "json-log" (see
+//                       JSONLogObserver) or "otlp" (see OTLPObserver). if
+//                       unset, ConfigureFromEnv does nothing.
+//   MONKIT_ENDPOINT     where the exporter sends spans. for json-log, this is
+//                       "stderr" (the default), "stdout", or a file path to
+//                       append to. for otlp, it's the collector's base URL,
+//                       "http://localhost:4318" by default.
+//   MONKIT_SAMPLE_RATE  the fraction of Traces to export, between 0 and 1.
+//                       defaults to 1. sampled Traces are chosen with
+//                       SampleTrace and marked with Trace.SetSampled.
+//
+// Only Spans on sampled Traces (see Trace.Sampled) are exported, so
+// SetSampleRateForFunc overrides apply to exporting too. Other exporters,
+// such as zipkin and jaeger, aren't part of monkit and are reported as
+// errors. Files opened for json-log are closed and otlp exporters are
+// stopped on Shutdown.
+func (r *Registry) ConfigureFromEnv() error {
+	exporter := os.Getenv(EnvExporter)
+	if exporter == "" {
+		return nil
+	}
+
+	rate := 1.0
+	if val := os.Getenv(EnvSampleRate); val != "" {
+		var err error
+		rate, err = strconv.ParseFloat(val, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return fmt.Errorf("monkit: invalid %s %q", EnvSampleRate, val)
+		}
+	}
+
+	var observer SpanObserver
+	switch exporter {
+	case "json-log":
+		var w io.Writer
+		switch endpoint := os.Getenv(EnvEndpoint); endpoint {
+		case "", "stderr":
+			w = os.Stderr
+		case "stdout":
+			w = os.Stdout
+		default:
+			fh, err := os.OpenFile(endpoint,
+				os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				return err
+			}
+			r.onShutdown(func() { fh.Close() })
+			w = fh
+		}
+		observer = &sampledObserver{observer: NewJSONLogObserver(w)}
+	case "otlp":
+		endpoint := os.Getenv(EnvEndpoint)
+		if endpoint == "" {
+			endpoint = "http://localhost:4318"
+		}
+		o := NewOTLPObserver(r, nil, endpoint)
+		r.onShutdown(o.Stop)
+		observer = o // already skips unsampled Traces
+	default:
+		return fmt.Errorf("monkit: unsupported %s %q", EnvExporter, exporter)
+	}
+
+	r.ObserveTraces(func(t *Trace) {
+		if rate >= 1 || r.SampleTrace(t.Id(), rate) {
+			t.SetSampled(true)
+		}
+		t.ObserveSpans(observer)
+	})
+	return nil
+}
+
+// sampledObserver hands observer only the Spans on sampled Traces. Sampled
+// is checked as each Span starts and finishes, rather than once per Trace,
+// since SetSampleRateForFunc decides when the root Span starts.
+type sampledObserver struct {
+	observer SpanObserver
+}
+
+func (o *sampledObserver) Start(s *Span) {
+	if s.Trace().Sampled() {
+		o.observer.Start(s)
+	}
+}
+
+func (o *sampledObserver) Finish(s *Span, err error, panicked bool,
+	finish time.Time) {
+	if s.Trace().Sampled() {
+		o.observer.Finish(s, err, panicked, finish)
+	}
+}
@@ -16,8 +16,15 @@ package monkit
 
 import (
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// ExemplarWindow is how long a Func's latency exemplar is kept before any
+// newer Span can replace it, even a faster one. See Func.LatencyExemplar.
+const ExemplarWindow = time.Minute
+
 // Func represents a FuncStats bound to a particular function id, scope, and
 // name. You should create a Func using the Func creation methods
 // (Func/FuncNamed) on a Scope. If you want to manage installation bookkeeping
@@ -35,16 +42,34 @@ type Func struct {
 	FuncStats
 
 	// constructor things
-	id    int64
-	scope *Scope
-	name  string
+	id      int64
+	scope   *Scope
+	name    string
+	created time.Time
+
+	// call graph edges. the counters are shared between a caller's callees
+	// and the callee's callers, and are updated with sync/atomic.
+	edgeMtx sync.RWMutex
+	callers map[*Func]*int64
+	callees map[*Func]*int64
+
+	// protected by exemplarMtx
+	exemplarMtx      sync.Mutex
+	exemplarLatency  time.Duration
+	exemplarTraceId  int64
+	exemplarRecorded time.Time
+
+	// values recorded with Span.Observe
+	observedMtx sync.RWMutex
+	observed    map[string]*FloatVal
 }
 
 func newFunc(s *Scope, name string) (f *Func) {
 	f = &Func{
-		id:    NewId(),
-		scope: s,
-		name:  name,
+		id:      NewId(),
+		scope:   s,
+		name:    name,
+		created: time.Now(),
 	}
 	initFuncStats(&f.FuncStats)
 	return f
@@ -69,3 +94,133 @@ func (f *Func) Scope() *Scope { return f.scope }
 func (f *Func) Parents(cb func(f *Func)) {
 	f.FuncStats.parents(cb)
 }
+
+func (f *Func) start(parent *Func) {
+	f.FuncStats.start(parent)
+	if parent != nil {
+		atomic.AddInt64(f.callerEdge(parent), 1)
+	}
+}
+
+// callerEdge returns the counter for calls from caller to f, creating it if
+// necessary. Only one Func's edgeMtx is ever held at a time.
+func (f *Func) callerEdge(caller *Func) *int64 {
+	f.edgeMtx.RLock()
+	count := f.callers[caller]
+	f.edgeMtx.RUnlock()
+	if count != nil {
+		return count
+	}
+
+	f.edgeMtx.Lock()
+	count = f.callers[caller]
+	if count != nil {
+		f.edgeMtx.Unlock()
+		return count
+	}
+	count = new(int64)
+	if f.callers == nil {
+		f.callers = map[*Func]*int64{}
+	}
+	f.callers[caller] = count
+	f.edgeMtx.Unlock()
+
+	caller.edgeMtx.Lock()
+	if caller.callees == nil {
+		caller.callees = map[*Func]*int64{}
+	}
+	caller.callees[f] = count
+	caller.edgeMtx.Unlock()
+	return count
+}
+
+func (f *Func) iterateEdges(callers bool, cb func(f *Func, count int64)) {
+	f.edgeMtx.RLock()
+	edges := f.callees
+	if callers {
+		edges = f.callers
+	}
+	funcs := make([]*Func, 0, len(edges))
+	counts := make([]*int64, 0, len(edges))
+	for f, count := range edges {
+		funcs = append(funcs, f)
+		counts = append(counts, count)
+	}
+	f.edgeMtx.RUnlock()
+	for i, other := range funcs {
+		cb(other, atomic.LoadInt64(counts[i]))
+	}
+}
+
+// Callers calls cb with every Func that has started a Span of this Func as a
+// child, along with how many times it did so. Together with Callees, this
+// gives a call graph aggregated across all Traces. Unlike Parents, root Spans
+// aren't represented.
+func (f *Func) Callers(cb func(caller *Func, count int64)) {
+	f.iterateEdges(true, cb)
+}
+
+// Callees calls cb with every Func that has had a Span started as a child of
+// one of this Func's Spans, along with how many times. See Callers.
+func (f *Func) Callees(cb func(callee *Func, count int64)) {
+	f.iterateEdges(false, cb)
+}
+
+// LatencyExemplar returns the latency and Trace id of a recent slow Span of
+// this Func, for exporters that can attach exemplars to latency metrics
+// (such as Prometheus) so a metric links to a Trace that explains it. The
+// exemplar is the slowest Span on a sampled Trace (see Trace.Sampled) seen
+// within roughly the last ExemplarWindow. ok is false if there hasn't been
+// one.
+func (f *Func) LatencyExemplar() (latency time.Duration, traceId int64,
+	ok bool) {
+	f.exemplarMtx.Lock()
+	defer f.exemplarMtx.Unlock()
+	return f.exemplarLatency, f.exemplarTraceId, !f.exemplarRecorded.IsZero()
+}
+
+func (f *Func) observeExemplar(latency time.Duration, traceId int64,
+	finish time.Time) {
+	f.exemplarMtx.Lock()
+	if f.exemplarRecorded.IsZero() || latency >= f.exemplarLatency ||
+		finish.Sub(f.exemplarRecorded) > ExemplarWindow {
+		f.exemplarLatency = latency
+		f.exemplarTraceId = traceId
+		f.exemplarRecorded = finish
+	}
+	f.exemplarMtx.Unlock()
+}
+
+func (f *Func) observe(name string, value float64) {
+	f.observedMtx.RLock()
+	v := f.observed[name]
+	f.observedMtx.RUnlock()
+	if v == nil {
+		f.observedMtx.Lock()
+		v = f.observed[name]
+		if v == nil {
+			v = NewFloatVal()
+			if f.observed == nil {
+				f.observed = map[string]*FloatVal{}
+			}
+			f.observed[name] = v
+		}
+		f.observedMtx.Unlock()
+	}
+	v.Observe(value)
+}
+
+// ObservedStats returns aggregate statistics of the values recorded under
+// name with Span.Observe, across all of this Func's Spans. All of them are
+// zero if nothing has been recorded under name.
+func (f *Func) ObservedStats(name string) (count, sum, min, max float64) {
+	f.observedMtx.RLock()
+	v := f.observed[name]
+	f.observedMtx.RUnlock()
+	if v == nil {
+		return 0, 0, 0, 0
+	}
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	return float64(v.dist.Count), v.dist.Sum, v.dist.Low, v.dist.High
+}
@@ -0,0 +1,94 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FuncCount is the number of Spans of a Func that a FuncCountObserver has
+// seen.
+type FuncCount struct {
+	// Current is how many Spans are currently running.
+	Current int64
+	// Total is how many Spans have been started.
+	Total int64
+}
+
+type funcCounter struct {
+	// sync/atomic things
+	current int64
+	total   int64
+}
+
+// FuncCountObserver is a SpanObserver that keeps live counts of running and
+// total Spans per Func. It's a much lighter weight alternative to FuncStats
+// for things like quick health endpoints. Construct with
+// NewFuncCountObserver.
+type FuncCountObserver struct {
+	mtx      sync.RWMutex
+	counters map[*Func]*funcCounter
+}
+
+// NewFuncCountObserver creates a new FuncCountObserver.
+func NewFuncCountObserver() *FuncCountObserver {
+	return &FuncCountObserver{counters: map[*Func]*funcCounter{}}
+}
+
+func (o *FuncCountObserver) counter(f *Func) *funcCounter {
+	o.mtx.RLock()
+	c, ok := o.counters[f]
+	o.mtx.RUnlock()
+	if ok {
+		return c
+	}
+	o.mtx.Lock()
+	c, ok = o.counters[f]
+	if !ok {
+		c = &funcCounter{}
+		o.counters[f] = c
+	}
+	o.mtx.Unlock()
+	return c
+}
+
+// Start implements the SpanObserver interface.
+func (o *FuncCountObserver) Start(s *Span) {
+	c := o.counter(s.Func())
+	atomic.AddInt64(&c.current, 1)
+	atomic.AddInt64(&c.total, 1)
+}
+
+// Finish implements the SpanObserver interface.
+func (o *FuncCountObserver) Finish(s *Span, err error, panicked bool,
+	finish time.Time) {
+	atomic.AddInt64(&o.counter(s.Func()).current, -1)
+}
+
+// Counts returns the current counts keyed by the Func's full name.
+func (o *FuncCountObserver) Counts() map[string]FuncCount {
+	o.mtx.RLock()
+	rv := make(map[string]FuncCount, len(o.counters))
+	for f, c := range o.counters {
+		rv[f.FullName()] = FuncCount{
+			Current: atomic.LoadInt64(&c.current),
+			Total:   atomic.LoadInt64(&c.total),
+		}
+	}
+	o.mtx.RUnlock()
+	return rv
+}
@@ -16,6 +16,8 @@ package monkit
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
 	"sync/atomic"
 	"time"
 
@@ -38,6 +40,9 @@ type FuncStats struct {
 	// sync/atomic things
 	current         int64
 	highwater       int64
+	slo             int64
+	sloViolations   int64
+	contextErrors   int64
 	parentsAndMutex funcSet
 
 	// mutex things (reuses mutex from parents)
@@ -45,12 +50,30 @@ type FuncStats struct {
 	panics       int64
 	successTimes DurationDist
 	failureTimes DurationDist
+	bucketBounds []time.Duration
+	bucketCounts []int64
+}
+
+// defaultLatencyBuckets is shared by every FuncStats until SetLatencyBuckets
+// is called, so it must never be modified.
+var defaultLatencyBuckets = []time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond,
+	50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond,
+	500 * time.Millisecond, time.Second, 2500 * time.Millisecond,
+	5 * time.Second, 10 * time.Second}
+
+// DefaultLatencyBuckets returns a copy of the latency histogram bucket
+// boundaries new FuncStats start with. See SetLatencyBuckets.
+func DefaultLatencyBuckets() []time.Duration {
+	return append([]time.Duration(nil), defaultLatencyBuckets...)
 }
 
 func initFuncStats(f *FuncStats) {
 	f.errors = map[string]int64{}
 	initDurationDist(&f.successTimes)
 	initDurationDist(&f.failureTimes)
+	f.bucketBounds = defaultLatencyBuckets
+	f.bucketCounts = make([]int64, len(f.bucketBounds)+1)
 }
 
 // NewFuncStats creates a FuncStats
@@ -64,12 +87,68 @@ func NewFuncStats() (f *FuncStats) {
 func (f *FuncStats) Reset() {
 	atomic.StoreInt64(&f.current, 0)
 	atomic.StoreInt64(&f.highwater, 0)
+	atomic.StoreInt64(&f.sloViolations, 0)
+	atomic.StoreInt64(&f.contextErrors, 0)
 	f.parentsAndMutex.Lock()
 	f.errors = make(map[string]int64, len(f.errors))
 	f.panics = 0
 	f.successTimes.Reset()
 	f.failureTimes.Reset()
+	f.bucketCounts = make([]int64, len(f.bucketBounds)+1)
+	f.parentsAndMutex.Unlock()
+}
+
+// SetLatencyBuckets replaces the upper bounds of the latency histogram
+// buckets, which must be sorted in increasing order; otherwise an error is
+// returned and the buckets are left alone. Durations past the last bound are
+// counted in an implicit +Inf bucket. Existing bucket counts are discarded.
+func (f *FuncStats) SetLatencyBuckets(bounds []time.Duration) error {
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i] <= bounds[i-1] {
+			return fmt.Errorf("monkit: latency buckets out of order: %v",
+				bounds)
+		}
+	}
+	bounds = append([]time.Duration(nil), bounds...)
+	f.parentsAndMutex.Lock()
+	f.bucketBounds = bounds
+	f.bucketCounts = make([]int64, len(bounds)+1)
 	f.parentsAndMutex.Unlock()
+	return nil
+}
+
+// SetSLO sets a latency objective for the function. Every observed execution
+// that takes longer than d, regardless of outcome, is counted as a violation.
+// See SLOViolations. A d of zero or less disables SLO tracking.
+func (f *FuncStats) SetSLO(d time.Duration) {
+	atomic.StoreInt64(&f.slo, int64(d))
+}
+
+// SLO returns the latency objective set with SetSLO, if any.
+func (f *FuncStats) SLO() time.Duration {
+	return time.Duration(atomic.LoadInt64(&f.slo))
+}
+
+// SLOViolations returns how many observed executions took longer than the
+// SLO.
+func (f *FuncStats) SLOViolations() int64 {
+	return atomic.LoadInt64(&f.sloViolations)
+}
+
+// ContextErrors returns how many executions returned a nil error even
+// though their context was already canceled or past its deadline. These are
+// only counted if the Registry classifies them; see
+// Registry.SetClassifyContextErrors.
+func (f *FuncStats) ContextErrors() int64 {
+	return atomic.LoadInt64(&f.contextErrors)
+}
+
+// observeLatency expects parentsAndMutex to be held.
+func (f *FuncStats) observeLatency(duration time.Duration) {
+	i := sort.Search(len(f.bucketBounds), func(i int) bool {
+		return duration <= f.bucketBounds[i]
+	})
+	f.bucketCounts[i] += 1
 }
 
 func (f *FuncStats) start(parent *Func) {
@@ -86,7 +165,11 @@ func (f *FuncStats) start(parent *Func) {
 
 func (f *FuncStats) end(err error, panicked bool, duration time.Duration) {
 	atomic.AddInt64(&f.current, -1)
+	if slo := atomic.LoadInt64(&f.slo); slo > 0 && int64(duration) > slo {
+		atomic.AddInt64(&f.sloViolations, 1)
+	}
 	f.parentsAndMutex.Lock()
+	f.observeLatency(duration)
 	if panicked {
 		f.panics += 1
 		f.failureTimes.Insert(duration)
@@ -99,10 +182,17 @@ func (f *FuncStats) end(err error, panicked bool, duration time.Duration) {
 		return
 	}
 	f.failureTimes.Insert(duration)
-	f.errors[errors.GetClass(err).String()] += 1
+	f.errors[errorName(err)] += 1
 	f.parentsAndMutex.Unlock()
 }
 
+func errorName(err error) string {
+	if se, ok := err.(*StatusError); ok {
+		return se.Class
+	}
+	return errors.GetClass(err).String()
+}
+
 // Current returns how many concurrent instances of this function are currently
 // being observed.
 func (f *FuncStats) Current() int64 { return atomic.LoadInt64(&f.current) }
@@ -146,6 +236,12 @@ func (f *FuncStats) parents(cb func(f *Func)) {
 func (f *FuncStats) Stats(cb func(name string, val float64)) {
 	cb("current", float64(f.Current()))
 	cb("highwater", float64(f.Highwater()))
+	if f.SLO() > 0 {
+		cb("slo violations", float64(f.SLOViolations()))
+	}
+	if contextErrors := f.ContextErrors(); contextErrors > 0 {
+		cb("context errors", float64(contextErrors))
+	}
 	f.parentsAndMutex.Lock()
 	panics := f.panics
 	errs := make(map[string]int64, len(f.errors))
@@ -154,6 +250,8 @@ func (f *FuncStats) Stats(cb func(name string, val float64)) {
 	}
 	st := f.successTimes.Copy()
 	ft := f.failureTimes.Copy()
+	bounds := f.bucketBounds
+	buckets := append([]int64(nil), f.bucketCounts...)
 	f.parentsAndMutex.Unlock()
 
 	cb("success", float64(st.Count)) // DEPRECATED
@@ -173,6 +271,17 @@ func (f *FuncStats) Stats(cb func(name string, val float64)) {
 	ft.Stats(func(name string, val float64) {
 		cb("failure times "+name, val)
 	})
+
+	// buckets are reported cumulatively, like Prometheus histograms
+	cumulative := int64(0)
+	for i, bound := range bounds {
+		cumulative += buckets[i]
+		cb(fmt.Sprintf("latency_bucket{le=%q}",
+			strconv.FormatFloat(bound.Seconds(), 'g', -1, 64)),
+			float64(cumulative))
+	}
+	cumulative += buckets[len(bounds)]
+	cb(`latency_bucket{le="+Inf"}`, float64(cumulative))
 }
 
 // SuccessTimes returns a DurationDist of successes
@@ -0,0 +1,191 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFuncStatsLatencyBuckets(t *testing.T) {
+	f := NewFuncStats()
+	if err := f.SetLatencyBuckets([]time.Duration{
+		100 * time.Millisecond, 10 * time.Millisecond}); err == nil {
+		t.Fatal("expected an error for unsorted buckets")
+	}
+	if err := f.SetLatencyBuckets([]time.Duration{
+		10 * time.Millisecond, 100 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []time.Duration{
+		time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond,
+		time.Second} {
+		f.start(nil)
+		f.end(nil, false, d)
+	}
+
+	stats := Collect(f)
+	for name, expected := range map[string]float64{
+		`latency_bucket{le="0.01"}`: 2,
+		`latency_bucket{le="0.1"}`:  3,
+		`latency_bucket{le="+Inf"}`: 4,
+	} {
+		if stats[name] != expected {
+			t.Fatalf("expected %s to be %v, got %v", name, expected, stats[name])
+		}
+	}
+
+	DefaultLatencyBuckets()[0] = time.Hour
+	if DefaultLatencyBuckets()[0] == time.Hour {
+		t.Fatal("DefaultLatencyBuckets should return a copy")
+	}
+}
+
+func TestFuncSLOViolations(t *testing.T) {
+	r := NewRegistry()
+	f := r.ScopeNamed("slo").FuncNamed("work")
+	f.SetSLO(50 * time.Millisecond)
+	for _, d := range []time.Duration{
+		time.Millisecond, 50 * time.Millisecond, 51 * time.Millisecond,
+		time.Second} {
+		f.start(nil)
+		f.end(nil, false, d)
+	}
+	if f.SLOViolations() != 2 {
+		t.Fatalf("expected 2 violations, got %d", f.SLOViolations())
+	}
+	if stats := Collect(r); stats["slo.work.slo violations"] != 2 {
+		t.Fatalf("unexpected stats: %v", stats)
+	}
+}
+
+func TestFuncStatsStatusClass(t *testing.T) {
+	f := NewRegistry().ScopeNamed("rpc").FuncNamed("handle")
+	for _, code := range []int{200, 404, 503, 14} {
+		ctx := context.Background()
+		done := f.Task(&ctx)
+		SpanFromCtx(ctx).AnnotateStatus(code)
+		done(nil)
+	}
+	if f.Success() != 1 {
+		t.Fatalf("expected 1 success, got %d", f.Success())
+	}
+	errs := f.Errors()
+	if errs[StatusServerError] != 2 || errs[StatusClientError] != 1 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+}
+
+func TestFuncCallGraph(t *testing.T) {
+	scope := NewRegistry().ScopeNamed("graph")
+	a, b, c := scope.FuncNamed("a"), scope.FuncNamed("b"), scope.FuncNamed("c")
+
+	// a calls b twice and c once, b calls c three times.
+	ctx := context.Background()
+	done := a.Task(&ctx)
+	for i := 0; i < 2; i++ {
+		bctx := ctx
+		doneB := b.Task(&bctx)
+		for j := 0; j < 3 && i == 0; j++ {
+			cctx := bctx
+			c.Task(&cctx)(nil)
+		}
+		doneB(nil)
+	}
+	cctx := ctx
+	c.Task(&cctx)(nil)
+	done(nil)
+
+	edges := func(
+		iterate func(cb func(f *Func, count int64))) map[string]int64 {
+		rv := map[string]int64{}
+		iterate(func(f *Func, count int64) { rv[f.ShortName()] = count })
+		return rv
+	}
+	for name, actual := range map[string]map[string]int64{
+		"a callees": edges(a.Callees),
+		"b callees": edges(b.Callees),
+		"c callers": edges(c.Callers),
+		"b callers": edges(b.Callers),
+		"a callers": edges(a.Callers),
+	} {
+		expected := map[string]map[string]int64{
+			"a callees": {"b": 2, "c": 1},
+			"b callees": {"c": 3},
+			"c callers": {"a": 1, "b": 3},
+			"b callers": {"a": 2},
+			"a callers": {},
+		}[name]
+		if len(actual) != len(expected) {
+			t.Fatalf("%s: expected %v, got %v", name, expected, actual)
+		}
+		for f, count := range expected {
+			if actual[f] != count {
+				t.Fatalf("%s: expected %v, got %v", name, expected, actual)
+			}
+		}
+	}
+}
+
+func TestFuncLatencyExemplar(t *testing.T) {
+	f := NewRegistry().ScopeNamed("exemplar").FuncNamed("work")
+	if _, _, ok := f.LatencyExemplar(); ok {
+		t.Fatal("expected no exemplar yet")
+	}
+
+	start := time.Now()
+	run := func(d time.Duration, sampled bool) int64 {
+		ctx := context.Background()
+		f.TaskAt(&ctx, start)
+		s := SpanFromCtx(ctx)
+		s.Trace().SetSampled(sampled)
+		s.FinishAt(nil, start.Add(d))
+		return s.Trace().Id()
+	}
+
+	slow := run(time.Second, true)
+	run(time.Millisecond, true)
+	run(time.Hour, false) // unsampled traces can't be linked to
+	latency, traceId, ok := f.LatencyExemplar()
+	if !ok || latency != time.Second || traceId != slow {
+		t.Fatalf("expected the slow span's trace %d as the exemplar, got %v %d",
+			slow, latency, traceId)
+	}
+}
+
+func TestFuncObservedStats(t *testing.T) {
+	r := NewRegistry()
+	f := r.ScopeNamed("observe").FuncNamed("batch")
+	other := r.ScopeNamed("observe").FuncNamed("other")
+	for _, items := range []float64{3, 10, 5} {
+		ctx := context.Background()
+		done := f.Task(&ctx)
+		SpanFromCtx(ctx).Observe("items", items)
+		done(nil)
+	}
+	ctx := context.Background()
+	other.Task(&ctx)(nil)
+	SpanFromCtx(ctx).Observe("items", 100)
+
+	count, sum, min, max := f.ObservedStats("items")
+	if count != 3 || sum != 18 || min != 3 || max != 10 {
+		t.Fatalf("unexpected stats: count %v sum %v min %v max %v",
+			count, sum, min, max)
+	}
+	if count, _, _, _ := f.ObservedStats("bytes"); count != 0 {
+		t.Fatalf("expected nothing observed, got %v", count)
+	}
+}
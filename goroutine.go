@@ -0,0 +1,96 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+)
+
+// SetGoroutineLocalSpans turns on goroutine-local current Spans (see
+// SetCurrentSpan), for library code that has no context.Context to thread
+// through but should still take part in tracing. It's off by default: it
+// relies on parsing goroutine ids out of stack traces, which Go goes out
+// of its way not to expose, and it's slow compared to passing contexts.
+// Prefer contexts wherever possible.
+func (r *Registry) SetGoroutineLocalSpans(enabled bool) {
+	var val int32
+	if enabled {
+		val = 1
+	}
+	atomic.StoreInt32(&r.goroutineSpans, val)
+}
+
+// SetCurrentSpan makes s the current Span of the calling goroutine, so that
+// new Spans started with a context that carries no Span become children of
+// s instead of starting new Traces. The returned restore function makes the
+// previous current Span, if any, current again; it must be called on the
+// same goroutine, typically deferred, or the entry outlives the goroutine.
+// SetCurrentSpan does nothing unless goroutine-local Spans are turned on
+// with SetGoroutineLocalSpans.
+//
+//   restore := monkit.Default.SetCurrentSpan(monkit.SpanFromCtx(ctx))
+//   defer restore()
+//   library.Call() // Tasks started with context.Background() parent to ctx
+func (r *Registry) SetCurrentSpan(s *Span) (restore func()) {
+	if atomic.LoadInt32(&r.goroutineSpans) == 0 {
+		return func() {}
+	}
+	id := goroutineId()
+	r.goroutineMtx.Lock()
+	prev, hadPrev := r.currentSpans[id]
+	if r.currentSpans == nil {
+		r.currentSpans = map[int64]*Span{}
+	}
+	r.currentSpans[id] = s
+	r.goroutineMtx.Unlock()
+	return func() {
+		r.goroutineMtx.Lock()
+		if hadPrev {
+			r.currentSpans[id] = prev
+		} else {
+			delete(r.currentSpans, id)
+		}
+		r.goroutineMtx.Unlock()
+	}
+}
+
+// CurrentSpan returns the calling goroutine's current Span set with
+// SetCurrentSpan, or nil.
+func (r *Registry) CurrentSpan() (s *Span) {
+	if atomic.LoadInt32(&r.goroutineSpans) == 0 {
+		return nil
+	}
+	id := goroutineId()
+	r.goroutineMtx.Lock()
+	s = r.currentSpans[id]
+	r.goroutineMtx.Unlock()
+	return s
+}
+
+// goroutineId parses the calling goroutine's id out of the header of its
+// stack trace, which looks like "goroutine 123 [running]:".
+func goroutineId() int64 {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+	fields := bytes.Fields(bytes.TrimPrefix(buf[:n], []byte("goroutine ")))
+	if len(fields) == 0 {
+		return 0
+	}
+	id, _ := strconv.ParseInt(string(fields[0]), 10, 64)
+	return id
+}
@@ -0,0 +1,85 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build go1.7
+
+package monkit
+
+import (
+	"context"
+	"sync"
+)
+
+// Group runs goroutines for a fan-out like golang.org/x/sync/errgroup's
+// Group, except that every goroutine runs in its own child Span of the
+// Span the Group was created from, so the fan-out is parented and counted
+// correctly:
+//
+//   g, ctx := monkit.NewGroup(ctx, mon.Func())
+//   for _, shard := range shards {
+//     shard := shard
+//     g.Go(func(ctx context.Context) error {
+//       return fetch(ctx, shard)
+//     })
+//   }
+//   err := g.Wait()
+//
+type Group struct {
+	f      *Func
+	ctx    context.Context
+	cancel func()
+	wg     sync.WaitGroup
+
+	errOnce sync.Once
+	err     error
+}
+
+// NewGroup creates a Group whose goroutines start Spans of f under the
+// current Span in ctx. Like errgroup.WithContext, the returned context is
+// canceled the first time a goroutine returns an error, or once Wait
+// returns, whichever happens first.
+func NewGroup(ctx context.Context, f *Func) (*Group, context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	return &Group{f: f, ctx: ctx, cancel: cancel}, ctx
+}
+
+// Go calls fn in a new goroutine, in a new child Span that finishes with
+// the error fn returns. The first non-nil error cancels the Group's context
+// and is returned by Wait.
+func (g *Group) Go(fn func(ctx context.Context) error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := g.run(fn); err != nil {
+			g.errOnce.Do(func() {
+				g.err = err
+				g.cancel()
+			})
+		}
+	}()
+}
+
+func (g *Group) run(fn func(ctx context.Context) error) (err error) {
+	ctx := g.ctx
+	defer g.f.Task(&ctx)(&err)
+	return fn(ctx)
+}
+
+// Wait blocks until every goroutine started with Go has returned and its
+// Span has finished, then returns the first non-nil error, if any.
+func (g *Group) Wait() error {
+	g.wg.Wait()
+	g.cancel()
+	return g.err
+}
@@ -0,0 +1,113 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// DefaultDeferTimeout is how long a Span waits for a continuation from Defer
+// to resume before it gives up on it, unless changed with
+// Registry.SetDeferTimeout.
+const DefaultDeferTimeout = time.Minute
+
+// SetDeferTimeout changes how long Spans wait for continuations from
+// Span.Defer to resume, for Defer calls from now on. Zero or less restores
+// DefaultDeferTimeout.
+func (r *Registry) SetDeferTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&r.deferTimeout, int64(timeout))
+}
+
+// DeferTimeout returns the timeout set with SetDeferTimeout.
+func (r *Registry) DeferTimeout() time.Duration {
+	if timeout := atomic.LoadInt64(&r.deferTimeout); timeout > 0 {
+		return time.Duration(timeout)
+	}
+	return DefaultDeferTimeout
+}
+
+// heldEnd is how a Span was ended while Defer continuations held it open.
+type heldEnd struct {
+	err          error
+	panicked     bool
+	finish       time.Time
+	budgetFinish time.Time // see annotateBudget
+	result       *string   // see FinishWithResult
+}
+
+// Defer marks that work on behalf of the Span will continue later, such as
+// on a worker goroutine the work is handed to over a channel, and returns a
+// function the worker calls to start a new child Span for it. Until the
+// child Span finishes, or the Registry's DeferTimeout elapses without resume
+// being called, ending the Span is held: its finish time and error are
+// recorded when it's ended, but it stays in the Span tree, so the child
+// isn't orphaned even if the Span that handed off the work returns first.
+//
+//   resume := monkit.SpanFromCtx(ctx).Defer()
+//   work <- func() {
+//     s := resume()
+//     defer s.Finish(nil)
+//     ...
+//   }
+//
+// Child Spans belong to a Func named after the Span's Func with a ".resume"
+// suffix. resume should be called at most once; resuming after the timeout
+// returns a child of a possibly finished Span as usual.
+func (s *Span) Defer() (resume func() *Span) {
+	f := s.f.scope.FuncNamed(s.Func().name + ".resume")
+	s.mtx.Lock()
+	held := !s.noop && !s.done
+	if held {
+		s.setExt().holds++
+	}
+	s.mtx.Unlock()
+
+	var state int32 // 1 once resumed, 2 once timed out
+	var timer *time.Timer
+	if held {
+		timer = time.AfterFunc(s.f.scope.r.DeferTimeout(), func() {
+			if atomic.CompareAndSwapInt32(&state, 0, 2) {
+				s.releaseHold()
+			}
+		})
+	}
+	return func() *Span {
+		child := newSpan(s, f, nil, s.f.scope.r.newId(), nil)
+		if held && atomic.CompareAndSwapInt32(&state, 0, 1) {
+			timer.Stop()
+			child.mtx.Lock()
+			child.setExt().holding = s
+			child.mtx.Unlock()
+		}
+		return child
+	}
+}
+
+// releaseHold releases one Defer hold, finishing the Span if it was ended
+// while held.
+func (s *Span) releaseHold() {
+	s.mtx.Lock()
+	ext := s.setExt()
+	ext.holds--
+	held := ext.held
+	if ext.holds > 0 || held == nil {
+		s.mtx.Unlock()
+		return
+	}
+	s.mtx.Unlock()
+	s.finishAt(held.err, held.panicked, held.finish, held.budgetFinish,
+		held.result)
+}
@@ -37,3 +37,24 @@ func NewId() int64 {
 	id := atomic.AddUint64(&idCounter, inc)
 	return int64(id >> 1)
 }
+
+// SetDeterministicIds makes Spans and Traces started through this Registry
+// get ids from a simple counter, starting over at 1 every time it's enabled,
+// instead of random ids. This is only meant for tests, such as comparing an
+// exporter's output against golden files; ids from different Registries or
+// processes will collide.
+func (r *Registry) SetDeterministicIds(enabled bool) {
+	if enabled {
+		atomic.StoreInt64(&r.idCounter, 0)
+		atomic.StoreInt32(&r.deterministicIds, 1)
+	} else {
+		atomic.StoreInt32(&r.deterministicIds, 0)
+	}
+}
+
+func (r *Registry) newId() int64 {
+	if atomic.LoadInt32(&r.deterministicIds) != 0 {
+		return atomic.AddInt64(&r.idCounter, 1)
+	}
+	return NewId()
+}
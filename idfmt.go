@@ -0,0 +1,48 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// IdStyle selects how FormatId renders an id.
+type IdStyle int
+
+const (
+	// Decimal renders ids as signed base 10 integers.
+	Decimal IdStyle = iota
+	// Hex64 renders ids as 16 zero-padded lowercase hex digits, which is what
+	// most tracing systems and log correlation conventions expect.
+	Hex64
+	// Hex128 renders ids as 32 zero-padded lowercase hex digits, for systems
+	// that require 128 bit trace ids.
+	Hex128
+)
+
+// FormatId renders a Trace or Span id in the given style. Exporters and log
+// helpers should all use FormatId so ids rendered by different systems can be
+// correlated.
+func FormatId(id int64, style IdStyle) string {
+	switch style {
+	case Hex64:
+		return fmt.Sprintf("%016x", uint64(id))
+	case Hex128:
+		return fmt.Sprintf("%032x", uint64(id))
+	default:
+		return strconv.FormatInt(id, 10)
+	}
+}
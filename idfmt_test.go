@@ -0,0 +1,33 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import "testing"
+
+func TestFormatId(t *testing.T) {
+	trace := NewTrace(0x1234abcd)
+	for style, expected := range map[IdStyle]string{
+		Decimal: "305441741",
+		Hex64:   "000000001234abcd",
+		Hex128:  "0000000000000000000000001234abcd",
+	} {
+		if got := trace.FormatId(style); got != expected {
+			t.Fatalf("expected %q, got %q", expected, got)
+		}
+		if got := FormatId(trace.Id(), style); got != expected {
+			t.Fatalf("expected %q, got %q", expected, got)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+type jsonLink struct {
+	TraceId      int64  `json:"traceId"`
+	SpanId       int64  `json:"spanId"`
+	Relationship string `json:"relationship"`
+}
+
+// JSONLogObserver is a SpanObserver that writes every finished Span to an
+// io.Writer as a single line of JSON. It's the simplest possible exporter,
+// meant for shipping spans through an existing log pipeline.
+type JSONLogObserver struct {
+	mtx sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// NewJSONLogObserver creates a JSONLogObserver writing to w.
+func NewJSONLogObserver(w io.Writer) *JSONLogObserver {
+	return &JSONLogObserver{w: w}
+}
+
+// Start implements the SpanObserver interface.
+func (o *JSONLogObserver) Start(s *Span) {}
+
+// Finish implements the SpanObserver interface.
+func (o *JSONLogObserver) Finish(s *Span, err error, panicked bool,
+	finish time.Time) {
+	buf, err := marshalSpanLine(NewSpanData(s, err, panicked, finish))
+	o.mtx.Lock()
+	if err == nil {
+		_, err = o.w.Write(buf)
+	}
+	if err != nil && o.err == nil {
+		o.err = err
+	}
+	o.mtx.Unlock()
+}
+
+// Err returns the first error encountered encoding or writing a Span, if any.
+func (o *JSONLogObserver) Err() error {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return o.err
+}
+
+// marshalSpanLine encodes data as a single newline-terminated line of JSON.
+func marshalSpanLine(data *SpanData) ([]byte, error) {
+	start, _ := data.WallTimes()
+	line := struct {
+		Id          int64                  `json:"id"`
+		TraceId     int64                  `json:"traceId"`
+		ParentId    int64                  `json:"parentId,omitempty"`
+		Func        string                 `json:"func"`
+		Kind        string                 `json:"kind"`
+		Start       int64                  `json:"start"`
+		DurationMs  float64                `json:"durationMs"`
+		Orphaned    bool                   `json:"orphaned,omitempty"`
+		Err         string                 `json:"err,omitempty"`
+		Panicked    bool                   `json:"panicked,omitempty"`
+		Status      string                 `json:"status,omitempty"`
+		StatusMsg   string                 `json:"statusMessage,omitempty"`
+		Args        []string               `json:"args,omitempty"`
+		Annotations [][]string             `json:"annotations,omitempty"`
+		Links       []jsonLink             `json:"links,omitempty"`
+		Attributes  map[string]interface{} `json:"attributes,omitempty"`
+		Tags        map[string]string      `json:"tags,omitempty"`
+	}{
+		Id:         data.Id,
+		TraceId:    data.TraceId,
+		ParentId:   data.ParentId,
+		Func:       data.FullName(),
+		Kind:       data.Kind.String(),
+		Start:      start.UnixNano(),
+		DurationMs: float64(data.Duration()) / float64(time.Millisecond),
+		Orphaned:   data.Orphaned,
+		Panicked:   data.Panicked,
+		Args:       data.Args,
+		Attributes: data.Attributes,
+		Tags:       data.Tags,
+	}
+	if data.Err != nil {
+		line.Err = data.Err.Error()
+	}
+	if data.Status != StatusCodeUnset {
+		line.Status = data.Status.String()
+		line.StatusMsg = data.StatusMessage
+	}
+	annotations := append([]Annotation(nil), data.Annotations...)
+	SortAnnotations(annotations)
+	for _, annotation := range annotations {
+		line.Annotations = append(line.Annotations,
+			[]string{annotation.Name, annotation.Value})
+	}
+	for _, link := range data.Links {
+		line.Links = append(line.Links, jsonLink{
+			TraceId:      link.TraceId,
+			SpanId:       link.SpanId,
+			Relationship: link.Relationship.String()})
+	}
+	buf, err := json.Marshal(line)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, '\n'), nil
+}
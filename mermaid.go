@@ -0,0 +1,91 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"time"
+)
+
+// TraceToMermaid writes the Span tree under root as a Mermaid sequence
+// diagram, for pasting into Markdown that renders Mermaid, such as on GitHub
+// or GitLab. Every Scope is a participant, and every parent to child call is
+// a message labeled with the child's name and how long it has been running.
+// Like Children, only sees child Spans that are still running.
+func TraceToMermaid(root *Span, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	m := mermaidWriter{w: bw, participants: map[*Scope]string{}}
+	m.printf("sequenceDiagram\n")
+	m.participant(root.Func().Scope())
+	m.calls(root)
+	if m.err != nil {
+		return m.err
+	}
+	return bw.Flush()
+}
+
+type mermaidWriter struct {
+	w            io.Writer
+	err          error
+	participants map[*Scope]string
+}
+
+func (m *mermaidWriter) printf(format string, args ...interface{}) {
+	if m.err == nil {
+		_, m.err = fmt.Fprintf(m.w, format, args...)
+	}
+}
+
+// participant declares the Scope the first time it comes up, so
+// participants are laid out in call order, and returns its Mermaid id.
+func (m *mermaidWriter) participant(scope *Scope) string {
+	if id, ok := m.participants[scope]; ok {
+		return id
+	}
+	id := fmt.Sprintf("p%d", len(m.participants))
+	m.participants[scope] = id
+	m.printf("    participant %s as %s\n", id, escapeMermaid(scope.Name()))
+	return id
+}
+
+func (m *mermaidWriter) calls(parent *Span) {
+	from := m.participant(parent.Func().Scope())
+	parent.Children(func(child *Span) {
+		to := m.participant(child.Func().Scope())
+		elapsed := child.Duration() / time.Microsecond * time.Microsecond
+		m.printf("    %s->>%s: %s (%s)\n", from, to,
+			escapeMermaid(child.Name()), elapsed)
+		m.calls(child)
+	})
+}
+
+// escapeMermaid replaces characters that have a meaning in Mermaid, or that
+// would end the line, with Mermaid entity codes.
+func escapeMermaid(val string) string {
+	var rv []byte
+	for _, b := range []byte(val) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			128 <= b, b == ' ', b == '.', b == '_', b == '/', b == '(',
+			b == ')':
+			rv = append(rv, b)
+		default:
+			rv = append(rv, fmt.Sprintf("#%d;", b)...)
+		}
+	}
+	return string(rv)
+}
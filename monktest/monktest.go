@@ -0,0 +1,123 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package monktest helps tests assert on the Spans instrumented code creates.
+// Expected usage like:
+//
+//   func TestHandler(t *testing.T) {
+//     c, cancel := monktest.NewCollector()
+//     defer cancel()
+//     mon := c.Registry.ScopeNamed("handler")
+//     ...
+//     c.AssertChild(t, "handler.Serve", "handler.lookup")
+//   }
+package monktest // import "gopkg.in/spacemonkeygo/monkit.v2/monktest"
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/spacemonkeygo/monkit.v2"
+)
+
+// Collector is a SpanObserver that captures every Span started on its
+// Registry. Construct with NewCollector.
+type Collector struct {
+	// Registry is a fresh Registry whose Spans are all captured. Instrumented
+	// code under test needs to create its Scopes from it.
+	Registry *monkit.Registry
+
+	mtx      sync.Mutex
+	started  []*monkit.Span
+	finished []*monkit.SpanData
+}
+
+// NewCollector creates a Collector along with a new Registry for it to watch.
+// Call cancel to stop capturing Spans.
+func NewCollector() (c *Collector, cancel func()) {
+	c = &Collector{Registry: monkit.NewRegistry()}
+	cancel = c.Registry.ObserveTraces(func(t *monkit.Trace) {
+		t.ObserveSpans(c)
+	})
+	return c, cancel
+}
+
+// Start implements the SpanObserver interface.
+func (c *Collector) Start(s *monkit.Span) {
+	c.mtx.Lock()
+	c.started = append(c.started, s)
+	c.mtx.Unlock()
+}
+
+// Finish implements the SpanObserver interface.
+func (c *Collector) Finish(s *monkit.Span, err error, panicked bool,
+	finish time.Time) {
+	data := monkit.NewSpanData(s, err, panicked, finish)
+	c.mtx.Lock()
+	c.finished = append(c.finished, data)
+	c.mtx.Unlock()
+}
+
+// Started returns every Span that has started so far, in order, including
+// ones that are still running.
+func (c *Collector) Started() []*monkit.Span {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return append([]*monkit.Span(nil), c.started...)
+}
+
+// Spans returns snapshots of every Span that has finished so far, in the
+// order they finished.
+func (c *Collector) Spans() []*monkit.SpanData {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return append([]*monkit.SpanData(nil), c.finished...)
+}
+
+// SpanNamed returns the first finished Span whose Func has the given name,
+// which can be either the full name ("pkg.Func") or the short name ("Func").
+// It returns nil if there isn't one.
+func (c *Collector) SpanNamed(name string) *monkit.SpanData {
+	for _, s := range c.Spans() {
+		if s.FullName() == name || s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// AssertChild fails the test unless some finished Span named child has a
+// finished Span named parent as its parent. Names are matched as in
+// SpanNamed.
+func (c *Collector) AssertChild(t testing.TB, parent, child string) {
+	spans := c.Spans()
+	found := false
+	for _, p := range spans {
+		if p.FullName() != parent && p.Name != parent {
+			continue
+		}
+		found = true
+		for _, s := range spans {
+			if (s.FullName() == child || s.Name == child) &&
+				s.ParentId == p.Id && s.TraceId == p.TraceId {
+				return
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("no finished span named %q", parent)
+	}
+	t.Fatalf("no finished span named %q is a child of %q", child, parent)
+}
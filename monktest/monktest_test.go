@@ -0,0 +1,53 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monktest
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCollector(t *testing.T) {
+	c, cancel := NewCollector()
+	defer cancel()
+	mon := c.Registry.ScopeNamed("app")
+
+	lookup := func(ctx context.Context) (err error) {
+		defer mon.TaskNamed("lookup")(&ctx)(&err)
+		return nil
+	}
+	serve := func(ctx context.Context) (err error) {
+		defer mon.TaskNamed("serve")(&ctx)(&err)
+		return lookup(ctx)
+	}
+	if err := serve(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.Started()) != 2 || len(c.Spans()) != 2 {
+		t.Fatalf("expected 2 spans, got %d started and %d finished",
+			len(c.Started()), len(c.Spans()))
+	}
+	if c.SpanNamed("app.serve") == nil || c.SpanNamed("lookup") == nil {
+		t.Fatal("expected spans to be found by full and short name")
+	}
+	if c.SpanNamed("missing") != nil {
+		t.Fatal("expected no span for an unknown name")
+	}
+	if c.SpanNamed("serve").ParentId != 0 {
+		t.Fatal("serve should be a root span")
+	}
+	c.AssertChild(t, "app.serve", "app.lookup")
+}
@@ -0,0 +1,881 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFuncCountObserver(t *testing.T) {
+	r := NewRegistry()
+	o := NewFuncCountObserver()
+	r.ObserveTraces(func(t *Trace) { t.ObserveSpans(o) })
+	scope := r.ScopeNamed("counts")
+	a, b := scope.FuncNamed("a"), scope.FuncNamed("b")
+
+	ctx := context.Background()
+	doneA := a.Task(&ctx)
+	child := ctx
+	doneB := b.Task(&child)
+	b.Task(&ctx)(nil)
+
+	counts := o.Counts()
+	if counts["counts.a"] != (FuncCount{Current: 1, Total: 1}) {
+		t.Fatalf("unexpected counts for a: %+v", counts["counts.a"])
+	}
+	if counts["counts.b"] != (FuncCount{Current: 1, Total: 2}) {
+		t.Fatalf("unexpected counts for b: %+v", counts["counts.b"])
+	}
+
+	doneB(nil)
+	doneA(nil)
+	counts = o.Counts()
+	if counts["counts.a"].Current != 0 || counts["counts.b"].Current != 0 {
+		t.Fatalf("expected nothing running, got %+v", counts)
+	}
+}
+
+type recordingObserver struct {
+	started, finished []*Span
+}
+
+func (o *recordingObserver) Start(s *Span) {
+	o.started = append(o.started, s)
+}
+
+func (o *recordingObserver) Finish(s *Span, err error, panicked bool,
+	finish time.Time) {
+	o.finished = append(o.finished, s)
+}
+
+func TestObserverAttachedMidSpan(t *testing.T) {
+	f := NewRegistry().ScopeNamed("observers").FuncNamed("work")
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	running := SpanFromCtx(ctx)
+
+	o := &recordingObserver{}
+	running.Trace().ObserveSpans(o)
+	child := ctx
+	f.Task(&child)(nil)
+	done(nil)
+
+	if len(o.started) != 1 || len(o.finished) != 1 {
+		t.Fatalf("expected exactly the child span, got %d starts, %d finishes",
+			len(o.started), len(o.finished))
+	}
+	if o.started[0] == running || o.finished[0] == running {
+		t.Fatal("observer should not see the span that was already running")
+	}
+}
+
+type panickingObserver struct{ start bool }
+
+func (o panickingObserver) Start(s *Span) {
+	if o.start {
+		panic("start")
+	}
+}
+
+func (o panickingObserver) Finish(s *Span, err error, panicked bool,
+	finish time.Time) {
+	panic("finish")
+}
+
+func TestObserverPanicRecovered(t *testing.T) {
+	r := NewRegistry()
+	var recovered []interface{}
+	r.SetObserverPanicHandler(func(rec interface{}) {
+		recovered = append(recovered, rec)
+	})
+	o := &recordingObserver{}
+	r.ObserveTraces(func(t *Trace) {
+		t.ObserveSpans(o)
+		t.ObserveSpans(panickingObserver{start: true})
+	})
+	f := r.ScopeNamed("observers").FuncNamed("work")
+
+	completed := false
+	func() {
+		ctx := context.Background()
+		defer f.Task(&ctx)(nil)
+		completed = true
+	}()
+
+	if !completed || f.Success() != 1 {
+		t.Fatal("expected the monitored function to complete")
+	}
+	if len(recovered) != 2 || recovered[0] != "start" ||
+		recovered[1] != "finish" {
+		t.Fatalf("unexpected recovered values %v", recovered)
+	}
+	if len(o.started) != 1 || len(o.finished) != 1 {
+		t.Fatal("expected other observers to still hear about the span")
+	}
+}
+
+type progressObserver struct {
+	recordingObserver
+	mtx       sync.Mutex
+	snapshots int
+	finished  bool
+	late      bool
+}
+
+func (o *progressObserver) Progress(s *Span, now time.Time) {
+	o.mtx.Lock()
+	o.snapshots++
+	o.late = o.late || o.finished
+	o.mtx.Unlock()
+}
+
+func (o *progressObserver) Finish(s *Span, err error, panicked bool,
+	finish time.Time) {
+	o.mtx.Lock()
+	o.finished = true
+	o.mtx.Unlock()
+}
+
+func (o *progressObserver) Snapshots() (snapshots int, late bool) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return o.snapshots, o.late
+}
+
+func TestSpanPeriodicExport(t *testing.T) {
+	r := NewRegistry()
+	o := &progressObserver{}
+	r.ObserveTraces(func(t *Trace) { t.ObserveSpans(o) })
+	f := r.ScopeNamed("progress").FuncNamed("work")
+
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	SpanFromCtx(ctx).EnablePeriodicExport(time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		snapshots, _ := o.Snapshots()
+		if snapshots >= 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected periodic snapshots, got %d", snapshots)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	done(nil)
+
+	snapshots, _ := o.Snapshots()
+	time.Sleep(10 * time.Millisecond)
+	after, late := o.Snapshots()
+	if late || after != snapshots {
+		t.Fatal("expected snapshots to stop once the span finished")
+	}
+}
+
+func TestConfigureFromEnv(t *testing.T) {
+	fh, err := ioutil.TempFile("", "monkit-spans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+	defer os.Remove(fh.Name())
+
+	os.Setenv(EnvExporter, "json-log")
+	os.Setenv(EnvEndpoint, fh.Name())
+	defer os.Unsetenv(EnvExporter)
+	defer os.Unsetenv(EnvEndpoint)
+
+	r := NewRegistry()
+	if err := r.ConfigureFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	r.SetSampleRateForFunc("env.skipped", 0)
+	ctx := context.Background()
+	r.ScopeNamed("env").FuncNamed("work").Task(&ctx)(nil)
+	o, ok := SpanFromCtx(ctx).observer.(*sampledObserver)
+	if !ok || !SpanFromCtx(ctx).Trace().Sampled() {
+		t.Fatalf("expected a sampled trace, got %T", SpanFromCtx(ctx).observer)
+	}
+	if _, ok := o.observer.(*JSONLogObserver); !ok {
+		t.Fatalf("expected a JSONLogObserver, got %T", o.observer)
+	}
+	skipped := context.Background()
+	r.ScopeNamed("env").FuncNamed("skipped").Task(&skipped)(nil)
+	r.Shutdown()
+
+	data, err := ioutil.ReadFile(fh.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"func":"env.work"`) ||
+		strings.Contains(string(data), `"func":"env.skipped"`) {
+		t.Fatalf("unexpected output: %s", data)
+	}
+
+	os.Setenv(EnvExporter, "otlp")
+	r = NewRegistry()
+	if err := r.ConfigureFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	ctx = context.Background()
+	r.ScopeNamed("env").FuncNamed("work").Task(&ctx)
+	if _, ok := SpanFromCtx(ctx).observer.(*OTLPObserver); !ok {
+		t.Fatalf("expected an OTLPObserver, got %T", SpanFromCtx(ctx).observer)
+	}
+	r.Shutdown()
+
+	os.Setenv(EnvExporter, "carrier-pigeon")
+	if err := NewRegistry().ConfigureFromEnv(); err == nil {
+		t.Fatal("expected an error for an unsupported exporter")
+	}
+}
+
+func TestSpanFollowsFrom(t *testing.T) {
+	f := NewRegistry().ScopeNamed("links").FuncNamed("work")
+	producerCtx := context.Background()
+	f.Task(&producerCtx)(nil)
+	producer := SpanFromCtx(producerCtx)
+
+	var buf bytes.Buffer
+	o := NewJSONLogObserver(&buf)
+	consumerCtx := context.Background()
+	done := f.Task(&consumerCtx)
+	consumer := SpanFromCtx(consumerCtx)
+	consumer.FollowsFrom(producer)
+	done(nil)
+
+	expected := SpanLink{
+		TraceId:      producer.Trace().Id(),
+		SpanId:       producer.Id(),
+		Relationship: LinkFollowsFrom}
+	data := NewSpanData(consumer, nil, false, consumer.finished())
+	if len(data.Links) != 1 || data.Links[0] != expected {
+		t.Fatalf("unexpected links: %+v", data.Links)
+	}
+
+	o.Finish(consumer, nil, false, consumer.finished())
+	if !strings.Contains(buf.String(), `"relationship":"follows_from"`) {
+		t.Fatalf("unexpected output: %s", buf.String())
+	}
+}
+
+func TestStatsDObserver(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	o, err := NewStatsDObserver(listener.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.SetPrefix("app.")
+	r := NewRegistry()
+	r.ObserveTraces(func(t *Trace) { t.ObserveSpans(o) })
+	f := r.ScopeNamed("statsd").FuncNamed("work")
+	ctx := context.Background()
+	f.Task(&ctx)(nil)
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, DefaultStatsDPacketSize)
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(buf[:n]), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected packet: %q", buf[:n])
+	}
+	if !strings.HasPrefix(lines[0], "app.statsd.work.duration:") ||
+		!strings.HasSuffix(lines[0], "|ms|#status:success") {
+		t.Fatalf("unexpected timer: %q", lines[0])
+	}
+	if lines[1] != "app.statsd.work.calls:1|c|#status:success" {
+		t.Fatalf("unexpected counter: %q", lines[1])
+	}
+}
+
+func TestRegistrySubscribe(t *testing.T) {
+	r := NewRegistry()
+	f := r.ScopeNamed("stream").FuncNamed("work")
+	events, unsubscribe := r.Subscribe()
+
+	ctx := context.Background()
+	f.Task(&ctx)(nil)
+
+	for _, expected := range []SpanStreamEventType{SpanStarted, SpanFinished} {
+		select {
+		case ev := <-events:
+			if ev.Type != expected || ev.Span.FullName() != "stream.work" {
+				t.Fatalf("unexpected event: %+v", ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected an event")
+		}
+	}
+
+	// a subscriber that never reads doesn't block spans
+	for i := 0; i < SubscribeBufferSize; i++ {
+		ctx := context.Background()
+		f.Task(&ctx)(nil)
+	}
+	if r.DroppedStreamEvents() != SubscribeBufferSize {
+		t.Fatalf("expected %d drops, got %d", SubscribeBufferSize,
+			r.DroppedStreamEvents())
+	}
+
+	unsubscribe()
+	for range events {
+	}
+}
+
+type memorySpanStore struct {
+	mtx   sync.Mutex
+	spans []SpanData
+}
+
+func (s *memorySpanStore) Store(data SpanData) error {
+	s.mtx.Lock()
+	s.spans = append(s.spans, data)
+	s.mtx.Unlock()
+	return nil
+}
+
+func TestSetSpanStore(t *testing.T) {
+	r := NewRegistry()
+	store := &memorySpanStore{}
+	r.SetSpanStore(store)
+	f := r.ScopeNamed("store").FuncNamed("work")
+
+	ids := map[int64]bool{}
+	for i := 0; i < 250; i++ {
+		ctx := context.Background()
+		done := f.Task(&ctx)
+		child := ctx
+		f.Task(&child)(nil)
+		done(nil)
+		ids[SpanFromCtx(ctx).Id()] = true
+		ids[SpanFromCtx(child).Id()] = true
+	}
+	r.Shutdown()
+
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	if len(store.spans) != len(ids) {
+		t.Fatalf("expected %d stored spans, got %d", len(ids),
+			len(store.spans))
+	}
+	for _, data := range store.spans {
+		if !ids[data.Id] || data.FullName() != "store.work" {
+			t.Fatalf("unexpected span stored: %+v", data)
+		}
+	}
+	if r.SpanStoreDropped() != 0 {
+		t.Fatalf("expected no drops, got %d", r.SpanStoreDropped())
+	}
+}
+
+func TestSetSpanStoreRunningSpans(t *testing.T) {
+	r := NewRegistry()
+	first, second := &memorySpanStore{}, &memorySpanStore{}
+	r.SetSpanStore(first)
+	f := r.ScopeNamed("store").FuncNamed("work")
+
+	// Spans that are running when the store is replaced go to the new one
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	r.SetSpanStore(second)
+	done(nil)
+
+	// and aren't stored at all if there's no store by the time they finish
+	ctx = context.Background()
+	done = f.Task(&ctx)
+	r.SetSpanStore(nil)
+	done(nil)
+
+	r.SetSpanStore(second)
+	ctx = context.Background()
+	done = f.Task(&ctx)
+	r.Shutdown()
+	done(nil)
+
+	if len(first.spans) != 0 || len(second.spans) != 1 {
+		t.Fatalf("expected one span in the second store, got %d and %d",
+			len(first.spans), len(second.spans))
+	}
+	if r.SpanStoreDropped() != 0 {
+		t.Fatalf("expected no drops, got %d", r.SpanStoreDropped())
+	}
+}
+
+func TestCloudTraceObserver(t *testing.T) {
+	var requests []map[string]interface{}
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			var body map[string]interface{}
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				t.Error(err)
+			}
+			requests = append(requests, body)
+			paths = append(paths, req.URL.Path)
+		}))
+	defer server.Close()
+
+	r := NewRegistry()
+	o := NewCloudTraceObserver(server.Client(), server.URL, "proj")
+	r.ObserveTraces(func(t *Trace) { t.ObserveSpans(o) })
+	f := r.ScopeNamed("gcp").FuncNamed("work")
+
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	SpanFromCtx(ctx).Trace().SetSampled(true)
+	child := ctx
+	f.Task(&child)(nil)
+	SpanFromCtx(ctx).Annotate("user", "bob")
+	done(nil)
+
+	unsampled := context.Background()
+	f.Task(&unsampled)(nil)
+	o.Stop()
+
+	if len(requests) != 1 ||
+		paths[0] != "/v2/projects/proj/traces:batchWrite" {
+		t.Fatalf("unexpected requests to %v", paths)
+	}
+	spans, _ := requests[0]["spans"].([]interface{})
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %v", requests[0])
+	}
+	root, _ := spans[1].(map[string]interface{})
+	traceId := FormatId(SpanFromCtx(ctx).Trace().Id(), Hex128)
+	spanId := FormatId(SpanFromCtx(ctx).Id(), Hex64)
+	if root["name"] != "projects/proj/traces/"+traceId+"/spans/"+spanId ||
+		root["spanId"] != spanId || len(traceId) != 32 {
+		t.Fatalf("unexpected ids: %v", root)
+	}
+	displayName, _ := root["displayName"].(map[string]interface{})
+	if displayName["value"] != "gcp.work" {
+		t.Fatalf("unexpected display name: %v", root)
+	}
+	attrs, _ := root["attributes"].(map[string]interface{})
+	attrMap, _ := attrs["attributeMap"].(map[string]interface{})
+	user, _ := attrMap["user"].(map[string]interface{})
+	value, _ := user["stringValue"].(map[string]interface{})
+	if value["value"] != "bob" {
+		t.Fatalf("unexpected attributes: %v", root)
+	}
+	first, _ := spans[0].(map[string]interface{})
+	if first["parentSpanId"] != spanId {
+		t.Fatalf("unexpected child: %v", first)
+	}
+}
+
+func TestOTLPObserverResource(t *testing.T) {
+	var requests []map[string]interface{}
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			var body map[string]interface{}
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				t.Error(err)
+			}
+			requests = append(requests, body)
+			paths = append(paths, req.URL.Path)
+		}))
+	defer server.Close()
+
+	r := NewRegistry()
+	r.SetResource(map[string]string{"service.name": "api"})
+	o := NewOTLPObserver(r, server.Client(), server.URL)
+	r.ObserveTraces(func(t *Trace) { t.ObserveSpans(o) })
+	f := r.ScopeNamed("otlp").FuncNamed("work")
+
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	SpanFromCtx(ctx).Trace().SetSampled(true)
+	child := ctx
+	f.Task(&child)(nil)
+	SpanFromCtx(ctx).Annotate("user", "bob")
+	done(nil)
+	o.Stop()
+
+	if len(requests) != 1 || paths[0] != "/v1/traces" {
+		t.Fatalf("unexpected requests to %v", paths)
+	}
+	resourceSpans, _ := requests[0]["resourceSpans"].([]interface{})
+	if len(resourceSpans) != 1 {
+		t.Fatalf("expected 1 resource, got %v", requests[0])
+	}
+	rs, _ := resourceSpans[0].(map[string]interface{})
+	resource, _ := rs["resource"].(map[string]interface{})
+	attrs, _ := resource["attributes"].([]interface{})
+	if len(attrs) != 1 {
+		t.Fatalf("unexpected resource: %v", resource)
+	}
+	attr, _ := attrs[0].(map[string]interface{})
+	value, _ := attr["value"].(map[string]interface{})
+	if attr["key"] != "service.name" || value["stringValue"] != "api" {
+		t.Fatalf("unexpected resource: %v", resource)
+	}
+
+	scopeSpans, _ := rs["scopeSpans"].([]interface{})
+	if len(scopeSpans) != 1 {
+		t.Fatalf("expected 1 scope, got %v", rs)
+	}
+	scope, _ := scopeSpans[0].(map[string]interface{})
+	spans, _ := scope["spans"].([]interface{})
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %v", scope)
+	}
+	for _, span := range spans {
+		span, _ := span.(map[string]interface{})
+		attrs, _ := span["attributes"].([]interface{})
+		for _, attr := range attrs {
+			attr, _ := attr.(map[string]interface{})
+			if attr["key"] == "service.name" {
+				t.Fatalf("resource attribute on span: %v", span)
+			}
+		}
+	}
+	root, _ := spans[1].(map[string]interface{})
+	if root["traceId"] != FormatId(SpanFromCtx(ctx).Trace().Id(), Hex128) ||
+		root["name"] != "otlp.work" {
+		t.Fatalf("unexpected root: %v", root)
+	}
+}
+
+func TestOTLPConvert(t *testing.T) {
+	for kind, expected := range map[SpanKind]int{
+		SpanKindInternal: 1, SpanKindServer: 2, SpanKindClient: 3,
+		SpanKindProducer: 4, SpanKindConsumer: 5} {
+		if span := otlpConvert(&SpanData{Kind: kind}); span.Kind != expected {
+			t.Fatalf("expected %v to map to %d, got %d", kind, expected,
+				span.Kind)
+		}
+	}
+
+	span := otlpConvert(&SpanData{
+		Annotations: []Annotation{
+			{Name: "retry", Value: "1"},
+			{Name: "user", Value: "bob"},
+			{Name: "retry", Value: "2"}},
+		Links: []SpanLink{
+			{TraceId: 1, SpanId: 2, Relationship: LinkFollowsFrom}}})
+	if len(span.Attributes) != 2 || span.Attributes[0].Key != "retry" ||
+		span.Attributes[0].Value.ArrayValue == nil ||
+		len(span.Attributes[0].Value.ArrayValue.Values) != 2 ||
+		*span.Attributes[0].Value.ArrayValue.Values[1].StringValue != "2" ||
+		*span.Attributes[1].Value.StringValue != "bob" {
+		t.Fatalf("unexpected attributes: %+v", span.Attributes)
+	}
+	if len(span.Links) != 1 || span.Links[0].SpanId != FormatId(2, Hex64) ||
+		span.Links[0].TraceId != FormatId(1, Hex128) ||
+		len(span.Links[0].Attributes) != 1 {
+		t.Fatalf("unexpected links: %+v", span.Links)
+	}
+}
+
+func TestRegistryWallClock(t *testing.T) {
+	var spans []interface{}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			var body struct {
+				ResourceSpans []struct {
+					ScopeSpans []struct {
+						Spans []interface{}
+					}
+				}
+			}
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				t.Error(err)
+			}
+			for _, rs := range body.ResourceSpans {
+				for _, ss := range rs.ScopeSpans {
+					spans = append(spans, ss.Spans...)
+				}
+			}
+		}))
+	defer server.Close()
+
+	r := NewRegistry()
+	wall := time.Unix(1500000000, 0)
+	r.SetWallClock(func() time.Time { return wall })
+	o := NewOTLPObserver(r, server.Client(), server.URL)
+	r.ObserveTraces(func(t *Trace) {
+		t.SetSampled(true)
+		t.ObserveSpans(o)
+	})
+	f := r.ScopeNamed("clock").FuncNamed("work")
+
+	ctx := context.Background()
+	f.Task(&ctx)(nil)
+	s := SpanFromCtx(ctx)
+	o.Stop()
+
+	if !s.WallStart().Equal(wall) || s.Start().Equal(wall) {
+		t.Fatalf("expected only the wall clock to be fixed, got %v and %v",
+			s.WallStart(), s.Start())
+	}
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %v", spans)
+	}
+	span, _ := spans[0].(map[string]interface{})
+	end, _ := span["endTimeUnixNano"].(string)
+	elapsed, err := strconv.ParseInt(end, 10, 64)
+	elapsed -= wall.UnixNano()
+	if span["startTimeUnixNano"] != "1500000000000000000" || err != nil ||
+		elapsed < 0 || elapsed > int64(time.Minute) {
+		t.Fatalf("unexpected timestamps: %v", span)
+	}
+}
+
+func TestRoutingObserver(t *testing.T) {
+	r := NewRegistry()
+	o := NewRoutingObserver(func(t *Trace, spans []SpanData) string {
+		if t.HadError() {
+			return "errors"
+		}
+		return "normal"
+	})
+	routed := map[string][][]SpanData{}
+	for _, name := range []string{"errors", "normal"} {
+		name := name
+		o.AddSink(name, func(t *Trace, spans []SpanData) {
+			routed[name] = append(routed[name], spans)
+		})
+	}
+	r.ObserveTraces(func(t *Trace) { t.ObserveSpans(o) })
+	f := r.ScopeNamed("routing").FuncNamed("work")
+
+	run := func(err error) {
+		ctx := context.Background()
+		done := f.Task(&ctx)
+		child := ctx
+		f.Task(&child)(&err)
+		done(nil)
+	}
+	run(nil)
+	run(errors.New("oops"))
+
+	for _, name := range []string{"errors", "normal"} {
+		if len(routed[name]) != 1 || len(routed[name][0]) != 2 {
+			t.Fatalf("expected one 2 span trace routed to %s, got %v", name,
+				routed[name])
+		}
+	}
+	if routed["errors"][0][0].Err == nil || routed["normal"][0][0].Err != nil {
+		t.Fatalf("traces were routed to the wrong sinks: %v", routed)
+	}
+
+	// detached spans are part of the trace, late spans are dropped
+	r.SetFinishedParentPolicy(DetachFinishedParent)
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	child := ctx
+	finishChild := f.Task(&child)
+	done(nil)
+	detached := ctx
+	f.Task(&detached)(nil)
+	finishChild(nil)
+	late := ctx
+	f.Task(&late)(nil)
+	if len(routed["normal"]) != 2 || len(routed["normal"][1]) != 3 {
+		t.Fatalf("expected a 3 span trace routed once, got %v",
+			routed["normal"])
+	}
+	if len(o.pending) != 0 {
+		t.Fatalf("expected nothing pending, got %v", o.pending)
+	}
+}
+
+func TestSpanSetStatus(t *testing.T) {
+	r := NewRegistry()
+	var buf bytes.Buffer
+	o := NewJSONLogObserver(&buf)
+	r.ObserveTraces(func(t *Trace) { t.ObserveSpans(o) })
+	f := r.ScopeNamed("status").FuncNamed("lookup")
+
+	// a cache miss is returned as an error, but it's an expected outcome
+	lookup := func(ctx context.Context) (err error) {
+		defer f.Task(&ctx)(&err)
+		SpanFromCtx(ctx).SetStatus(StatusCodeOk, "cache miss")
+		return errors.New("not found")
+	}
+	fail := func(ctx context.Context) (err error) {
+		defer f.Task(&ctx)(&err)
+		return errors.New("disk on fire")
+	}
+	lookup(context.Background())
+	fail(context.Background())
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", buf.String())
+	}
+	for i, expected := range []string{
+		`"status":"ok","statusMessage":"cache miss"`,
+		`"status":"error","statusMessage":"disk on fire"`,
+	} {
+		if !strings.Contains(lines[i], expected) {
+			t.Fatalf("expected %s in %s", expected, lines[i])
+		}
+	}
+}
+
+func TestRegistryTraceSizeBuckets(t *testing.T) {
+	r := NewRegistry()
+	if err := r.SetTraceSizeBuckets([]int64{3, 1}); err == nil {
+		t.Fatal("expected an error for unsorted buckets")
+	}
+	if err := r.SetTraceSizeBuckets([]int64{1, 3}); err != nil {
+		t.Fatal(err)
+	}
+	f := r.ScopeNamed("sizes").FuncNamed("work")
+	for _, size := range []int{1, 2, 3, 5, 8} {
+		ctx := context.Background()
+		done := f.Task(&ctx)
+		for i := 1; i < size; i++ {
+			child := ctx
+			f.Task(&child)(nil)
+		}
+		if count := SpanFromCtx(ctx).Trace().SpanCount(); count != int64(size) {
+			t.Fatalf("expected %d spans, got %d", size, count)
+		}
+		done(nil)
+	}
+	// traces still running at Shutdown aren't counted
+	ctx := context.Background()
+	defer f.Task(&ctx)(nil)
+	SpanFromCtx(ctx).Trace().ExportReady()
+	r.Shutdown()
+
+	buckets := map[string]float64{}
+	r.Stats(func(name string, val float64) {
+		if strings.HasPrefix(name, "trace_spans_bucket") {
+			buckets[name] = val
+		}
+	})
+	expected := map[string]float64{
+		`trace_spans_bucket{le="1"}`:    1,
+		`trace_spans_bucket{le="3"}`:    3,
+		`trace_spans_bucket{le="+Inf"}`: 5,
+	}
+	if len(buckets) != len(expected) {
+		t.Fatalf("unexpected buckets %v", buckets)
+	}
+	for name, val := range expected {
+		if buckets[name] != val {
+			t.Fatalf("unexpected buckets %v", buckets)
+		}
+	}
+}
+
+func TestRegistryOpenMetricsHandler(t *testing.T) {
+	r := NewRegistry()
+	f := r.ScopeNamed("om").FuncNamed("work")
+	f.SetLatencyBuckets([]time.Duration{time.Millisecond, time.Second})
+	start := time.Now()
+	var traceId int64
+	for _, d := range []time.Duration{time.Microsecond, 10 * time.Millisecond,
+		2 * time.Second} {
+		ctx := context.Background()
+		f.TaskAt(&ctx, start)
+		s := SpanFromCtx(ctx)
+		s.Trace().SetSampled(d == 10*time.Millisecond)
+		if s.Trace().Sampled() {
+			traceId = s.Trace().Id()
+		}
+		var err error
+		if d > time.Second {
+			err = errors.New("slow")
+		}
+		s.FinishAt(err, start.Add(d))
+	}
+
+	server := httptest.NewServer(r.OpenMetricsHandler())
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != OpenMetricsContentType {
+		t.Fatalf("unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+	if lines[len(lines)-1] != "# EOF" {
+		t.Fatalf("expected # EOF terminator:\n%s", body)
+	}
+
+	labels := `{scope="om",func="work"`
+	for _, expected := range []string{
+		"# TYPE monkit_func_calls counter",
+		"monkit_func_calls_total" + labels + `,outcome="success"} 2`,
+		"monkit_func_calls_total" + labels + `,outcome="error"} 1`,
+		"# TYPE monkit_func_current gauge",
+		"monkit_func_current" + labels + "} 0",
+		"# TYPE monkit_func_latency_seconds histogram",
+		"monkit_func_latency_seconds_bucket" + labels + `,le="0.001"} 1`,
+		"monkit_func_latency_seconds_bucket" + labels + `,le="1"} 2 # {trace_id="` +
+			FormatId(traceId, Hex128) + `"} 0.01`,
+		"monkit_func_latency_seconds_bucket" + labels + `,le="+Inf"} 3`,
+		"monkit_func_latency_seconds_count" + labels + "} 3",
+	} {
+		found := false
+		for _, line := range lines {
+			found = found || line == expected
+		}
+		if !found {
+			t.Fatalf("missing %q in:\n%s", expected, body)
+		}
+	}
+
+	// every sample belongs to the family declared before it
+	family := ""
+	for _, line := range lines[:len(lines)-1] {
+		if strings.HasPrefix(line, "# TYPE ") {
+			family = strings.Fields(line)[2]
+		} else if !strings.HasPrefix(line, "#") &&
+			!strings.HasPrefix(line, family+"_") &&
+			!strings.HasPrefix(line, family+"{") {
+			t.Fatalf("sample outside of its family: %q", line)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"log"
+	"time"
+)
+
+// SetObserverPanicHandler registers a hook that's given whatever a
+// SpanObserver panicked with. Panics in SpanObservers are recovered, so a
+// buggy exporter can't break the code being monitored, and the Span carries
+// on as if the SpanObserver had returned normally. By default, the first
+// such panic is logged with the standard log package and the rest are
+// ignored. A nil handler restores the default.
+func (r *Registry) SetObserverPanicHandler(handler func(rec interface{})) {
+	r.observerPanic.Store(observerPanicHandlerRef{handler: handler})
+}
+
+type observerPanicHandlerRef struct {
+	handler func(rec interface{})
+}
+
+// recoverObserver is deferred around calls into SpanObservers.
+func (r *Registry) recoverObserver() {
+	rec := recover()
+	if rec == nil {
+		return
+	}
+	ref, _ := r.observerPanic.Load().(observerPanicHandlerRef)
+	if ref.handler != nil {
+		ref.handler(rec)
+		return
+	}
+	r.observerPanicOnce.Do(func() {
+		log.Printf("monkit: recovered panic in span observer: %v", rec)
+	})
+}
+
+func observeStart(observer SpanObserver, s *Span) {
+	defer s.f.scope.r.recoverObserver()
+	observer.Start(s)
+}
+
+func observeFinish(observer SpanObserver, s *Span, err error,
+	panicked bool, finish time.Time) {
+	defer s.f.scope.r.recoverObserver()
+	observer.Finish(s, err, panicked, finish)
+}
+
+func observeProgress(observer SpanProgressObserver, s *Span,
+	now time.Time) {
+	defer s.f.scope.r.recoverObserver()
+	observer.Progress(s, now)
+}
@@ -0,0 +1,170 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OpenMetricsContentType is the content type OpenMetricsHandler serves.
+const OpenMetricsContentType = "application/openmetrics-text; " +
+	"version=1.0.0; charset=utf-8"
+
+// OpenMetricsHandler returns an http.Handler that serves the Registry's
+// Func stats in the OpenMetrics text format, for scrapers that want
+// OpenMetrics features such as exemplars and _created samples. Every Func
+// gets a call counter by outcome, a gauge of current calls, and a latency
+// histogram with the Func's latency buckets (see
+// FuncStats.SetLatencyBuckets), whose matching bucket carries the Func's
+// latency exemplar (see Func.LatencyExemplar), with the Trace id as a
+// "trace_id" label formatted as Hex128. Samples are labeled with the Func's
+// "scope" and "func".
+func (r *Registry) OpenMetricsHandler() http.Handler {
+	return openMetricsHandler{r: r}
+}
+
+type openMetricsHandler struct {
+	r *Registry
+}
+
+// openMetricsFunc is what's needed from one Func to render it.
+type openMetricsFunc struct {
+	labels         string
+	created        time.Time
+	calls          [3]float64 // by outcome, in openMetricsOutcomes order
+	current        float64
+	bounds         []string
+	buckets        []float64 // cumulative, the last is +Inf
+	sum            float64
+	exemplar       string
+	exemplarBucket int // index of the bucket the exemplar falls in
+}
+
+var openMetricsOutcomes = [3]string{"success", "error", "panic"}
+
+func (h openMetricsHandler) ServeHTTP(w http.ResponseWriter,
+	req *http.Request) {
+	var funcs []*openMetricsFunc
+	h.r.Funcs(func(f *Func) {
+		funcs = append(funcs, newOpenMetricsFunc(f))
+	})
+
+	w.Header().Set("Content-Type", OpenMetricsContentType)
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	fmt.Fprintf(out, "# TYPE monkit_func_calls counter\n")
+	fmt.Fprintf(out, "# HELP monkit_func_calls Finished calls by outcome.\n")
+	for _, f := range funcs {
+		for i, outcome := range openMetricsOutcomes {
+			labels := f.labels + `,outcome="` + outcome + `"`
+			fmt.Fprintf(out, "monkit_func_calls_total{%s} %s\n", labels,
+				openMetricsFloat(f.calls[i]))
+			fmt.Fprintf(out, "monkit_func_calls_created{%s} %s\n", labels,
+				openMetricsTime(f.created))
+		}
+	}
+
+	fmt.Fprintf(out, "# TYPE monkit_func_current gauge\n")
+	fmt.Fprintf(out, "# HELP monkit_func_current Calls in progress.\n")
+	for _, f := range funcs {
+		fmt.Fprintf(out, "monkit_func_current{%s} %s\n", f.labels,
+			openMetricsFloat(f.current))
+	}
+
+	fmt.Fprintf(out, "# TYPE monkit_func_latency_seconds histogram\n")
+	fmt.Fprintf(out, "# UNIT monkit_func_latency_seconds seconds\n")
+	fmt.Fprintf(out,
+		"# HELP monkit_func_latency_seconds Latency of finished calls.\n")
+	for _, f := range funcs {
+		for i, bound := range f.bounds {
+			fmt.Fprintf(out, "monkit_func_latency_seconds_bucket{%s,le=%q} %s",
+				f.labels, bound, openMetricsFloat(f.buckets[i]))
+			if f.exemplar != "" && i == f.exemplarBucket {
+				out.WriteString(f.exemplar)
+			}
+			out.WriteString("\n")
+		}
+		fmt.Fprintf(out, "monkit_func_latency_seconds_count{%s} %s\n",
+			f.labels, openMetricsFloat(f.buckets[len(f.buckets)-1]))
+		fmt.Fprintf(out, "monkit_func_latency_seconds_sum{%s} %s\n",
+			f.labels, openMetricsFloat(f.sum))
+		fmt.Fprintf(out, "monkit_func_latency_seconds_created{%s} %s\n",
+			f.labels, openMetricsTime(f.created))
+	}
+
+	out.WriteString("# EOF\n")
+}
+
+func newOpenMetricsFunc(f *Func) *openMetricsFunc {
+	m := &openMetricsFunc{
+		labels: fmt.Sprintf(`scope="%s",func="%s"`,
+			openMetricsEscape(f.scope.name), openMetricsEscape(f.name)),
+		created: f.created,
+	}
+	f.Stats(func(name string, val float64) {
+		switch {
+		case name == "successes":
+			m.calls[0] = val
+		case name == "errors":
+			m.calls[1] = val
+		case name == "panics":
+			m.calls[2] = val
+		case name == "current":
+			m.current = val
+		case name == "success times sum" || name == "failure times sum":
+			m.sum += val
+		case strings.HasPrefix(name, `latency_bucket{le="`):
+			bound := strings.TrimSuffix(
+				strings.TrimPrefix(name, `latency_bucket{le="`), `"}`)
+			m.bounds = append(m.bounds, bound)
+			m.buckets = append(m.buckets, val)
+		}
+	})
+
+	if latency, traceId, ok := f.LatencyExemplar(); ok {
+		m.exemplarBucket = len(m.bounds) - 1
+		for i, bound := range m.bounds {
+			le, err := strconv.ParseFloat(bound, 64)
+			if err == nil && latency.Seconds() <= le {
+				m.exemplarBucket = i
+				break
+			}
+		}
+		m.exemplar = fmt.Sprintf(` # {trace_id="%s"} %s`,
+			FormatId(traceId, Hex128), openMetricsFloat(latency.Seconds()))
+	}
+	return m
+}
+
+var openMetricsEscaper = strings.NewReplacer(
+	`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func openMetricsEscape(s string) string {
+	return openMetricsEscaper.Replace(s)
+}
+
+func openMetricsFloat(val float64) string {
+	return strconv.FormatFloat(val, 'g', -1, 64)
+}
+
+func openMetricsTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/1e9, 'f', 3, 64)
+}
@@ -0,0 +1,155 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultOrphanRate is how many times per second an OnOrphan callback is
+// called at most, unless changed with SetOrphanRate.
+const DefaultOrphanRate = 10
+
+// orphanSummaryInterval is how long after a suppressed OnOrphan call the
+// suppressed count is reported, if no call reported it in the meantime.
+const orphanSummaryInterval = time.Second
+
+// orphanNotifier rate limits OnOrphan callbacks with a token bucket that
+// holds up to one second's worth of calls.
+type orphanNotifier struct {
+	mtx             sync.Mutex
+	cb              func(s *Span, suppressed int64)
+	rate            float64
+	tokens          float64
+	last            time.Time
+	suppressed      int64
+	totalSuppressed int64
+	summary         *time.Timer // pending flushOrphans, see notifyOrphan
+	hooked          bool        // whether Shutdown stops the summary
+	closed          bool
+}
+
+func orphanBurst(rate float64) float64 {
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
+
+// OnOrphan registers cb to be called whenever a Span is orphaned, which
+// happens when its parent finishes first (or evicts it, see
+// Span.SetMaxChildren). A nil cb unregisters it. Orphans are usually a sign
+// of a bug, and a bug can orphan thousands of Spans at once, so calls to cb
+// are rate limited (see SetOrphanRate). Each call gets the number of orphans
+// whose calls were suppressed since the previous call, so a log line per
+// call is an accurate summary. cb is called without any locks held, from
+// the goroutine that caused the orphaning. If calls are suppressed and no
+// further call is allowed within a second, cb is called from a background
+// goroutine with a nil Span to report the suppressed count, so it isn't lost
+// when a burst of orphans ends.
+func (r *Registry) OnOrphan(cb func(s *Span, suppressed int64)) {
+	n := &r.orphanNotifier
+	n.mtx.Lock()
+	n.cb = cb
+	n.mtx.Unlock()
+}
+
+// SetOrphanRate changes how many times per second the OnOrphan callback is
+// called at most. A rate of zero or less means no limit. The default is
+// DefaultOrphanRate.
+func (r *Registry) SetOrphanRate(perSecond float64) {
+	n := &r.orphanNotifier
+	n.mtx.Lock()
+	n.rate = perSecond
+	n.tokens = orphanBurst(perSecond)
+	n.last = time.Time{}
+	n.mtx.Unlock()
+}
+
+// SuppressedOrphans returns how many OnOrphan calls in total have been
+// suppressed by the rate limit.
+func (r *Registry) SuppressedOrphans() int64 {
+	n := &r.orphanNotifier
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	return n.totalSuppressed
+}
+
+func (r *Registry) notifyOrphan(s *Span) {
+	n := &r.orphanNotifier
+	n.mtx.Lock()
+	cb := n.cb
+	if cb == nil {
+		n.mtx.Unlock()
+		return
+	}
+	if n.rate > 0 {
+		now := r.now()
+		if !n.last.IsZero() {
+			n.tokens += now.Sub(n.last).Seconds() * n.rate
+		}
+		n.last = now
+		if burst := orphanBurst(n.rate); n.tokens > burst {
+			n.tokens = burst
+		}
+		if n.tokens < 1 {
+			n.suppressed += 1
+			n.totalSuppressed += 1
+			hook := false
+			if n.summary == nil && !n.closed {
+				n.summary = time.AfterFunc(orphanSummaryInterval,
+					r.flushOrphans)
+				hook, n.hooked = !n.hooked, true
+			}
+			n.mtx.Unlock()
+			if hook {
+				r.onShutdown(r.stopOrphanSummary)
+			}
+			return
+		}
+		n.tokens -= 1
+	}
+	suppressed := n.suppressed
+	n.suppressed = 0
+	n.mtx.Unlock()
+	cb(s, suppressed)
+}
+
+// flushOrphans reports the OnOrphan calls suppressed since the last call.
+func (r *Registry) flushOrphans() {
+	n := &r.orphanNotifier
+	n.mtx.Lock()
+	n.summary = nil
+	cb, suppressed := n.cb, n.suppressed
+	if cb == nil || suppressed == 0 || n.closed {
+		n.mtx.Unlock()
+		return
+	}
+	n.suppressed = 0
+	n.mtx.Unlock()
+	cb(nil, suppressed)
+}
+
+func (r *Registry) stopOrphanSummary() {
+	n := &r.orphanNotifier
+	n.mtx.Lock()
+	n.closed = true
+	if n.summary != nil {
+		n.summary.Stop()
+		n.summary = nil
+	}
+	n.mtx.Unlock()
+}
@@ -0,0 +1,98 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package otbridge helps migrate from OpenTracing to monkit incrementally, by
+// continuing OpenTracing traces as monkit Traces and exposing monkit Spans as
+// OpenTracing SpanContexts.
+//
+// opentracing.SpanContext doesn't define how to get at a span's ids, since
+// every tracer stores them differently, so this package works with Ids that
+// the caller fills in from its tracer. For example, with Jaeger:
+//
+//   jc := otSpan.Context().(jaeger.SpanContext)
+//   trace, spanId := otbridge.Extract(otbridge.Ids{
+//     TraceIdHigh: jc.TraceID().High,
+//     TraceIdLow:  jc.TraceID().Low,
+//     SpanId:      uint64(jc.SpanID()),
+//     Sampled:     jc.IsSampled()})
+//   defer mon.Func().RemoteTrace(&ctx, spanId, trace)(&err)
+//
+// This package doesn't import opentracing-go, but SpanContext implements the
+// opentracing.SpanContext interface.
+package otbridge // import "gopkg.in/spacemonkeygo/monkit.v2/otbridge"
+
+import (
+	"gopkg.in/spacemonkeygo/monkit.v2"
+)
+
+type traceIdHighKey struct{}
+
+// Ids identifies an OpenTracing span. OpenTracing tracers commonly use 128
+// bit trace ids, while monkit's are 64 bits.
+type Ids struct {
+	TraceIdHigh uint64
+	TraceIdLow  uint64
+	SpanId      uint64
+	Sampled     bool
+}
+
+// Extract returns a Trace and span id suitable for Func.RemoteTrace, which
+// starts a monkit Span continuing the OpenTracing span identified by ids.
+// The monkit Trace id is the lower 64 bits of the OpenTracing trace id, the
+// convention B3 uses too. The upper 64 bits are kept on the Trace, so
+// SpanContext can hand back the full trace id. The span id is a new id,
+// since the monkit Span is a child of the OpenTracing span.
+func Extract(ids Ids) (trace *monkit.Trace, spanId int64) {
+	trace = monkit.NewTrace(int64(ids.TraceIdLow))
+	if ids.TraceIdHigh != 0 {
+		trace.Set(traceIdHighKey{}, ids.TraceIdHigh)
+	}
+	trace.SetSampled(ids.Sampled)
+	return trace, monkit.NewId()
+}
+
+// SpanContext exposes a monkit Span as an opentracing.SpanContext, so
+// OpenTracing instrumentation can start spans as children of monkit Spans.
+type SpanContext struct {
+	span *monkit.Span
+}
+
+// ContextOf returns the SpanContext for s.
+func ContextOf(s *monkit.Span) SpanContext {
+	return SpanContext{span: s}
+}
+
+// Ids returns the ids of the Span, in OpenTracing's terms. If the Span's
+// Trace was started by Extract, the full 128 bit trace id is returned.
+func (sc SpanContext) Ids() Ids {
+	trace := sc.span.Trace()
+	high, _ := trace.Get(traceIdHighKey{}).(uint64)
+	return Ids{
+		TraceIdHigh: high,
+		TraceIdLow:  uint64(trace.Id()),
+		SpanId:      uint64(sc.span.Id()),
+		Sampled:     trace.Sampled(),
+	}
+}
+
+// ForeachBaggageItem implements the opentracing.SpanContext interface, by
+// iterating over the baggage of the Span's Trace until handler returns
+// false.
+func (sc SpanContext) ForeachBaggageItem(handler func(k, v string) bool) {
+	for k, v := range sc.span.Trace().Baggage() {
+		if !handler(k, v) {
+			return
+		}
+	}
+}
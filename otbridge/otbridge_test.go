@@ -0,0 +1,59 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package otbridge
+
+import (
+	"context"
+	"testing"
+
+	"gopkg.in/spacemonkeygo/monkit.v2"
+)
+
+func TestRoundTrip(t *testing.T) {
+	f := monkit.NewRegistry().ScopeNamed("otbridge").FuncNamed("server")
+	ids := Ids{
+		TraceIdHigh: 0x80f198ee56343ba8,
+		TraceIdLow:  0x64fe8b2a57d3eff7,
+		SpanId:      0xe457b5a2e4d86bd1,
+		Sampled:     true,
+	}
+
+	trace, spanId := Extract(ids)
+	ctx := context.Background()
+	defer f.RemoteTrace(&ctx, spanId, trace)(nil)
+	s := monkit.SpanFromCtx(ctx)
+	if s.Trace().Id() != 0x64fe8b2a57d3eff7 || !s.Trace().Sampled() {
+		t.Fatalf("unexpected trace %x", s.Trace().Id())
+	}
+	if uint64(s.Id()) == ids.SpanId {
+		t.Fatal("the monkit span should be a new child span")
+	}
+
+	s.SetBaggageItem("user", "bob")
+	sc := ContextOf(s)
+	back := sc.Ids()
+	if back.TraceIdHigh != ids.TraceIdHigh || back.TraceIdLow != ids.TraceIdLow ||
+		back.SpanId != uint64(s.Id()) || !back.Sampled {
+		t.Fatalf("ids didn't round trip: %+v", back)
+	}
+	baggage := map[string]string{}
+	sc.ForeachBaggageItem(func(k, v string) bool {
+		baggage[k] = v
+		return true
+	})
+	if len(baggage) != 1 || baggage["user"] != "bob" {
+		t.Fatalf("unexpected baggage %v", baggage)
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OTLPObserver is a SpanObserver that exports finished Spans on sampled Traces
+// (see Trace.Sampled) to an OpenTelemetry collector, as OTLP/JSON over HTTP.
+// Spans are named after their Func (see Span.SetName), their annotations and
+// tags become span attributes, and their links (see Span.AddLink) become OTLP
+// links. Annotations repeated under the same name become a single array
+// attribute, in the order they were made. The Registry's resource attributes
+// (see Registry.SetResource) are sent once per batch, as the OTLP resource,
+// rather than on every span. Snapshots of running Spans (see
+// Span.EnablePeriodicExport) are exported too, with the attribute
+// "monkit.in_progress" set to "true" and their snapshot time as end time, so
+// collectors can show them as active until the final export replaces them.
+//
+//   monkit.Default.SetResource(map[string]string{"service.name": "api"})
+//   o := monkit.NewOTLPObserver(monkit.Default, nil,
+//     "http://localhost:4318")
+//   defer o.Stop()
+//   monkit.Default.ObserveTraces(func(t *monkit.Trace) { t.ObserveSpans(o) })
+//
+// OTLPObserver is a BatchExporter underneath, so see BatchExporter for how
+// batching, retries and drops work.
+type OTLPObserver struct {
+	*BatchExporter
+	r        *Registry
+	client   *http.Client
+	endpoint string
+}
+
+// NewOTLPObserver creates an OTLPObserver that posts to the /v1/traces path
+// of the given collector endpoint, with the resource attributes of r. A nil
+// client means http.DefaultClient. Call Stop when done.
+func NewOTLPObserver(r *Registry, client *http.Client,
+	endpoint string) *OTLPObserver {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	o := &OTLPObserver{
+		r:        r,
+		client:   client,
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+	}
+	o.BatchExporter = NewBatchExporter(o.send, DefaultBatchSize,
+		DefaultBatchInterval)
+	return o
+}
+
+// Finish implements the SpanObserver interface. Spans on Traces that aren't
+// sampled are skipped.
+func (o *OTLPObserver) Finish(s *Span, err error, panicked bool,
+	finish time.Time) {
+	if !s.Trace().Sampled() {
+		return
+	}
+	o.BatchExporter.Finish(s, err, panicked, finish)
+}
+
+// Progress implements the SpanProgressObserver interface.
+func (o *OTLPObserver) Progress(s *Span, now time.Time) {
+	if !s.Trace().Sampled() {
+		return
+	}
+	data := NewSpanData(s, nil, false, now)
+	data.InProgress = true
+	o.Add(*data)
+}
+
+type otlpValue struct {
+	StringValue *string    `json:"stringValue,omitempty"`
+	ArrayValue  *otlpArray `json:"arrayValue,omitempty"`
+}
+
+type otlpArray struct {
+	Values []otlpValue `json:"values"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpLink struct {
+	TraceId    string          `json:"traceId"`
+	SpanId     string          `json:"spanId"`
+	Attributes []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Links             []otlpLink      `json:"links,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+func otlpString(val string) otlpValue {
+	return otlpValue{StringValue: &val}
+}
+
+// otlpAttributes converts vals to attributes sorted by key, so identical
+// batches encode identically.
+func otlpAttributes(vals map[string]string) []otlpAttribute {
+	multi := make(map[string][]string, len(vals))
+	for key, val := range vals {
+		multi[key] = []string{val}
+	}
+	return otlpMultiAttributes(multi)
+}
+
+// otlpMultiAttributes is like otlpAttributes, but keys with more than one
+// value become array attributes.
+func otlpMultiAttributes(vals map[string][]string) []otlpAttribute {
+	keys := make([]string, 0, len(vals))
+	for key := range vals {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	attrs := make([]otlpAttribute, 0, len(keys))
+	for _, key := range keys {
+		values := vals[key]
+		if len(values) == 1 {
+			attrs = append(attrs, otlpAttribute{Key: key,
+				Value: otlpString(values[0])})
+			continue
+		}
+		array := &otlpArray{Values: make([]otlpValue, 0, len(values))}
+		for _, val := range values {
+			array.Values = append(array.Values, otlpString(val))
+		}
+		attrs = append(attrs, otlpAttribute{Key: key,
+			Value: otlpValue{ArrayValue: array}})
+	}
+	return attrs
+}
+
+// otlpKind maps a SpanKind to its OTLP value, whose order differs from
+// SpanKind's.
+func otlpKind(kind SpanKind) int {
+	switch kind {
+	case SpanKindServer:
+		return 2
+	case SpanKindClient:
+		return 3
+	case SpanKindProducer:
+		return 4
+	case SpanKindConsumer:
+		return 5
+	default:
+		return 1
+	}
+}
+
+func otlpConvert(data *SpanData) otlpSpan {
+	start, finish := data.WallTimes()
+	span := otlpSpan{
+		TraceId:           FormatId(data.TraceId, Hex128),
+		SpanId:            FormatId(data.Id, Hex64),
+		Name:              data.FullName(),
+		Kind:              otlpKind(data.Kind),
+		StartTimeUnixNano: strconv.FormatInt(start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(finish.UnixNano(), 10),
+	}
+	if data.ParentId != 0 {
+		span.ParentSpanId = FormatId(data.ParentId, Hex64)
+	}
+	if len(data.Annotations) > 0 || len(data.Tags) > 0 || data.InProgress {
+		vals := make(map[string][]string,
+			len(data.Annotations)+len(data.Tags))
+		for _, annotation := range data.Annotations {
+			vals[annotation.Name] = append(vals[annotation.Name],
+				annotation.Value)
+		}
+		for key, val := range data.Tags {
+			vals[key] = append(vals[key], val)
+		}
+		if data.InProgress {
+			vals["monkit.in_progress"] = []string{"true"}
+		}
+		span.Attributes = otlpMultiAttributes(vals)
+	}
+	for _, link := range data.Links {
+		l := otlpLink{
+			TraceId: FormatId(link.TraceId, Hex128),
+			SpanId:  FormatId(link.SpanId, Hex64)}
+		if link.Relationship != LinkRelated {
+			l.Attributes = otlpAttributes(map[string]string{
+				"monkit.link.relationship": link.Relationship.String()})
+		}
+		span.Links = append(span.Links, l)
+	}
+	switch {
+	case data.Status == StatusCodeOk:
+		span.Status.Code = 1
+	case data.Status == StatusCodeError:
+		span.Status = otlpStatus{Code: 2, Message: data.StatusMessage}
+	case data.Panicked:
+		span.Status = otlpStatus{Code: 2, Message: "panic"}
+	case data.Err != nil:
+		span.Status = otlpStatus{Code: 2, Message: data.Err.Error()}
+	}
+	return span
+}
+
+func (o *OTLPObserver) send(batch []SpanData) error {
+	scope := otlpScopeSpans{Spans: make([]otlpSpan, 0, len(batch))}
+	scope.Scope.Name = "monkit"
+	for i := range batch {
+		scope.Spans = append(scope.Spans, otlpConvert(&batch[i]))
+	}
+	resource := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	resource.Resource.Attributes = otlpAttributes(o.r.Resource())
+	body, err := json.Marshal(struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}{ResourceSpans: []otlpResourceSpans{resource}})
+	if err != nil {
+		return err
+	}
+	resp, err := o.client.Post(o.endpoint+"/v1/traces", "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("otlp: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	return err
+}
@@ -41,8 +41,8 @@ func formatSpan(s *monkit.Span) interface{} {
 		Annotations [][]string `json:"annotations"`
 	}{}
 	js.Id = s.Id()
-	if s.Parent() != nil {
-		parent_id := s.Parent().Id()
+	if s.HasParent() {
+		parent_id := s.ParentId()
 		js.ParentId = &parent_id
 	}
 	js.Func.Package = s.Func().Scope().Name()
@@ -54,8 +54,10 @@ func formatSpan(s *monkit.Span) interface{} {
 	for _, arg := range s.Args() {
 		js.Args = append(js.Args, fmt.Sprint("%#v", arg))
 	}
-	js.Annotations = make([][]string, 0, len(s.Annotations()))
-	for _, annotation := range s.Annotations() {
+	annotations := s.Annotations()
+	monkit.SortAnnotations(annotations)
+	js.Annotations = make([][]string, 0, len(annotations))
+	for _, annotation := range annotations {
 		js.Annotations = append(js.Annotations,
 			[]string{annotation.Name, annotation.Value})
 	}
@@ -82,8 +84,8 @@ func formatFinishedSpan(s *collect.FinishedSpan) interface{} {
 		Annotations [][]string `json:"annotations"`
 	}{}
 	js.Id = s.Span.Id()
-	if s.Span.Parent() != nil {
-		parent_id := s.Span.Parent().Id()
+	if s.Span.HasParent() {
+		parent_id := s.Span.ParentId()
 		js.ParentId = &parent_id
 	}
 	js.Func.Package = s.Span.Func().Scope().Name()
@@ -101,8 +103,10 @@ func formatFinishedSpan(s *collect.FinishedSpan) interface{} {
 	for _, arg := range s.Span.Args() {
 		js.Args = append(js.Args, fmt.Sprint("%#v", arg))
 	}
-	js.Annotations = make([][]string, 0, len(s.Span.Annotations()))
-	for _, annotation := range s.Span.Annotations() {
+	annotations := s.Span.Annotations()
+	monkit.SortAnnotations(annotations)
+	js.Annotations = make([][]string, 0, len(annotations))
+	for _, annotation := range annotations {
 		js.Annotations = append(js.Annotations,
 			[]string{annotation.Name, annotation.Value})
 	}
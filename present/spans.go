@@ -17,6 +17,7 @@ package present
 import (
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 
 	"gopkg.in/spacemonkeygo/monkit.v2"
@@ -100,6 +101,19 @@ func outputTextSpan(w io.Writer, s *monkit.Span, indent string) (err error) {
 			return err
 		}
 	}
+	baggage := s.IntroducedBaggage()
+	keys := make([]string, 0, len(baggage))
+	for key := range baggage {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		_, err = fmt.Fprintf(w, "%s  baggage %s: %s\n", indent, key,
+			baggage[key])
+		if err != nil {
+			return err
+		}
+	}
 	s.Children(func(s *monkit.Span) {
 		if err != nil {
 			return
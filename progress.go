@@ -0,0 +1,95 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"time"
+)
+
+// SpanProgressObserver is a SpanObserver that also wants to hear about
+// Spans that are still running. See Span.EnablePeriodicExport.
+type SpanProgressObserver interface {
+	SpanObserver
+
+	// Progress is called periodically while a Span that has periodic export
+	// enabled is running, with the time of the snapshot. It's never called
+	// after Finish is called for the Span.
+	Progress(s *Span, now time.Time)
+}
+
+func (l *spanObserverTuple) Progress(s *Span, now time.Time) {
+	if progress, ok := l.car.(SpanProgressObserver); ok {
+		observeProgress(progress, s, now)
+	}
+	cdr := loadSpanObserverTuple(&l.cdr)
+	if cdr != nil {
+		cdr.Progress(s, now)
+	}
+}
+
+// periodicExport is the background ticker of EnablePeriodicExport.
+type periodicExport struct {
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// EnablePeriodicExport gives visibility into long-running Spans, which are
+// otherwise only exported once they finish: every interval until the Span
+// finishes, SpanObservers that implement SpanProgressObserver get an
+// in-progress snapshot of it. The final snapshot is the usual call to
+// Finish. Calling it again, or after the Span finished, does nothing.
+func (s *Span) EnablePeriodicExport(interval time.Duration) {
+	progress, ok := s.observer.(SpanProgressObserver)
+	if !ok || interval <= 0 {
+		return
+	}
+	s.mtx.Lock()
+	if ext := s.getExt(); s.done || ext.held != nil ||
+		ext.periodicExport != nil {
+		s.mtx.Unlock()
+		return
+	}
+	p := &periodicExport{
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{})}
+	s.setExt().periodicExport = p
+	s.mtx.Unlock()
+
+	go func() {
+		defer close(p.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				select {
+				case <-p.stop:
+					return
+				default:
+				}
+				observeProgress(progress, s, s.f.scope.r.now())
+			}
+		}
+	}()
+}
+
+// stopPeriodicExport stops the ticker and waits for any snapshot in flight,
+// so that SpanObservers don't hear about progress after Finish.
+func (p *periodicExport) stopPeriodicExport() {
+	close(p.stop)
+	<-p.stopped
+}
@@ -16,19 +16,62 @@ package monkit
 
 import (
 	"fmt"
+	"path"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type traceWatcherRef struct {
 	watcher func(*Trace)
 }
 
+type defaultAnnotationsRef struct {
+	cb func(s *Span) []Annotation
+}
+
 // Registry encapsulates all of the top-level state for a monitoring system.
 // In general, only the Default registry is ever used.
 type Registry struct {
 	// sync/atomic things
-	traceWatcher *traceWatcherRef
+	traceWatcher       *traceWatcherRef
+	defaultAnnotations *defaultAnnotationsRef
+	lateSpans          int64
+	samplerSeed        uint64
+	maxBaggageBytes    int64
+	rejectedBaggage    int64
+	finishedParents    int32
+	funcRateCount      int32
+	timeResolution     int64
+	idCounter          int64
+	storeDropped       int64
+	maxLiveTraces      int64
+	liveTraces         int64
+	shedTraces         int64
+	argSizeLimit       int64
+	maxArgs            int64
+	annotSampling      int64
+	maxTagValues       int64
+	overflowedTags     int64
+	deterministicIds   int32
+	classifyCtxErrs    int32
+	goroutineSpans     int32
+	samplingMode       int32
+	tailLatency        int64
+	maxTailSpans       int64
+	tailSpans          int64
+	tailOverflows      int64
+	deferTimeout       int64
+	coarseNow          atomic.Value
+	wallClock          atomic.Value
+	spanBagFactory     atomic.Value
+	panicWrapper       atomic.Value
+	adoptedTrace       atomic.Value
+	flushAnnotation    atomic.Value
+	resource           atomic.Value
+	observerPanic      atomic.Value
 
 	watcherMtx     sync.Mutex
 	watcherCounter int64
@@ -42,6 +85,42 @@ type Registry struct {
 
 	orphanMtx sync.Mutex
 	orphans   map[*Span]struct{}
+
+	orphanNotifier orphanNotifier
+
+	traceSizes traceSizes
+
+	goroutineMtx sync.Mutex
+	currentSpans map[int64]*Span
+
+	correlationMtx sync.Mutex
+	correlations   correlations
+
+	tagMtx    sync.Mutex
+	tagValues map[string]map[string]struct{}
+
+	stream *spanStream
+
+	storeMtx    sync.RWMutex
+	store       *spanStoreExporter
+	storeCancel func() // stops observing new Traces for the store
+
+	funcRateMtx sync.Mutex
+	funcRates   map[string]float64
+
+	clockMtx    sync.Mutex
+	clockStop   chan struct{}
+	clockHooked bool // whether Shutdown stops the clock
+
+	observerPanicOnce sync.Once
+
+	// only set by tests, before the Registry is used
+	testClock func() time.Time // replaces monotime.Now, see now
+
+	shutdownMtx   sync.Mutex
+	shutdown      bool
+	shutdownHooks []func()
+	exportReady   map[*Trace]struct{}
 }
 
 // NewRegistry creates a NewRegistry, though you almost certainly just want
@@ -51,7 +130,15 @@ func NewRegistry() *Registry {
 		traceWatchers: map[int64]func(*Trace){},
 		scopes:        map[string]*Scope{},
 		spans:         map[*Span]struct{}{},
-		orphans:       map[*Span]struct{}{}}
+		orphans:       map[*Span]struct{}{},
+		stream:        &spanStream{},
+		maxTailSpans:  DefaultMaxTailBufferedSpans,
+		correlations: correlations{
+			ttl:     DefaultCorrelationTTL,
+			maxKeys: DefaultMaxCorrelationKeys},
+		orphanNotifier: orphanNotifier{
+			rate:   DefaultOrphanRate,
+			tokens: orphanBurst(DefaultOrphanRate)}}
 }
 
 // Package creates a new monitoring Scope, named after the top level package.
@@ -77,13 +164,418 @@ func (r *Registry) ScopeNamed(name string) *Scope {
 	return s
 }
 
+// SetClassifyContextErrors controls whether Spans that finish with a nil
+// error while their context is already canceled or past its deadline get
+// called out. When enabled, such Spans are annotated with "ctx.err" and the
+// context's error, and counted in their Func's ContextErrors. They still
+// count as successes otherwise. This catches functions that swallow
+// cancellation. It's off by default.
+func (r *Registry) SetClassifyContextErrors(enabled bool) {
+	var val int32
+	if enabled {
+		val = 1
+	}
+	atomic.StoreInt32(&r.classifyCtxErrs, val)
+}
+
+func (r *Registry) classifiesContextErrors() bool {
+	return atomic.LoadInt32(&r.classifyCtxErrs) != 0
+}
+
+// FinishedParentPolicy controls what happens when a Span is started from a
+// context whose Span already finished, which usually means a goroutine
+// outlived the task that started it. See Registry.SetFinishedParentPolicy.
+type FinishedParentPolicy int32
+
+const (
+	// AnnotateFinishedParent keeps the finished Span as the parent, so the
+	// new Span is immediately orphaned, and marks the new Span with a
+	// "parent-already-finished" Annotation holding the parent's id. This is
+	// the default.
+	AnnotateFinishedParent FinishedParentPolicy = iota
+	// DetachFinishedParent annotates the new Span like AnnotateFinishedParent,
+	// but starts it as a new root Span in the same Trace instead of parenting
+	// it to the finished Span.
+	DetachFinishedParent
+)
+
+// SetFinishedParentPolicy sets how Spans started from already finished Spans
+// are handled.
+func (r *Registry) SetFinishedParentPolicy(policy FinishedParentPolicy) {
+	atomic.StoreInt32(&r.finishedParents, int32(policy))
+}
+
+// FinishedParentPolicy returns the policy set with SetFinishedParentPolicy.
+func (r *Registry) FinishedParentPolicy() FinishedParentPolicy {
+	return FinishedParentPolicy(atomic.LoadInt32(&r.finishedParents))
+}
+
+// Scope retrieves or creates a Scope by path. Paths use slashes for nesting,
+// such as "storage/s3". Dots are treated as slashes, so "storage.s3" is the
+// same Scope, and leading or trailing separators are ignored. See also
+// Scope.Scope and ScopeNamed.
+func (r *Registry) Scope(path string) *Scope {
+	return r.ScopeNamed(strings.Trim(strings.Replace(path, ".", "/", -1), "/"))
+}
+
+// LookupFunc returns the existing Func with the given full name (see
+// Func.FullName), such as "storage/s3.Get", or nil if there isn't one.
+// Unlike Scope.FuncNamed, it never creates anything.
+func (r *Registry) LookupFunc(fullName string) (f *Func) {
+	r.Scopes(func(s *Scope) {
+		if f == nil && strings.HasPrefix(fullName, s.name+".") {
+			f = s.lookupFunc(fullName[len(s.name)+1:])
+		}
+	})
+	return f
+}
+
+// FuncsMatching calls 'cb' on all currently known Funcs whose full names
+// match the given path.Match pattern, such as "storage/*" for every Func in
+// Scopes nested under "storage", or "storage.*" for every Func directly in
+// the "storage" Scope. Invalid patterns match nothing.
+func (r *Registry) FuncsMatching(pattern string, cb func(f *Func)) {
+	r.Funcs(func(f *Func) {
+		if matched, _ := path.Match(pattern, f.FullName()); matched {
+			cb(f)
+		}
+	})
+}
+
+func (r *Registry) removeScope(s *Scope) {
+	r.scopeMtx.Lock()
+	if r.scopes[s.name] == s {
+		delete(r.scopes, s.name)
+	}
+	r.scopeMtx.Unlock()
+}
+
+func (r *Registry) lateSpan() {
+	atomic.AddInt64(&r.lateSpans, 1)
+}
+
+// LateSpans returns how many Spans were started against a Scope after that
+// Scope was closed. See Scope.Close.
+func (r *Registry) LateSpans() int64 {
+	return atomic.LoadInt64(&r.lateSpans)
+}
+
+// SetSamplerSeed sets the seed used by SampleTrace. Services that should make
+// the same sampling decisions for the same Traces must use the same seed.
+func (r *Registry) SetSamplerSeed(seed uint64) {
+	atomic.StoreUint64(&r.samplerSeed, seed)
+}
+
+// SampleTrace returns whether the Trace with the given id falls within the
+// given sampling rate (between 0 and 1), seeded by SetSamplerSeed. See
+// SampleTraceId for the algorithm.
+func (r *Registry) SampleTrace(traceId int64, rate float64) bool {
+	return SampleTraceId(traceId, atomic.LoadUint64(&r.samplerSeed), rate)
+}
+
+// SetArgSizeLimit limits how long each rendered Task argument can be (see
+// Span.Args), so an accidentally huge slice or map argument can't blow up
+// the size of every trace that includes it. Longer arguments are cut off
+// after n bytes and marked with "<N bytes elided>". Zero or less means no
+// limit, which is the default. Arguments are rendered when they're read, so
+// the limit applies to Spans that are already running too.
+func (r *Registry) SetArgSizeLimit(n int) {
+	atomic.StoreInt64(&r.argSizeLimit, int64(n))
+}
+
+// ArgSizeLimit returns the limit set with SetArgSizeLimit.
+func (r *Registry) ArgSizeLimit() int {
+	return int(atomic.LoadInt64(&r.argSizeLimit))
+}
+
+// SetMaxArgs limits how many Task arguments a new Span keeps, so that
+// variadic instrumentation with dozens of arguments can't bloat every Span.
+// Arguments past the first n are dropped when the Span starts, and the Span
+// is annotated with "args.truncated" and how many were dropped. Zero or less
+// means no limit, which is the default.
+func (r *Registry) SetMaxArgs(n int) {
+	atomic.StoreInt64(&r.maxArgs, int64(n))
+}
+
+// MaxArgs returns the limit set with SetMaxArgs.
+func (r *Registry) MaxArgs() int {
+	return int(atomic.LoadInt64(&r.maxArgs))
+}
+
+// SetPanicWrapper registers a hook that Tasks call when re-panicking after
+// a panic passed through them, so that the value recovered further up can
+// say where the panic came from, such as the Func name and Trace id of the
+// innermost Span. The hook is given the Span and the recovered value, and
+// its result is what gets panicked with. It's called by every Task the
+// panic passes through, so a wrapper that only cares about the innermost
+// Span should pass values it already wrapped through unchanged. Each Span
+// records the value it recovered, before wrapping. A nil wrapper restores
+// the default of re-panicking with the original value.
+func (r *Registry) SetPanicWrapper(
+	wrapper func(s *Span, rec interface{}) interface{}) {
+	r.panicWrapper.Store(panicWrapperRef{wrapper: wrapper})
+}
+
+type panicWrapperRef struct {
+	wrapper func(s *Span, rec interface{}) interface{}
+}
+
+func (r *Registry) wrapPanic(s *Span, rec interface{}) interface{} {
+	ref, _ := r.panicWrapper.Load().(panicWrapperRef)
+	if ref.wrapper == nil {
+		return rec
+	}
+	return ref.wrapper(s, rec)
+}
+
+// SetFlushOnAnnotation makes any Span annotated with the given name (see
+// Span.Annotate), such as "slo.breach", force its Trace to be sampled (see
+// Trace.SetSamplingPriority) and request that it be exported right away
+// (see Trace.FlushRequested), so interesting Traces are captured without
+// waiting on sampling or batching. An empty name turns this off, which is
+// the default.
+func (r *Registry) SetFlushOnAnnotation(name string) {
+	r.flushAnnotation.Store(name)
+}
+
+func (r *Registry) flushesOn(name string) bool {
+	flushName, _ := r.flushAnnotation.Load().(string)
+	return flushName != "" && flushName == name
+}
+
+// SetResource sets attributes describing the process as a whole, such as
+// "service.name" or "host.name", which exporters that support it, such as
+// OTLPObserver, send once per batch of Spans rather than on every Span,
+// following OpenTelemetry's resource model. attrs is copied.
+func (r *Registry) SetResource(attrs map[string]string) {
+	resource := make(map[string]string, len(attrs))
+	for key, val := range attrs {
+		resource[key] = val
+	}
+	r.resource.Store(resource)
+}
+
+// Resource returns a copy of the attributes set with SetResource.
+func (r *Registry) Resource() map[string]string {
+	resource, _ := r.resource.Load().(map[string]string)
+	rv := make(map[string]string, len(resource))
+	for key, val := range resource {
+		rv[key] = val
+	}
+	return rv
+}
+
+// SetAnnotationSampling bounds how many annotations added with Span.Annotate
+// each Span keeps to k, for Spans annotated once per item of a large batch
+// and the like. Once a Span has k annotations, further ones are reservoir
+// sampled, so the Span keeps a uniform random sample of k out of all of its
+// annotations rather than the first or most recent k. Annotations monkit adds
+// itself, such as "status" or "deadline", are always kept and don't count
+// towards k. Zero or less keeps every annotation, which is the default.
+func (r *Registry) SetAnnotationSampling(k int) {
+	atomic.StoreInt64(&r.annotSampling, int64(k))
+}
+
+// AnnotationSampling returns the limit set with SetAnnotationSampling.
+func (r *Registry) AnnotationSampling() int {
+	return int(atomic.LoadInt64(&r.annotSampling))
+}
+
+// SetMaxBaggageBytes limits the total size of each Trace's baggage items, as
+// the sum of the lengths of all keys and values, so that propagating baggage
+// can't bloat every outgoing request. Items that would exceed the budget are
+// rejected and counted (see RejectedBaggage). Zero or less means no limit,
+// which is the default.
+func (r *Registry) SetMaxBaggageBytes(n int) {
+	atomic.StoreInt64(&r.maxBaggageBytes, int64(n))
+}
+
+// MaxBaggageBytes returns the limit set with SetMaxBaggageBytes.
+func (r *Registry) MaxBaggageBytes() int {
+	return int(atomic.LoadInt64(&r.maxBaggageBytes))
+}
+
+func (r *Registry) rejectBaggage() {
+	atomic.AddInt64(&r.rejectedBaggage, 1)
+}
+
+// RejectedBaggage returns how many baggage items were rejected for exceeding
+// the limit set with SetMaxBaggageBytes.
+func (r *Registry) RejectedBaggage() int64 {
+	return atomic.LoadInt64(&r.rejectedBaggage)
+}
+
+// SetSampleRateForFunc sets the sampling rate for Traces whose root Span is
+// started by the Func with the given full name (see Func.FullName), such as
+// 0 for health checks or 1 for payment endpoints. When such a root Span
+// starts, its Trace is marked sampled or not (see Trace.SetSampled) using
+// SampleTrace with this rate, overriding whatever was decided before, and
+// every Span in the Trace shares that decision. Traces with an explicit
+// sampling priority are left alone. A negative rate removes the override.
+func (r *Registry) SetSampleRateForFunc(fullName string, rate float64) {
+	r.funcRateMtx.Lock()
+	if rate < 0 {
+		delete(r.funcRates, fullName)
+	} else {
+		if r.funcRates == nil {
+			r.funcRates = map[string]float64{}
+		}
+		r.funcRates[fullName] = rate
+	}
+	atomic.StoreInt32(&r.funcRateCount, int32(len(r.funcRates)))
+	r.funcRateMtx.Unlock()
+}
+
+// sampleRoot applies any SetSampleRateForFunc override for a new root Span.
+func (r *Registry) sampleRoot(s *Span) {
+	if atomic.LoadInt32(&r.funcRateCount) == 0 ||
+		s.trace.SamplingPriority() != 0 || s.trace.Shed() {
+		return
+	}
+	r.funcRateMtx.Lock()
+	rate, ok := r.funcRates[s.Func().FullName()]
+	r.funcRateMtx.Unlock()
+	if ok {
+		s.trace.SetSampled(r.SampleTrace(s.trace.Id(), rate))
+	}
+}
+
+// startTrace sets up a brand new Trace, unless it has to be shed.
+func (r *Registry) startTrace(t *Trace) {
+	// even shed Traces honor the Registry's limits and Shutdown.
+	t.setRegistry(r)
+	if r.admitTrace(t) {
+		r.observeTrace(t)
+	}
+}
+
+// AdoptTrace makes every new root Span that isn't given its own Trace (see
+// Func.ResetTrace and Func.RemoteTrace) join a Trace with the given id and
+// sampling decision, instead of starting a new Trace. It's meant for
+// continuing a long-running workflow's Trace after a process restart, from
+// a Trace id persisted before the restart. The Trace is handed to the
+// Registry's trace observers (see ObserveTraces) once, now, and doesn't
+// count towards SetMaxLiveTraces. Calling AdoptTrace again replaces the
+// adopted Trace; see ReleaseAdoptedTrace to stop adopting.
+//
+// The id is trusted as is, so beware of collisions: if the Trace is still
+// running elsewhere, such as in the previous incarnation of a process that
+// hasn't quite exited, or the id was generated by an unrelated system,
+// unrelated Spans will be merged into one Trace by whatever collects them.
+// Likewise, all root Spans in the process join the adopted Trace, even ones
+// unrelated to the workflow. Also, the adopted Trace can go idle between
+// root Spans, and its ExportReady channel closes the first time it does.
+func (r *Registry) AdoptTrace(traceId int64, sampled bool) *Trace {
+	t := NewTrace(traceId)
+	t.SetSampled(sampled)
+	r.observeTrace(t)
+	r.adoptedTrace.Store(adoptedTraceRef{trace: t})
+	return t
+}
+
+// ReleaseAdoptedTrace stops root Spans from joining the Trace set with
+// AdoptTrace.
+func (r *Registry) ReleaseAdoptedTrace() {
+	r.adoptedTrace.Store(adoptedTraceRef{})
+}
+
+type adoptedTraceRef struct {
+	trace *Trace
+}
+
+// adopted returns the Trace set with AdoptTrace, if any.
+func (r *Registry) adopted() *Trace {
+	ref, _ := r.adoptedTrace.Load().(adoptedTraceRef)
+	return ref.trace
+}
+
+// SetMaxLiveTraces limits how many Traces started in this process can have
+// running Spans at once, to protect the process from running out of memory
+// because of tracing during incidents. Once the limit is reached, new root
+// Spans still run and are still counted in their Func's stats, but their
+// Traces are shed: they're unsampled and never handed to the Registry's
+// trace observers (see ObserveTraces and Trace.Shed). Each shed Trace is
+// counted (see ShedTraces). Traces that are already live are unaffected.
+// Zero or less means no limit, which is the default.
+func (r *Registry) SetMaxLiveTraces(n int) {
+	atomic.StoreInt64(&r.maxLiveTraces, int64(n))
+}
+
+// LiveTraces returns how many Traces currently count towards the limit set
+// by SetMaxLiveTraces.
+func (r *Registry) LiveTraces() int64 {
+	return atomic.LoadInt64(&r.liveTraces)
+}
+
+// ShedTraces returns how many Traces have been shed because of
+// SetMaxLiveTraces.
+func (r *Registry) ShedTraces() int64 {
+	return atomic.LoadInt64(&r.shedTraces)
+}
+
+func (r *Registry) admitTrace(t *Trace) bool {
+	for {
+		live := atomic.LoadInt64(&r.liveTraces)
+		if max := atomic.LoadInt64(&r.maxLiveTraces); max > 0 && live >= max {
+			atomic.AddInt64(&r.shedTraces, 1)
+			t.mtx.Lock()
+			t.shed = true
+			t.mtx.Unlock()
+			t.SetSampled(false)
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&r.liveTraces, live, live+1) {
+			t.mtx.Lock()
+			t.live = true
+			t.mtx.Unlock()
+			return true
+		}
+	}
+}
+
+func (r *Registry) releaseLiveTrace() {
+	atomic.AddInt64(&r.liveTraces, -1)
+}
+
 func (r *Registry) observeTrace(t *Trace) {
+	t.setRegistry(r)
+	if r.SamplingMode() == TailSampling {
+		t.tail = &tailBuffer{r: r}
+	}
 	watcher := loadTraceWatcherRef(&r.traceWatcher)
 	if watcher != nil {
 		watcher.watcher(t)
 	}
 }
 
+// SetDefaultAnnotations registers a hook that is called once for every new
+// Span, right after it is constructed. Any Annotations the hook returns are
+// added to the Span, which makes it a good place to attach environment
+// metadata such as host, pod, or version. The hook is on the Span start path,
+// so it should be cheap. Passing nil removes the hook.
+func (r *Registry) SetDefaultAnnotations(cb func(s *Span) []Annotation) {
+	if cb == nil {
+		storeDefaultAnnotationsRef(&r.defaultAnnotations, nil)
+		return
+	}
+	storeDefaultAnnotationsRef(&r.defaultAnnotations,
+		&defaultAnnotationsRef{cb: cb})
+}
+
+func (r *Registry) annotateDefaults(s *Span) {
+	ref := loadDefaultAnnotationsRef(&r.defaultAnnotations)
+	if ref == nil {
+		return
+	}
+	annotations := ref.cb(s)
+	if len(annotations) == 0 {
+		return
+	}
+	s.mtx.Lock()
+	s.annotations = append(s.annotations, annotations...)
+	s.mtx.Unlock()
+}
+
 func (r *Registry) updateWatcher() {
 	cbs := make([]func(*Trace), 0, len(r.traceWatchers))
 	for _, cb := range r.traceWatchers {
@@ -202,11 +694,67 @@ func (r *Registry) Scopes(cb func(s *Scope)) {
 	}
 }
 
-// Funcs calls 'cb' on all currently known Funcs.
+// Funcs calls 'cb' on all currently known Funcs, across all Scopes. This is
+// useful for exporters that want to discover every Func up front; use
+// Func.FullName to get a fully qualified name. Funcs created while Funcs is
+// running may or may not be visited.
 func (r *Registry) Funcs(cb func(f *Func)) {
 	r.Scopes(func(s *Scope) { s.Funcs(cb) })
 }
 
+func (r *Registry) onShutdown(hook func()) {
+	r.shutdownMtx.Lock()
+	if !r.shutdown {
+		r.shutdownHooks = append(r.shutdownHooks, hook)
+		r.shutdownMtx.Unlock()
+		return
+	}
+	r.shutdownMtx.Unlock()
+	hook()
+}
+
+// watchExportReady returns false if the Registry is already shut down.
+func (r *Registry) watchExportReady(t *Trace) bool {
+	r.shutdownMtx.Lock()
+	defer r.shutdownMtx.Unlock()
+	if r.shutdown {
+		return false
+	}
+	if r.exportReady == nil {
+		r.exportReady = map[*Trace]struct{}{}
+	}
+	r.exportReady[t] = struct{}{}
+	return true
+}
+
+func (r *Registry) unwatchExportReady(t *Trace) {
+	r.shutdownMtx.Lock()
+	delete(r.exportReady, t)
+	r.shutdownMtx.Unlock()
+}
+
+// Shutdown stops any background goroutines that were started on behalf of
+// the Registry, such as TraceRetention sweepers, and closes any pending
+// Trace.ExportReady channels. Stats and Spans can still be recorded
+// afterwards.
+func (r *Registry) Shutdown() {
+	r.shutdownMtx.Lock()
+	hooks := r.shutdownHooks
+	traces := make([]*Trace, 0, len(r.exportReady))
+	for t := range r.exportReady {
+		traces = append(traces, t)
+	}
+	r.shutdown = true
+	r.shutdownHooks = nil
+	r.shutdownMtx.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+	for _, t := range traces {
+		t.markComplete(true)
+	}
+}
+
 // Stats implements the StatSource interface.
 func (r *Registry) Stats(cb func(name string, val float64)) {
 	r.Scopes(func(s *Scope) {
@@ -214,6 +762,7 @@ func (r *Registry) Stats(cb func(name string, val float64)) {
 			cb(fmt.Sprintf("%s.%s", s.name, name), val)
 		})
 	})
+	r.traceSizeStats("", cb)
 }
 
 func filterPrefix(s, prefix string) (subfilter string, ok bool) {
@@ -234,6 +783,7 @@ func (r *Registry) FilteredStats(prefix string,
 			})
 		}
 	})
+	r.traceSizeStats(prefix, cb)
 }
 
 var _ FilterableStatSource = (*Registry)(nil)
@@ -256,6 +806,19 @@ func Funcs(cb func(f *Func)) { Default.Funcs(cb) }
 // Package is just a wrapper around Default.Package
 func Package() *Scope { return Default.ScopeNamed(callerPackage(1)) }
 
+// AdoptTrace is just a wrapper around Default.AdoptTrace
+func AdoptTrace(traceId int64, sampled bool) *Trace {
+	return Default.AdoptTrace(traceId, sampled)
+}
+
+// SetCurrentSpan is just a wrapper around Default.SetCurrentSpan
+func SetCurrentSpan(s *Span) (restore func()) {
+	return Default.SetCurrentSpan(s)
+}
+
+// CurrentSpan is just a wrapper around Default.CurrentSpan
+func CurrentSpan() *Span { return Default.CurrentSpan() }
+
 // Stats is just a wrapper around Default.Stats
 func Stats(cb func(name string, val float64)) { Default.Stats(cb) }
 
@@ -266,7 +829,7 @@ func (s spanSorter) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
 
 func (s spanSorter) Less(i, j int) bool {
 	ispan, jspan := s[i], s[j]
-	iname, jname := ispan.f.FullName(), jspan.f.FullName()
+	iname, jname := ispan.Func().FullName(), jspan.Func().FullName()
 	return (iname < jname) || (iname == jname && ispan.id < jspan.id)
 }
 
@@ -275,3 +838,9 @@ type scopeSorter []*Scope
 func (s scopeSorter) Len() int           { return len(s) }
 func (s scopeSorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 func (s scopeSorter) Less(i, j int) bool { return s[i].name < s[j].name }
+
+type funcSorter []*Func
+
+func (f funcSorter) Len() int           { return len(f) }
+func (f funcSorter) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f funcSorter) Less(i, j int) bool { return f[i].name < f[j].name }
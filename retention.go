@@ -0,0 +1,187 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/spacemonkeygo/monotime"
+)
+
+type retainedTrace struct {
+	completed time.Time
+	rebased   int64 // zero unless Rebase was called
+	spans     []SpanData
+}
+
+type pendingTrace struct {
+	firstSeen time.Time
+	spans     []SpanData
+}
+
+// TraceRetention keeps snapshots of the Spans of completed Traces for a
+// bounded amount of time, such as for a "recent traces" debug view. A Trace
+// is considered complete when its root Span finishes. Spans that finish
+// after their root (orphans) are added to the completed Trace if it's still
+// retained. Spans of Traces that don't complete within the TTL of their
+// first Span finishing, including orphans of Traces that were already
+// evicted, are dropped. Construct with NewTraceRetention.
+type TraceRetention struct {
+	ttl  time.Duration
+	now  func() time.Time
+	stop func()
+
+	mtx       sync.Mutex
+	stopped   bool
+	pending   map[*Trace]*pendingTrace
+	completed map[*Trace]*retainedTrace
+}
+
+// NewTraceRetention starts retaining all Traces that start on Registry r from
+// now on. Completed Traces are evicted by a background goroutine once they
+// are older than ttl. The goroutine runs until Stop is called or r is shut
+// down.
+func NewTraceRetention(r *Registry, ttl time.Duration) *TraceRetention {
+	return newTraceRetention(r, ttl, monotime.Now)
+}
+
+// newTraceRetention is NewTraceRetention with a clock, for tests.
+func newTraceRetention(r *Registry, ttl time.Duration,
+	now func() time.Time) *TraceRetention {
+	tr := &TraceRetention{
+		ttl:       ttl,
+		now:       now,
+		pending:   map[*Trace]*pendingTrace{},
+		completed: map[*Trace]*retainedTrace{},
+	}
+
+	cancel := r.ObserveTraces(func(t *Trace) {
+		t.ObserveSpans(tr)
+		t.addRetention(tr)
+	})
+	done := make(chan struct{})
+	var once sync.Once
+	tr.stop = func() {
+		once.Do(func() {
+			cancel()
+			close(done)
+			tr.mtx.Lock()
+			tr.stopped = true
+			tr.pending = nil
+			tr.mtx.Unlock()
+		})
+	}
+	r.onShutdown(tr.Stop)
+
+	go tr.sweeper(done)
+	return tr
+}
+
+func (tr *TraceRetention) sweeper(done <-chan struct{}) {
+	ticker := time.NewTicker(tr.ttl/4 + time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			tr.sweep()
+		}
+	}
+}
+
+func (tr *TraceRetention) sweep() {
+	cutoff := tr.now().Add(-tr.ttl)
+	tr.mtx.Lock()
+	for t, retained := range tr.completed {
+		if retained.completed.Before(cutoff) {
+			delete(tr.completed, t)
+		}
+	}
+	for t, pending := range tr.pending {
+		if pending.firstSeen.Before(cutoff) {
+			delete(tr.pending, t)
+		}
+	}
+	tr.mtx.Unlock()
+}
+
+// Stop stops retaining Traces and stops the background eviction goroutine.
+// Already completed Traces remain available, but the Spans of Traces that
+// haven't completed yet are dropped.
+func (tr *TraceRetention) Stop() { tr.stop() }
+
+// Start implements the SpanObserver interface.
+func (tr *TraceRetention) Start(s *Span) {}
+
+// Finish implements the SpanObserver interface.
+func (tr *TraceRetention) Finish(s *Span, err error, panicked bool,
+	finish time.Time) {
+	data := *NewSpanData(s, err, panicked, finish)
+	t := s.Trace()
+	tr.mtx.Lock()
+	defer tr.mtx.Unlock()
+	if tr.stopped {
+		return
+	}
+	if retained, ok := tr.completed[t]; ok {
+		if retained.rebased != 0 {
+			data.TraceId = retained.rebased
+		}
+		retained.spans = append(retained.spans, data)
+		return
+	}
+	pending := tr.pending[t]
+	if pending == nil {
+		pending = &pendingTrace{firstSeen: tr.now()}
+	}
+	pending.spans = append(pending.spans, data)
+	if s.Parent() != nil {
+		tr.pending[t] = pending
+		return
+	}
+	delete(tr.pending, t)
+	tr.completed[t] = &retainedTrace{completed: tr.now(), spans: pending.spans}
+}
+
+// rebase rewrites the Trace id of t's retained Spans, if t completed and is
+// still retained.
+func (tr *TraceRetention) rebase(t *Trace, traceId int64) bool {
+	tr.mtx.Lock()
+	defer tr.mtx.Unlock()
+	retained, ok := tr.completed[t]
+	if !ok {
+		return false
+	}
+	retained.rebased = traceId
+	for i := range retained.spans {
+		retained.spans[i].TraceId = traceId
+	}
+	return true
+}
+
+// TracesSince returns the Spans of all retained Traces that completed at or
+// after since.
+func (tr *TraceRetention) TracesSince(since time.Time) (spans []SpanData) {
+	tr.mtx.Lock()
+	for _, retained := range tr.completed {
+		if !retained.completed.Before(since) {
+			spans = append(spans, retained.spans...)
+		}
+	}
+	tr.mtx.Unlock()
+	return spans
+}
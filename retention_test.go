@@ -0,0 +1,159 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClock is a clock for tests that only moves when told to.
+type testClock struct {
+	mtx sync.Mutex
+	now time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Unix(1000, 0)}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mtx.Lock()
+	c.now = c.now.Add(d)
+	c.mtx.Unlock()
+}
+
+func TestTraceRetentionTTL(t *testing.T) {
+	r := NewRegistry()
+	defer r.Shutdown()
+	clock := newTestClock()
+	tr := newTraceRetention(r, time.Minute, clock.Now)
+
+	f := r.ScopeNamed("retention").FuncNamed("work")
+	run := func() {
+		ctx := context.Background()
+		defer f.Task(&ctx)(nil)
+		f.Task(&ctx)(nil)
+	}
+
+	run()
+	if spans := tr.TracesSince(time.Time{}); len(spans) != 2 {
+		t.Fatalf("expected 2 retained spans, got %d", len(spans))
+	}
+
+	clock.Advance(45 * time.Second)
+	run()
+	if spans := tr.TracesSince(clock.Now()); len(spans) != 2 {
+		t.Fatalf("expected 2 recent spans, got %d", len(spans))
+	}
+
+	clock.Advance(30 * time.Second)
+	tr.sweep()
+	if spans := tr.TracesSince(time.Time{}); len(spans) != 2 {
+		t.Fatalf("expected first trace to be evicted, got %d spans",
+			len(spans))
+	}
+}
+
+func TestTraceRetentionPendingEvicted(t *testing.T) {
+	r := NewRegistry()
+	defer r.Shutdown()
+	clock := newTestClock()
+	tr := newTraceRetention(r, time.Minute, clock.Now)
+	f := r.ScopeNamed("retention").FuncNamed("work")
+
+	// a child outliving its root after the Trace was evicted, and a Trace
+	// whose root never finishes
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	child := ctx
+	childDone := f.Task(&child)
+	done(nil)
+	ctx = context.Background()
+	f.Task(&ctx)
+	stuck := ctx
+	f.Task(&stuck)(nil)
+
+	pendingCount := func() int {
+		tr.mtx.Lock()
+		defer tr.mtx.Unlock()
+		return len(tr.pending)
+	}
+	if pendingCount() != 1 {
+		t.Fatalf("expected 1 pending trace, got %d", pendingCount())
+	}
+
+	clock.Advance(2 * time.Minute)
+	tr.sweep()
+	childDone(nil)
+	if pendingCount() != 1 {
+		t.Fatalf("expected only the late child pending, got %d",
+			pendingCount())
+	}
+
+	clock.Advance(2 * time.Minute)
+	tr.sweep()
+	if pendingCount() != 0 {
+		t.Fatalf("expected pending traces to be evicted, got %d",
+			pendingCount())
+	}
+
+	tr.Stop()
+	ctx = context.Background()
+	done = f.Task(&ctx)
+	child = ctx
+	f.Task(&child)(nil)
+	done(nil)
+	if pendingCount() != 0 || len(tr.TracesSince(time.Time{})) != 0 {
+		t.Fatal("expected nothing retained after Stop")
+	}
+}
+
+func TestTraceRebase(t *testing.T) {
+	r := NewRegistry()
+	defer r.Shutdown()
+	tr := NewTraceRetention(r, time.Minute)
+	f := r.ScopeNamed("retention").FuncNamed("work")
+
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	trace := SpanFromCtx(ctx).Trace()
+	f.Task(&ctx)(nil)
+	if trace.Rebase(1234) {
+		t.Fatal("rebase should fail before the trace completes")
+	}
+	done(nil)
+
+	if !trace.Rebase(1234) {
+		t.Fatal("rebase should succeed on a retained trace")
+	}
+	spans := tr.TracesSince(time.Time{})
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 retained spans, got %d", len(spans))
+	}
+	for _, span := range spans {
+		if span.TraceId != 1234 {
+			t.Fatalf("expected rebased trace id, got %d", span.TraceId)
+		}
+	}
+}
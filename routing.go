@@ -0,0 +1,125 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"sync"
+	"time"
+)
+
+// TraceSink receives the Spans of a whole Trace from a RoutingObserver, in
+// the order they finished.
+type TraceSink func(t *Trace, spans []SpanData)
+
+// RoutingObserver is a SpanObserver that collects the Spans of each Trace
+// and, once the Trace completes, hands them all to one of several named
+// TraceSinks chosen by a routing function. This allows for tiered storage,
+// such as sending Traces with errors (see Trace.HadError) or slow roots to
+// a detailed backend and everything else to a cheaper one:
+//
+//   o := monkit.NewRoutingObserver(
+//     func(t *monkit.Trace, spans []monkit.SpanData) string {
+//       if t.HadError() || spans[len(spans)-1].Duration() > time.Second {
+//         return "hot"
+//       }
+//       return "cold"
+//     })
+//   o.AddSink("hot", hotStore)
+//   o.AddSink("cold", coldStore)
+//
+// A Trace is considered complete once every Span the RoutingObserver saw
+// start has finished, which includes Spans started from finished parents
+// (see DetachFinishedParent). Spans that start after their Trace
+// completed (see Trace.ExportReady) are dropped. Construct with
+// NewRoutingObserver.
+type RoutingObserver struct {
+	route func(t *Trace, spans []SpanData) string
+
+	mtx     sync.Mutex
+	sinks   map[string]TraceSink
+	pending map[*Trace]*routedTrace
+}
+
+type routedTrace struct {
+	spans   []SpanData
+	running int
+}
+
+// NewRoutingObserver creates a RoutingObserver that uses route to pick the
+// name of the sink for each completed Trace. Traces routed to a name with no
+// sink are dropped.
+func NewRoutingObserver(
+	route func(t *Trace, spans []SpanData) string) *RoutingObserver {
+	return &RoutingObserver{
+		route:   route,
+		sinks:   map[string]TraceSink{},
+		pending: map[*Trace]*routedTrace{},
+	}
+}
+
+// AddSink registers sink under name, replacing any sink already registered
+// under that name.
+func (o *RoutingObserver) AddSink(name string, sink TraceSink) {
+	o.mtx.Lock()
+	o.sinks[name] = sink
+	o.mtx.Unlock()
+}
+
+// Start implements the SpanObserver interface.
+func (o *RoutingObserver) Start(s *Span) {
+	t := s.Trace()
+	if t.completed() {
+		return
+	}
+	o.mtx.Lock()
+	pending := o.pending[t]
+	if pending == nil {
+		pending = &routedTrace{}
+		o.pending[t] = pending
+	}
+	pending.running++
+	o.mtx.Unlock()
+}
+
+// Finish implements the SpanObserver interface.
+func (o *RoutingObserver) Finish(s *Span, err error, panicked bool,
+	finish time.Time) {
+	t := s.Trace()
+	o.mtx.Lock()
+	pending := o.pending[t]
+	if pending == nil {
+		// a late Span, or one that started before we were observing.
+		o.mtx.Unlock()
+		return
+	}
+	pending.spans = append(pending.spans,
+		*NewSpanData(s, err, panicked, finish))
+	pending.running--
+	if pending.running > 0 {
+		o.mtx.Unlock()
+		return
+	}
+	delete(o.pending, t)
+	o.mtx.Unlock()
+
+	spans := pending.spans
+	name := o.route(t, spans)
+	o.mtx.Lock()
+	sink := o.sinks[name]
+	o.mtx.Unlock()
+	if sink != nil {
+		sink(t, spans)
+	}
+}
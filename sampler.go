@@ -0,0 +1,97 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"time"
+)
+
+// SampleTraceId makes a sampling decision for a Trace id that only depends on
+// the id, the seed, and the rate, so every service that agrees on the seed and
+// rate makes the same decision for the same Trace. The algorithm, for ports
+// to other languages, is the splitmix64 finalizer over the id xor the seed,
+// with all arithmetic on unsigned 64 bit integers modulo 2^64:
+//
+//   x := uint64(id) ^ seed
+//   x += 0x9e3779b97f4a7c15
+//   x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+//   x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+//   x = x ^ (x >> 31)
+//
+// The Trace is sampled if float64(x >> 11) / 2^53 < rate, which is exact in
+// IEEE 754 double precision.
+func SampleTraceId(id int64, seed uint64, rate float64) bool {
+	return float64(mixId(id, seed)>>11)/(1<<53) < rate
+}
+
+// mixId is the splitmix64 finalizer over id xor seed. See SampleTraceId.
+func mixId(id int64, seed uint64) uint64 {
+	x := uint64(id) ^ seed
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// QuantileSampler is a SpanObserver that samples Traces based on how slow
+// their root Span was compared to the recent latency distribution of the root
+// Span's Func. When a root Span finishes, its Trace is marked as sampled (see
+// Trace.SetSampled) if the Span took longer than the configured quantile of
+// the Func's success times. Faster Traces are sampled with the baseline
+// probability, which is decided deterministically by Trace id (see
+// Registry.SampleTrace). Expected usage like:
+//
+//   sampler := monkit.NewQuantileSampler(.95, .01)
+//   monkit.Default.ObserveTraces(func(t *monkit.Trace) {
+//     t.ObserveSpans(sampler)
+//   })
+//
+// Since the decision is made when the root Span finishes, a QuantileSampler
+// is best paired with a SpanObserver that buffers a Trace's Spans until then.
+type QuantileSampler struct {
+	quantile float64
+	baseline float64
+}
+
+// NewQuantileSampler creates a QuantileSampler that keeps every Trace whose
+// root Span is slower than the given quantile (e.g. .95) of its Func, and
+// the baseline fraction (e.g. .01) of the rest.
+func NewQuantileSampler(quantile, baseline float64) *QuantileSampler {
+	return &QuantileSampler{quantile: quantile, baseline: baseline}
+}
+
+// Start implements the SpanObserver interface.
+func (q *QuantileSampler) Start(s *Span) {}
+
+// Finish implements the SpanObserver interface.
+func (q *QuantileSampler) Finish(s *Span, err error, panicked bool,
+	finish time.Time) {
+	if s.Parent() != nil {
+		return
+	}
+	if q.slow(s.Func(), finish.Sub(s.AttemptStart())) ||
+		s.f.scope.r.SampleTrace(s.Trace().Id(), q.baseline) {
+		s.Trace().SetSampled(true)
+	}
+}
+
+func (q *QuantileSampler) slow(f *Func, duration time.Duration) bool {
+	times := f.SuccessTimes()
+	if times.Count == 0 {
+		// nothing to compare against yet, so everything is the tail.
+		return true
+	}
+	return duration > times.Query(q.quantile)
+}
@@ -0,0 +1,252 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestQuantileSampler(t *testing.T) {
+	f := NewRegistry().ScopeNamed("sampler").FuncNamed("work")
+	for i := 1; i <= 100; i++ {
+		f.end(nil, false, time.Duration(i)*time.Millisecond)
+	}
+
+	sampler := NewQuantileSampler(.95, 0)
+	finishRoot := func(duration time.Duration) *Trace {
+		ctx := context.Background()
+		f.Task(&ctx)(nil)
+		s := SpanFromCtx(ctx)
+		sampler.Finish(s, nil, false, s.Start().Add(duration))
+		return s.Trace()
+	}
+
+	if !finishRoot(time.Second).Sampled() {
+		t.Fatal("slow trace should have been sampled")
+	}
+	if finishRoot(time.Millisecond).Sampled() {
+		t.Fatal("fast trace should not have been sampled")
+	}
+}
+
+func TestSampleTraceDeterministic(t *testing.T) {
+	a, b, c := NewRegistry(), NewRegistry(), NewRegistry()
+	a.SetSamplerSeed(1234)
+	b.SetSamplerSeed(1234)
+	c.SetSamplerSeed(5678)
+
+	sampled, differs := 0, false
+	for i := 0; i < 10000; i++ {
+		id := NewId()
+		decision := a.SampleTrace(id, .25)
+		if decision != b.SampleTrace(id, .25) {
+			t.Fatalf("registries with the same seed disagree on %d", id)
+		}
+		if decision != c.SampleTrace(id, .25) {
+			differs = true
+		}
+		if decision {
+			sampled++
+		}
+	}
+	if !differs {
+		t.Fatal("expected a different seed to make different decisions")
+	}
+	if sampled < 2000 || sampled > 3000 {
+		t.Fatalf("expected roughly a quarter sampled, got %d of 10000", sampled)
+	}
+	if a.SampleTrace(42, 0) || !a.SampleTrace(42, 1) {
+		t.Fatal("rates of 0 and 1 should never and always sample")
+	}
+}
+
+func TestNewTraceInheritsSampled(t *testing.T) {
+	f := NewRegistry().ScopeNamed("sampler").FuncNamed("work")
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	parent := SpanFromCtx(ctx).Trace()
+	parent.SetSampled(true)
+
+	async := ctx
+	f.ResetTrace(&async)(nil)
+	child := SpanFromCtx(async).Trace()
+	if child == parent {
+		t.Fatal("expected a new trace")
+	}
+	if !child.Sampled() {
+		t.Fatal("new trace should inherit the parent's sampling decision")
+	}
+	done(nil)
+
+	unsampled := context.Background()
+	f.ResetTrace(&unsampled)(nil)
+	if SpanFromCtx(unsampled).Trace().Sampled() {
+		t.Fatal("trace without a sampled parent should not be sampled")
+	}
+}
+
+func TestSampleRateForFunc(t *testing.T) {
+	r := NewRegistry()
+	scope := r.ScopeNamed("endpoints")
+	health := scope.FuncNamed("health")
+	payment := scope.FuncNamed("payment")
+	search := scope.FuncNamed("search")
+	r.SetSampleRateForFunc("endpoints.health", 0)
+	r.SetSampleRateForFunc("endpoints.payment", 1)
+	r.SetSampleRateForFunc("endpoints.search", .5)
+
+	count := func(f *Func) (sampled int) {
+		for i := 0; i < 1000; i++ {
+			ctx := context.Background()
+			done := f.Task(&ctx)
+			child := ctx
+			f.Task(&child)(nil)
+			if SpanFromCtx(child).Trace().Sampled() {
+				sampled++
+			}
+			done(nil)
+		}
+		return sampled
+	}
+	if sampled := count(health); sampled != 0 {
+		t.Fatalf("expected no health traces sampled, got %d", sampled)
+	}
+	if sampled := count(payment); sampled != 1000 {
+		t.Fatalf("expected all payment traces sampled, got %d", sampled)
+	}
+	if sampled := count(search); sampled < 400 || sampled > 600 {
+		t.Fatalf("expected about half of search traces sampled, got %d",
+			sampled)
+	}
+}
+
+func TestTailSampling(t *testing.T) {
+	r := NewRegistry()
+	r.SetSamplingMode(TailSampling)
+	o := &recordingObserver{}
+	r.ObserveTraces(func(t *Trace) { t.ObserveSpans(o) })
+	f := r.ScopeNamed("sampler").FuncNamed("work")
+
+	run := func(fail bool) context.Context {
+		ctx := context.Background()
+		done := f.Task(&ctx)
+		child := ctx
+		f.Task(&child)(nil)
+		if len(o.started) != 0 || r.TailBufferedSpans() != 2 {
+			t.Fatalf("expected spans to be buffered, got %d started, %d held",
+				len(o.started), r.TailBufferedSpans())
+		}
+		var err error
+		if fail {
+			err = errors.New("failed")
+		}
+		done(&err)
+		return ctx
+	}
+
+	ctx := run(false)
+	trace := SpanFromCtx(ctx).Trace()
+	if trace.Sampled() || len(o.finished) != 0 {
+		t.Fatalf("clean trace should have been dropped, got %d spans",
+			len(o.finished))
+	}
+	// spans joining a dropped trace later get their own decision
+	late := ctx
+	f.Task(&late)(nil)
+	if trace.Sampled() || len(o.started) != 0 || len(o.finished) != 0 {
+		t.Fatalf("late clean span should have been dropped, got %d spans",
+			len(o.finished))
+	}
+	late = ctx
+	err := errors.New("failed")
+	f.Task(&late)(&err)
+	if !trace.Sampled() || len(o.started) != 1 || len(o.finished) != 1 {
+		t.Fatalf("late errored span should have been kept, got %d spans",
+			len(o.finished))
+	}
+	o.started, o.finished = nil, nil
+
+	if ctx := run(true); !SpanFromCtx(ctx).Trace().Sampled() ||
+		len(o.started) != 2 || len(o.finished) != 2 {
+		t.Fatalf("errored trace should have been kept, got %d spans",
+			len(o.finished))
+	}
+	if o.finished[0] != o.started[1] || o.finished[1] != o.started[0] {
+		t.Fatal("expected spans to be handed over in order")
+	}
+	if r.TailBufferedSpans() != 0 {
+		t.Fatalf("expected nothing buffered, got %d", r.TailBufferedSpans())
+	}
+}
+
+func TestTailSamplingOverflow(t *testing.T) {
+	r := NewRegistry()
+	r.SetSamplingMode(TailSampling)
+	r.SetMaxTailBufferedSpans(1)
+	o := &recordingObserver{}
+	r.ObserveTraces(func(t *Trace) { t.ObserveSpans(o) })
+	f := r.ScopeNamed("sampler").FuncNamed("work")
+
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	child := ctx
+	f.Task(&child)
+	if len(o.started) != 2 || r.TailOverflows() != 1 ||
+		r.TailBufferedSpans() != 0 {
+		t.Fatalf("expected trace to fall back to head sampling, got %d started",
+			len(o.started))
+	}
+	done(nil)
+	if len(o.finished) != 1 {
+		t.Fatalf("expected 1 finished span, got %d", len(o.finished))
+	}
+}
+
+func TestTraceSampleSpanReproducible(t *testing.T) {
+	run := func(seed uint64) (decisions []bool) {
+		r := NewRegistry()
+		r.SetSamplerSeed(seed)
+		f := r.ScopeNamed("sampler").FuncNamed("work")
+		ctx := context.Background()
+		defer f.RemoteTrace(&ctx, NewId(), NewTrace(42))(nil)
+		for i := 0; i < 64; i++ {
+			child := ctx
+			f.Task(&child)(nil)
+			decisions = append(decisions,
+				SpanFromCtx(child).Trace().SampleSpan(.5))
+		}
+		return decisions
+	}
+
+	first, second, other := run(1234), run(1234), run(5678)
+	sampled, differs := 0, false
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("decision %d differs between runs of the same trace", i)
+		}
+		if first[i] != other[i] {
+			differs = true
+		}
+		if first[i] {
+			sampled++
+		}
+	}
+	if !differs || sampled == 0 || sampled == len(first) {
+		t.Fatalf("expected varied decisions, got %v", first)
+	}
+}
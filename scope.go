@@ -18,11 +18,15 @@ import (
 	"fmt"
 	"sort"
 	"sync"
+	"sync/atomic"
 )
 
 // Scope represents a named collection of StatSources. Scopes are constructed
 // through Registries.
 type Scope struct {
+	// sync/atomic things
+	closed int32
+
 	r       *Registry
 	name    string
 	mtx     sync.Mutex
@@ -36,6 +40,20 @@ func newScope(r *Registry, name string) *Scope {
 		sources: map[string]StatSource{}}
 }
 
+// Scope retrieves or creates a Scope nested under this one, named
+// "<this scope's name>/<name>". See Registry.Scope.
+func (s *Scope) Scope(name string) *Scope {
+	return s.r.Scope(s.name + "/" + name)
+}
+
+// lookupFunc returns the Func with the given name, if one already exists.
+func (s *Scope) lookupFunc(name string) *Func {
+	s.mtx.Lock()
+	f, _ := s.sources[name].(*Func)
+	s.mtx.Unlock()
+	return f
+}
+
 // Func retrieves or creates a Func named after the currently executing
 // function name (via runtime.Caller. See FuncNamed to choose your own name.
 func (s *Scope) Func() *Func {
@@ -66,17 +84,19 @@ func (s *Scope) FuncNamed(name string) *Func {
 	return f
 }
 
-// Funcs calls 'cb' for all Funcs registered on this Scope.
+// Funcs calls 'cb' for all Funcs registered on this Scope, sorted by name.
+// The set of Funcs is snapshotted first, so 'cb' may safely create new Funcs.
 func (s *Scope) Funcs(cb func(f *Func)) {
 	s.mtx.Lock()
-	funcs := make(map[*Func]struct{}, len(s.sources))
+	funcs := make([]*Func, 0, len(s.sources))
 	for _, source := range s.sources {
 		if f, ok := source.(*Func); ok {
-			funcs[f] = struct{}{}
+			funcs = append(funcs, f)
 		}
 	}
 	s.mtx.Unlock()
-	for f := range funcs {
+	sort.Sort(funcSorter(funcs))
+	for _, f := range funcs {
 		cb(f)
 	}
 }
@@ -273,6 +293,25 @@ func (s *Scope) FilteredStats(prefix string,
 // Name returns the name of the Scope, often the Package name.
 func (s *Scope) Name() string { return s.name }
 
+// Close marks the Scope as closed and removes it from its Registry, so a
+// later ScopeNamed call with the same name will create a fresh Scope. This is
+// intended for plugin systems that unload instrumented code at runtime.
+//
+// Spans that are already running when Close is called complete normally.
+// Spans started against a Func of a closed Scope are no-ops: they aren't
+// tracked by the Registry, their Trace, or the Func's stats, and they aren't
+// given to SpanObservers. Each one increments the Registry's LateSpans
+// counter instead.
+func (s *Scope) Close() {
+	if atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		s.r.removeScope(s)
+	}
+}
+
+func (s *Scope) isClosed() bool {
+	return atomic.LoadInt32(&s.closed) != 0
+}
+
 var _ FilterableStatSource = (*Scope)(nil)
 
 type namedSource struct {
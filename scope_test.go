@@ -0,0 +1,107 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"context"
+	"testing"
+)
+
+func TestScopeClose(t *testing.T) {
+	r := NewRegistry()
+	s := r.ScopeNamed("plugin")
+	f := s.FuncNamed("work")
+
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	s.Close()
+
+	late := context.Background()
+	f.Task(&late)(nil)
+
+	span := SpanFromCtx(late)
+	if span == nil || !span.noop {
+		t.Fatal("expected a no-op span")
+	}
+	if r.LateSpans() != 1 {
+		t.Fatalf("expected 1 late span, got %d", r.LateSpans())
+	}
+	if f.Current() != 1 {
+		t.Fatalf("late span should not be counted, got %d current", f.Current())
+	}
+
+	// spans already running finish normally
+	done(nil)
+	if f.Success() != 1 {
+		t.Fatalf("expected 1 success, got %d", f.Success())
+	}
+
+	if r.ScopeNamed("plugin") == s {
+		t.Fatal("closed scope should have been removed from the registry")
+	}
+}
+
+func TestRegistryFuncs(t *testing.T) {
+	r := NewRegistry()
+	r.ScopeNamed("a").FuncNamed("one")
+	r.ScopeNamed("a").FuncNamed("two")
+	r.ScopeNamed("b").FuncNamed("three")
+	r.ScopeNamed("b").Meter("not-a-func")
+
+	var names []string
+	r.Funcs(func(f *Func) {
+		names = append(names, f.FullName())
+		// creating funcs during iteration must not deadlock
+		f.Scope().FuncNamed(f.ShortName() + "-again")
+	})
+	expected := []string{"a.one", "a.two", "b.three"}
+	if len(names) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, names)
+		}
+	}
+}
+
+func TestRegistryScopePaths(t *testing.T) {
+	r := NewRegistry()
+	s3 := r.Scope("storage").Scope("s3")
+	if s3 != r.Scope("storage/s3") || s3 != r.Scope("/storage/s3/") ||
+		s3 != r.Scope("storage.s3") || s3 != r.Scope(".storage.s3") {
+		t.Fatal("expected the same scope for the same path")
+	}
+	get := s3.FuncNamed("Get")
+	if get != s3.FuncNamed("Get") {
+		t.Fatal("expected the same func for the same name")
+	}
+	if r.LookupFunc("storage/s3.Get") != get {
+		t.Fatal("expected lookup by full name to find the func")
+	}
+	if r.LookupFunc("storage/s3.Put") != nil {
+		t.Fatal("lookup should not create funcs")
+	}
+	r.Scope("storage").FuncNamed("Open")
+	r.Scope("network").FuncNamed("Dial")
+
+	var matched []string
+	r.FuncsMatching("storage/*", func(f *Func) {
+		matched = append(matched, f.FullName())
+	})
+	if len(matched) != 1 || matched[0] != "storage/s3.Get" {
+		t.Fatalf("unexpected matches: %v", matched)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package semconv annotates monkit Spans using OpenTelemetry semantic
+// convention keys, so that instrumentation agrees on annotation names and
+// tracing backends recognize them.
+package semconv // import "gopkg.in/spacemonkeygo/monkit.v2/semconv"
+
+import (
+	"strconv"
+
+	"gopkg.in/spacemonkeygo/monkit.v2"
+)
+
+// The annotation keys, as named by the OpenTelemetry semantic conventions.
+const (
+	DBSystem       = "db.system"
+	DBName         = "db.name"
+	DBOperation    = "db.operation"
+	DBStatement    = "db.statement"
+	DBRowsAffected = "db.rows_affected"
+
+	HTTPMethod     = "http.method"
+	HTTPRoute      = "http.route"
+	HTTPURL        = "http.url"
+	HTTPStatusCode = "http.status_code"
+
+	NetPeerName = "net.peer.name"
+	NetPeerPort = "net.peer.port"
+
+	RPCSystem  = "rpc.system"
+	RPCService = "rpc.service"
+	RPCMethod  = "rpc.method"
+)
+
+// SetDBSystem records which database management system, such as
+// "postgresql" or "mysql", a Span talks to.
+func SetDBSystem(s *monkit.Span, system string) {
+	s.Annotate(DBSystem, system)
+}
+
+// SetDBName records the name of the database a Span talks to.
+func SetDBName(s *monkit.Span, name string) {
+	s.Annotate(DBName, name)
+}
+
+// SetDBOperation records the kind of database operation, such as "SELECT",
+// a Span performs.
+func SetDBOperation(s *monkit.Span, operation string) {
+	s.Annotate(DBOperation, operation)
+}
+
+// SetDBStatement records the database statement a Span executes. Beware of
+// recording sensitive data in statements with literal values.
+func SetDBStatement(s *monkit.Span, statement string) {
+	s.Annotate(DBStatement, statement)
+}
+
+// SetDBRows records how many rows a database statement affected.
+func SetDBRows(s *monkit.Span, n int64) {
+	s.Annotate(DBRowsAffected, strconv.FormatInt(n, 10))
+}
+
+// SetHTTPMethod records the HTTP request method, such as "GET".
+func SetHTTPMethod(s *monkit.Span, method string) {
+	s.Annotate(HTTPMethod, method)
+}
+
+// SetHTTPRoute records the matched route template, such as "/users/{id}".
+func SetHTTPRoute(s *monkit.Span, route string) {
+	s.Annotate(HTTPRoute, route)
+}
+
+// SetHTTPURL records the full HTTP request URL.
+func SetHTTPURL(s *monkit.Span, url string) {
+	s.Annotate(HTTPURL, url)
+}
+
+// SetHTTPStatusCode records the HTTP response status code.
+func SetHTTPStatusCode(s *monkit.Span, code int) {
+	s.Annotate(HTTPStatusCode, strconv.Itoa(code))
+}
+
+// SetNetPeer records the host and port of the remote side of a Span.
+func SetNetPeer(s *monkit.Span, name string, port int) {
+	s.Annotate(NetPeerName, name)
+	s.Annotate(NetPeerPort, strconv.Itoa(port))
+}
+
+// SetRPC records the RPC system, such as "grpc", and the service and
+// method a Span calls or serves.
+func SetRPC(s *monkit.Span, system, service, method string) {
+	s.Annotate(RPCSystem, system)
+	s.Annotate(RPCService, service)
+	s.Annotate(RPCMethod, method)
+}
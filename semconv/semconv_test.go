@@ -0,0 +1,67 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package semconv
+
+import (
+	"context"
+	"testing"
+
+	"gopkg.in/spacemonkeygo/monkit.v2"
+)
+
+func TestSetters(t *testing.T) {
+	f := monkit.NewRegistry().ScopeNamed("semconv").FuncNamed("work")
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	s := monkit.SpanFromCtx(ctx)
+
+	SetDBSystem(s, "postgresql")
+	SetDBName(s, "users")
+	SetDBOperation(s, "UPDATE")
+	SetDBStatement(s, "UPDATE users SET name = $1")
+	SetDBRows(s, 3)
+	SetHTTPMethod(s, "GET")
+	SetHTTPRoute(s, "/users/{id}")
+	SetHTTPURL(s, "http://example.com/users/1")
+	SetHTTPStatusCode(s, 200)
+	SetNetPeer(s, "db.local", 5432)
+	SetRPC(s, "grpc", "Users", "Get")
+	done(nil)
+
+	annotations := map[string]string{}
+	for _, annotation := range s.Annotations() {
+		annotations[annotation.Name] = annotation.Value
+	}
+	for key, val := range map[string]string{
+		"db.system":        "postgresql",
+		"db.name":          "users",
+		"db.operation":     "UPDATE",
+		"db.statement":     "UPDATE users SET name = $1",
+		"db.rows_affected": "3",
+		"http.method":      "GET",
+		"http.route":       "/users/{id}",
+		"http.url":         "http://example.com/users/1",
+		"http.status_code": "200",
+		"net.peer.name":    "db.local",
+		"net.peer.port":    "5432",
+		"rpc.system":       "grpc",
+		"rpc.service":      "Users",
+		"rpc.method":       "Get",
+	} {
+		if annotations[key] != val {
+			t.Fatalf("expected %s=%q, got %q", key, val, annotations[key])
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build go1.21
+
+package monkit
+
+import (
+	"context"
+	"log/slog"
+)
+
+// SlogHandler wraps a slog.Handler so that every record logged with a context
+// carrying a Span (such as through Logger.InfoContext) includes "trace_id"
+// and "span_id" attributes, formatted as Hex64. Expected usage like:
+//
+//   handler := slog.NewTextHandler(os.Stderr, nil)
+//   logger := slog.New(monkit.SlogHandler(handler))
+//
+//   func MyFunc(ctx context.Context) (err error) {
+//     defer mon.Task()(&ctx)(&err)
+//     logger.InfoContext(ctx, "doing the thing")
+//     ...
+//   }
+func SlogHandler(h slog.Handler) slog.Handler {
+	return slogHandler{Handler: h}
+}
+
+// SlogEventHandler is like SlogHandler, but also records every record logged
+// with a context carrying a Span on the Span itself, so logs and traces
+// don't need separate instrumentation: the message is recorded as a Span
+// event (see Span.Event), and the record's attributes as Annotations named
+// after the attribute with a "log." prefix, plus any groups. Attributes
+// added with Logger.With are left out. Records logged without a Span are
+// only passed along.
+func SlogEventHandler(h slog.Handler) slog.Handler {
+	return slogHandler{Handler: h, events: true}
+}
+
+type slogHandler struct {
+	slog.Handler
+	events bool
+	groups string // dotted prefix from WithGroup
+}
+
+func (h slogHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if ctx != nil {
+		if s := SpanFromCtx(ctx); s != nil {
+			if h.events {
+				s.Event(rec.Message)
+				rec.Attrs(func(attr slog.Attr) bool {
+					s.Annotate("log."+h.groups+attr.Key, attr.Value.String())
+					return true
+				})
+			}
+			rec = rec.Clone()
+			rec.AddAttrs(
+				slog.String("trace_id", s.Trace().FormatId(Hex64)),
+				slog.String("span_id", FormatId(s.Id(), Hex64)))
+		}
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h slogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h.Handler = h.Handler.WithAttrs(attrs)
+	return h
+}
+
+func (h slogHandler) WithGroup(name string) slog.Handler {
+	h.Handler = h.Handler.WithGroup(name)
+	if name != "" {
+		h.groups += name + "."
+	}
+	return h
+}
@@ -0,0 +1,54 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build go1.21
+
+package monkit
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlogEventHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(SlogEventHandler(slog.NewTextHandler(&buf, nil)))
+	f := NewRegistry().ScopeNamed("slog").FuncNamed("work")
+
+	ctx := context.Background()
+	logger.InfoContext(ctx, "no span")
+	defer f.Task(&ctx)(nil)
+	s := SpanFromCtx(ctx)
+	logger.InfoContext(ctx, "fetched", "rows", 12)
+	logger.WithGroup("db").InfoContext(ctx, "queried", "table", "users")
+
+	events := s.Events()
+	if len(events) != 2 || events[0].Name != "fetched" ||
+		events[1].Name != "queried" {
+		t.Fatalf("unexpected events %v", events)
+	}
+	annotations := s.Annotations()
+	if len(annotations) != 2 ||
+		annotations[0] != (Annotation{Name: "log.rows", Value: "12"}) ||
+		annotations[1] != (Annotation{Name: "log.db.table", Value: "users"}) {
+		t.Fatalf("unexpected annotations %v", annotations)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[1], "span_id=") {
+		t.Fatalf("records should still be logged: %q", buf.String())
+	}
+}
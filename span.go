@@ -15,17 +15,20 @@
 package monkit
 
 import (
+	"encoding/json"
 	"fmt"
 	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/spacemonkeygo/monotime"
 )
 
 type ctxKey int
 
 const (
 	spanKey ctxKey = iota
+	baggageKey
 )
 
 // Annotation represents an arbitrary name and value string pair
@@ -34,44 +37,610 @@ type Annotation struct {
 	Value string
 }
 
+// SortAnnotations sorts annotations by name in place, keeping annotations
+// with the same name in the order they were added. Serializers use it so
+// that identical Spans encode to identical bytes.
+func SortAnnotations(annotations []Annotation) {
+	sort.Stable(annotationSorter(annotations))
+}
+
+type annotationSorter []Annotation
+
+func (s annotationSorter) Len() int           { return len(s) }
+func (s annotationSorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s annotationSorter) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+// SpanEvent represents something that happened at a specific point in time
+// during a Span. See Span.Event.
+type SpanEvent struct {
+	Name string
+	Time time.Time
+}
+
+// spanExt holds the state of a Span that most Spans never need, such as
+// events, links, and Defer holds, so that a Span only pays for it once it's
+// used. It's protected by the Span's mtx.
+type spanExt struct {
+	kind            SpanKind
+	maxChildren     int
+	evictedChildren int64
+	droppedAnnots   int64
+	lazyAnnotations []*lazyAnnotation
+	events          []SpanEvent
+	links           []SpanLink
+	baggage         map[string]string
+	attributes      map[string]interface{}
+	tags            map[string]string
+	restarted       time.Time
+	attempts        int
+	cancel          func()
+	status          int
+	hasStatus       bool
+	statusCode      StatusCode
+	statusMessage   string
+	name            string
+	adoptedBy       *Span
+	holds           int      // see Defer
+	held            *heldEnd // set if ended while holds > 0
+	holding         *Span    // a Span this resumed Span holds open
+	argNames        []string // see Func.TaskNamed
+	correlationKeys []string // see Registry.LinkByKey
+	paused          time.Duration
+	pausedAt        time.Time // zero unless paused
+	creationStack   []uintptr // see Func.TaskWithCaller
+	periodicExport  *periodicExport
+	lastActivity    time.Time // zero until annotated, see LastActivity
+	budgetStart     time.Time // set if the context has a deadline
+}
+
+// noExt stands in for the spanExt of Spans that don't have one yet. It must
+// never be modified.
+var noExt spanExt
+
+// getExt returns the Span's spanExt for reading, which is noExt if the Span
+// doesn't have one. mtx must be held.
+func (s *Span) getExt() *spanExt {
+	if s.ext == nil {
+		return &noExt
+	}
+	return s.ext
+}
+
+// setExt returns the Span's spanExt for writing, allocating it if needed.
+// mtx must be held.
+func (s *Span) setExt() *spanExt {
+	if s.ext == nil {
+		s.ext = &spanExt{}
+	}
+	return s.ext
+}
+
+// Lock ordering: a Span's mtx is never held while acquiring another Span's
+// mtx. Whenever both a parent and a child need updating (addChild, orphan,
+// and end), the parent's lock is taken and released first, and only then is
+// the child's lock taken. Children and end follow the same rule by
+// snapshotting under the lock and calling out without it. The only lock ever
+// acquired while holding a Span's mtx is the Registry's orphanMtx, which is
+// always a leaf.
 func (s *Span) addChild(child *Span) {
+	var evicted *Span
 	s.mtx.Lock()
+	if s.children == nil {
+		s.children = s.f.scope.r.newSpanBag()
+	}
 	s.children.Add(child)
 	done := s.done
+	if max := s.getExt().maxChildren; max > 0 && s.children.Len() > max {
+		evicted = s.children.Oldest()
+		s.children.Remove(evicted)
+		s.ext.evictedChildren += 1
+	}
 	s.mtx.Unlock()
 	if done {
 		child.orphan()
 	}
+	if evicted != nil {
+		evicted.orphan()
+	}
+}
+
+// AdoptChild attaches child, which must have been started as a root Span,
+// as a child of this Span, for building synthetic trees in tests or
+// stitching in Spans sourced from elsewhere. From then on child is reported
+// by Children, and it's orphaned like any other child if this Span finishes
+// first. child keeps its own Trace, and its Parent is still nil. It's an
+// error to adopt a Span that already has a parent or was already adopted, or
+// one of this Span's own ancestors.
+func (s *Span) AdoptChild(child *Span) error {
+	if child == s || child.parent != nil {
+		return fmt.Errorf("monkit: span %d already has a parent", child.id)
+	}
+	if s.noop || child.noop {
+		return nil
+	}
+	for ancestor := s.adopter(); ancestor != nil; ancestor = ancestor.adopter() {
+		if ancestor == child {
+			return fmt.Errorf("monkit: span %d is an ancestor of span %d",
+				child.id, s.id)
+		}
+	}
+	child.mtx.Lock()
+	if child.getExt().adoptedBy != nil {
+		child.mtx.Unlock()
+		return fmt.Errorf("monkit: span %d was already adopted", child.id)
+	}
+	child.setExt().adoptedBy = s
+	child.mtx.Unlock()
+	s.addChild(child)
+	return nil
+}
+
+// adopter returns the Span's parent, or the Span that adopted it.
+func (s *Span) adopter() *Span {
+	if s.parent != nil {
+		return s.parent
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.getExt().adoptedBy
+}
+
+// SetMaxChildren caps how many running child Spans this Span keeps track of,
+// which bounds memory for long-lived Spans (such as a streaming connection)
+// that start children faster than they finish. When a new child would exceed
+// the cap, the oldest running child is orphaned: it still completes and is
+// still counted normally, but it's detached from this Span and shows up in
+// Registry.RootSpans instead. A max of zero or less means no cap, which is
+// the default. See EvictedChildren.
+func (s *Span) SetMaxChildren(max int) {
+	s.mtx.Lock()
+	s.setExt().maxChildren = max
+	s.mtx.Unlock()
+}
+
+// EvictedChildren returns how many children have been orphaned because of
+// SetMaxChildren.
+func (s *Span) EvictedChildren() (rv int64) {
+	s.mtx.Lock()
+	rv = s.getExt().evictedChildren
+	s.mtx.Unlock()
+	return rv
 }
 
 func (s *Span) removeChild(child *Span) {
 	s.mtx.Lock()
-	s.children.Remove(child)
+	if s.children != nil {
+		s.children.Remove(child)
+	}
 	s.mtx.Unlock()
 }
 
+func (s *Span) isDone() (rv bool) {
+	s.mtx.Lock()
+	rv = s.done
+	s.mtx.Unlock()
+	return rv
+}
+
+func finishedParentAnnotation(parent *Span) Annotation {
+	return Annotation{
+		Name:  "parent-already-finished",
+		Value: strconv.FormatInt(parent.id, 10)}
+}
+
 func (s *Span) orphan() {
+	// must not be called with the parent's lock held. see addChild.
 	s.mtx.Lock()
-	if !s.done && !s.orphaned {
+	orphaned := !s.done && !s.orphaned
+	if orphaned {
 		s.orphaned = true
-		s.f.scope.r.orphanedSpan(s)
+		if s.parent != nil {
+			// adopted Spans are already tracked as roots. see AdoptChild.
+			s.f.scope.r.orphanedSpan(s)
+		}
 	}
 	s.mtx.Unlock()
+	if orphaned {
+		s.f.scope.r.notifyOrphan(s)
+	}
+}
+
+// PanicError is the error reported by TaskRecover when a task panics.
+type PanicError struct {
+	// Value is the value that was recovered from the panic.
+	Value interface{}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// taskExit returns the function handed back from Tasks, to be deferred until
+// the task ends. recover() only works when called directly by the deferred
+// function, so the teardown that doesn't need to recover is split into end.
+func (s *Span) taskExit() func(*error) {
+	return func(errptr *error) {
+		rec := recover()
+		panicked := rec != nil
+
+		var err error
+		if errptr != nil {
+			err = *errptr
+		}
+		s.end(err, panicked)
+
+		if panicked {
+			panic(s.f.scope.r.wrapPanic(s, rec))
+		}
+	}
+}
+
+// recoverExit is like taskExit, but reports panics as a *PanicError through
+// errptr instead of re-panicking. See TaskRecover.
+func (s *Span) recoverExit() func(*error) {
+	return func(errptr *error) {
+		rec := recover()
+		if rec == nil {
+			var err error
+			if errptr != nil {
+				err = *errptr
+			}
+			s.end(err, false)
+			return
+		}
+
+		err := &PanicError{Value: rec}
+		s.end(err, true)
+		if errptr != nil {
+			*errptr = err
+		}
+	}
+}
+
+// Finish ends the Span with the given error, exactly like calling the
+// function returned by the Task that created it. This is handy when there's
+// no error pointer around, or when the Span is finished somewhere other than
+// where it started. Only the first of Finish or the Task's returned function
+// has any effect, so it's safe to call both:
+//
+//   defer mon.Task()(&ctx)(nil)
+//   ...
+//   monkit.SpanFromCtx(ctx).Finish(err) // the deferred call does nothing
+func (s *Span) Finish(err error) {
+	s.end(err, false)
+}
+
+// FinishNow ends the Span successfully, like Finish(nil), for Spans that
+// can't fail and so have no error to hand over:
+//
+//   defer monkit.SpanFromCtx(ctx).FinishNow()
+func (s *Span) FinishNow() {
+	s.end(nil, false)
+}
+
+// FinishWithResult is like Finish, but also records a summary of the
+// result, such as a row count or how many bytes were read, in a "result"
+// annotation. Like Finish, only the first way the Span is finished has any
+// effect, and the annotation is only added if this call finishes the Span.
+func (s *Span) FinishWithResult(err error, summary string) {
+	s.endAt(err, false, time.Time{}, &summary)
+}
+
+// FinishAt is like Finish, but with an explicit finish time. It's meant to
+// go with Func.TaskAt when backfilling historical Spans.
+func (s *Span) FinishAt(err error, finish time.Time) {
+	s.endAt(err, false, finish, nil)
+}
+
+func (s *Span) end(err error, panicked bool) {
+	s.endAt(err, panicked, time.Time{}, nil)
+}
+
+// endAt ends the Span. A zero finish means now. A non-nil result is added as
+// a "result" annotation, under the same lock that settles which end counts,
+// so it's only added if this end counts. See FinishWithResult.
+func (s *Span) endAt(err error, panicked bool, finish time.Time,
+	result *string) {
+	if s.noop {
+		return
+	}
+
+	budgetFinish := finish
+	if finish.IsZero() {
+		finish = s.f.scope.r.now()
+		budgetFinish = time.Now()
+	}
+	s.finishAt(err, panicked, finish, budgetFinish, result)
+}
+
+// finishAt is endAt once the finish times are known. budgetFinish is finish
+// on the real clock, for the budget annotation. see annotateBudget.
+func (s *Span) finishAt(err error, panicked bool,
+	finish, budgetFinish time.Time, result *string) {
+	// snapshot the children under our lock, then orphan them after releasing
+	// it. see the lock ordering notes on addChild.
+	var children []*Span
+	s.mtx.Lock()
+	if s.done {
+		// only the first end counts. see Finish.
+		s.mtx.Unlock()
+		return
+	}
+	ext := s.getExt()
+	if ext.holds > 0 {
+		// see Defer. releaseHold ends the Span for real.
+		if ext.held == nil {
+			ext.held = &heldEnd{err: err, panicked: panicked, finish: finish,
+				budgetFinish: budgetFinish, result: result}
+		}
+		s.mtx.Unlock()
+		return
+	}
+	s.done = true
+	s.elapsed = finish.Sub(s.start)
+	if result != nil {
+		s.annotations = append(s.annotations,
+			Annotation{Name: "result", Value: *result})
+	}
+	start := s.latestStart()
+	f := s.Func() // see SetFunc
+	orphaned := s.orphaned
+	adoptedBy := ext.adoptedBy
+	holding := ext.holding
+	correlationKeys := ext.correlationKeys
+	cancel := ext.cancel
+	periodicExport := ext.periodicExport
+	budgetStart := ext.budgetStart
+	statsErr := err
+	if ext.statusCode == StatusCodeUnset && (err != nil || panicked) {
+		// see SetStatus
+		ext = s.setExt()
+		ext.statusCode, ext.statusMessage = StatusCodeError, "panic"
+		if err != nil {
+			ext.statusMessage = err.Error()
+		}
+	}
+	if ext.hasStatus {
+		if class := StatusClass(ext.status); class != StatusSuccess {
+			statsErr = &StatusError{Code: ext.status, Class: class, Err: err}
+		}
+	}
+	if s.children != nil {
+		s.children.Iterate(func(child *Span) {
+			children = append(children, child)
+		})
+	}
+	s.mtx.Unlock()
+
+	if result != nil && s.f.scope.r.flushesOn("result") {
+		// see SetFlushOnAnnotation
+		s.trace.requestFlush()
+	}
+
+	// read before cancel, which would otherwise show up as context.Canceled.
+	ctxErr := s.Context.Err()
+	if cancel != nil {
+		// see TaskWithDeadline
+		if s.deadlineExceeded() {
+			s.Annotate("deadline", "exceeded")
+		}
+		cancel()
+	}
+
+	if err == nil && !panicked && ctxErr != nil &&
+		s.f.scope.r.classifiesContextErrors() {
+		// see SetClassifyContextErrors
+		s.Annotate("ctx.err", ctxErr.Error())
+		atomic.AddInt64(&f.contextErrors, 1)
+	}
+
+	if deadline, ok := s.Context.Deadline(); ok {
+		s.annotateBudget(deadline, budgetStart, budgetFinish)
+	}
+
+	if statsErr != nil || panicked {
+		// set before any observer hears about the Span finishing.
+		s.trace.setHadError()
+	}
+
+	f.end(statsErr, panicked, finish.Sub(start))
+	if s.trace.Sampled() {
+		f.observeExemplar(finish.Sub(start), s.trace.id, finish)
+	}
+	for _, child := range children {
+		child.orphan()
+	}
+
+	if s.parent != nil {
+		s.parent.removeChild(s)
+		if orphaned {
+			s.f.scope.r.orphanEnd(s)
+		}
+	} else {
+		s.f.scope.r.rootSpanEnd(s)
+		if adoptedBy != nil {
+			adoptedBy.removeChild(s)
+		}
+	}
+
+	if periodicExport != nil {
+		periodicExport.stopPeriodicExport()
+	}
+
+	// s.observer was captured when the Span started, so only observers that
+	// saw Start get Finish.
+	if s.observer != nil {
+		observeFinish(s.observer, s, err, panicked, finish)
+	}
+
+	if len(correlationKeys) > 0 {
+		s.f.scope.r.finishCorrelated(s, correlationKeys,
+			NewSpanData(s, err, panicked, finish))
+	}
+
+	if holding != nil {
+		holding.releaseHold()
+	}
+
+	s.trace.spanFinished()
+}
+
+// RemainingBudget returns how much time is left until the deadline of the
+// Span's context, and whether it has one at all, so code can adapt, such as
+// by skipping optional work when time is short. It's zero once the deadline
+// has passed.
+func (s *Span) RemainingBudget() (remaining time.Duration, ok bool) {
+	deadline, ok := s.Context.Deadline()
+	if !ok {
+		return 0, false
+	}
+	if remaining = deadline.Sub(time.Now()); remaining < 0 {
+		remaining = 0
+	}
+	return remaining, true
+}
+
+// annotateBudget records what percentage of the time its context's deadline
+// allowed the Span used up, as "budget.used.pct". Deadlines are real time,
+// so start and finish come from time.Now rather than the Registry's clocks
+// (see SetWallClock and SetTimeResolution), unless they were given
+// explicitly with TaskAt and FinishAt. A Restart restarts the budget too.
+func (s *Span) annotateBudget(deadline, start, finish time.Time) {
+	pct := 100.0
+	elapsed := finish.Sub(start)
+	if budget := deadline.Sub(start); budget > elapsed {
+		pct = float64(elapsed) / float64(budget) * 100
+	}
+	s.Annotate("budget.used.pct", strconv.FormatFloat(pct, 'f', 1, 64))
 }
 
 // Duration returns the current amount of time the Span has been running
+// (since the last Restart, if any).
 func (s *Span) Duration() time.Duration {
-	return monotime.Now().Sub(s.start)
+	return s.f.scope.r.now().Sub(s.AttemptStart())
 }
 
-// Start returns the time the Span started.
-func (s *Span) Start() time.Time {
+// Pause marks the start of a period the Span spends waiting on something
+// external, such as acquiring a semaphore, that shouldn't count as the
+// Span's own work. See Resume and ActiveDuration. Pausing a paused Span
+// does nothing.
+func (s *Span) Pause() {
+	now := s.f.scope.r.now()
+	s.mtx.Lock()
+	if ext := s.setExt(); ext.pausedAt.IsZero() {
+		ext.pausedAt = now
+	}
+	s.mtx.Unlock()
+}
+
+// Resume ends a period started with Pause. Resuming a Span that isn't
+// paused does nothing.
+func (s *Span) Resume() {
+	now := s.f.scope.r.now()
+	s.mtx.Lock()
+	if ext := s.getExt(); !ext.pausedAt.IsZero() {
+		ext.paused += now.Sub(ext.pausedAt)
+		ext.pausedAt = time.Time{}
+	}
+	s.mtx.Unlock()
+}
+
+// ActiveDuration is like Duration, but excludes the time the Span spent
+// paused (see Pause), so it tells the Span's own work apart from time spent
+// waiting. Duration still reports wall clock time.
+func (s *Span) ActiveDuration() time.Duration {
+	now := s.f.scope.r.now()
+	s.mtx.Lock()
+	ext := s.getExt()
+	paused := ext.paused
+	if !ext.pausedAt.IsZero() {
+		paused += now.Sub(ext.pausedAt)
+	}
+	start := s.latestStart()
+	s.mtx.Unlock()
+	return now.Sub(start) - paused
+}
+
+// Start returns the time the Span started. It never changes, not even when
+// the Span is restarted (see AttemptStart), so it doesn't take any locks.
+func (s *Span) Start() time.Time { return s.start }
+
+// AttemptStart returns the time the Span was last restarted (see Restart),
+// or Start if it never was. Unlike Start, it takes the Span's lock.
+func (s *Span) AttemptStart() (rv time.Time) {
+	s.mtx.Lock()
+	rv = s.latestStart()
+	s.mtx.Unlock()
+	return rv
+}
+
+// WallStart returns when the Span started according to the Registry's wall
+// clock (see Registry.SetWallClock). Like Start, it ignores Restart. Spans
+// started with Func.TaskAt use their explicit start time.
+func (s *Span) WallStart() time.Time { return s.wall }
+
+// latestStart expects mtx to be held.
+func (s *Span) latestStart() time.Time {
+	if restarted := s.getExt().restarted; !restarted.IsZero() {
+		return restarted
+	}
 	return s.start
 }
 
+// Restart resets the Span's start time to now, for retry loops that only want
+// to measure the final attempt. Timing for earlier attempts is lost, though
+// the number of attempts so far is kept in an "attempts" annotation (which
+// is 2 after the first Restart). A Span's position among its siblings still
+// uses the original start time.
+//
+//   for {
+//     err = attempt(ctx)
+//     if err == nil || !retriable(err) {
+//       return err
+//     }
+//     monkit.SpanFromCtx(ctx).Restart()
+//   }
+func (s *Span) Restart() {
+	now := s.f.scope.r.now()
+	s.mtx.Lock()
+	ext := s.setExt()
+	ext.restarted = now
+	ext.attempts += 1
+	if !ext.budgetStart.IsZero() {
+		ext.budgetStart = time.Now()
+	}
+	// replace any earlier attempts annotation
+	annotations := make([]Annotation, 0, len(s.annotations)+1)
+	for _, annotation := range s.annotations {
+		if annotation.Name != "attempts" {
+			annotations = append(annotations, annotation)
+		}
+	}
+	s.annotations = append(annotations, Annotation{
+		Name: "attempts", Value: strconv.Itoa(ext.attempts + 1)})
+	s.mtx.Unlock()
+}
+
+// finished returns when the Span finished. mtx must be held, and it's only
+// meaningful once done is set.
+func (s *Span) finished() time.Time {
+	return s.start.Add(s.elapsed)
+}
+
+// SchedulingDelay returns how long after its parent started this Span
+// started, which shows time lost between a parent reaching a fan-out point
+// and its children actually running, such as from an overloaded worker pool.
+// It's zero for Spans without a parent.
+func (s *Span) SchedulingDelay() time.Duration {
+	if s.parent == nil {
+		return 0
+	}
+	return s.start.Sub(s.parent.start)
+}
+
 // Value implements context.Context
 func (s *Span) Value(key interface{}) interface{} {
-	if key == spanKey {
+	if key == spanKey && !s.noop {
 		return s
 	}
 	return s.Context.Value(key)
@@ -88,12 +657,14 @@ func (s *Span) Children(cb func(s *Span)) {
 	found := map[*Span]bool{}
 	var sorter []*Span
 	s.mtx.Lock()
-	s.children.Iterate(func(s *Span) {
-		if !found[s] {
-			found[s] = true
-			sorter = append(sorter, s)
-		}
-	})
+	if s.children != nil {
+		s.children.Iterate(func(s *Span) {
+			if !found[s] {
+				found[s] = true
+				sorter = append(sorter, s)
+			}
+		})
+	}
 	s.mtx.Unlock()
 	sort.Sort(spanSorter(sorter))
 	for _, s := range sorter {
@@ -101,21 +672,188 @@ func (s *Span) Children(cb func(s *Span)) {
 	}
 }
 
+// ChildCount returns the number of known running child Spans, without the
+// allocation and sorting Children does.
+func (s *Span) ChildCount() (rv int) {
+	s.mtx.Lock()
+	if s.children != nil {
+		rv = s.children.Len()
+	}
+	s.mtx.Unlock()
+	return rv
+}
+
+// limitArgs applies the Registry's SetMaxArgs to a new Span. The kept
+// arguments are copied so the dropped ones can be garbage collected.
+func (s *Span) limitArgs() {
+	max := s.f.scope.r.MaxArgs()
+	if max <= 0 || len(s.args) <= max {
+		return
+	}
+	dropped := len(s.args) - max
+	s.args = append([]interface{}(nil), s.args[:max]...)
+	s.Annotate("args.truncated", strconv.Itoa(dropped))
+}
+
 // Args returns the list of strings associated with the args given to the
-// Task that created this Span.
+// Task that created this Span. Args longer than the Registry's
+// ArgSizeLimit are truncated.
 func (s *Span) Args() (rv []string) {
+	limit := s.f.scope.r.ArgSizeLimit()
 	rv = make([]string, 0, len(s.args))
 	for _, arg := range s.args {
-		rv = append(rv, fmt.Sprintf("%#v", arg))
+		rv = append(rv, truncateArg(fmt.Sprintf("%#v", arg), limit))
 	}
 	return rv
 }
 
+// CreationStack returns the call stack captured when the Span was started
+// with Func.TaskWithCaller, innermost frame first, or nil. See
+// FramesString.
+func (s *Span) CreationStack() []uintptr {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]uintptr(nil), s.getExt().creationStack...)
+}
+
+// NamedArgs returns the Span's Args keyed by the parameter names given to
+// Func.TaskNamed. Args without a name, such as when the Span wasn't started
+// with TaskNamed, are keyed by position, as "arg0", "arg1", and so on.
+func (s *Span) NamedArgs() map[string]string {
+	s.mtx.Lock()
+	names := s.getExt().argNames
+	s.mtx.Unlock()
+	args := s.Args()
+	rv := make(map[string]string, len(args))
+	for i, arg := range args {
+		if i < len(names) {
+			rv[names[i]] = arg
+		} else {
+			rv["arg"+strconv.Itoa(i)] = arg
+		}
+	}
+	return rv
+}
+
+func truncateArg(arg string, limit int) string {
+	if limit <= 0 || len(arg) <= limit {
+		return arg
+	}
+	return fmt.Sprintf("%s<%d bytes elided>", arg[:limit], len(arg)-limit)
+}
+
+// RawArgs returns a copy of the args given to the Task that created this
+// Span, with their original types, so that observers can inspect them without
+// parsing the strings Args returns. The values themselves are not copied; they
+// are retained for the lifetime of the Span, so large args stay in memory for
+// that long.
+func (s *Span) RawArgs() []interface{} {
+	return append([]interface{}(nil), s.args...)
+}
+
+// SpanSummary holds the fields of a Span that never change after it starts.
+// See Span.Summary.
+type SpanSummary struct {
+	Id       int64
+	ParentId int64 // zero for root Spans
+	Trace    *Trace
+	Func     *Func
+	// Start is when the Span originally started, even if it was restarted
+	// since (see Span.Restart).
+	Start time.Time
+}
+
+// Summary returns the Span's immutable fields without taking any locks, so
+// it's safe and cheap to call from hot SpanObservers even while the Span is
+// being annotated or finished concurrently. Id, Func, Trace, Parent, and
+// Args are lock-free as well.
+func (s *Span) Summary() SpanSummary {
+	summary := SpanSummary{
+		Id:    s.id,
+		Trace: s.trace,
+		Func:  s.Func(),
+		Start: s.start,
+	}
+	if s.parent != nil {
+		summary.ParentId = s.parent.id
+	}
+	return summary
+}
+
+// SpanKey identifies a Span by value. Unlike a *Span, it's meaningful across
+// process and async boundaries and after the Span is gone, so exporters can
+// use it as a map key to match up a Span's Start and Finish, or to dedupe
+// Spans. See Span.Key.
+type SpanKey struct {
+	TraceId int64
+	SpanId  int64
+}
+
+// Key returns the Span's SpanKey. Like Summary, it doesn't take any locks.
+func (s *Span) Key() SpanKey {
+	return SpanKey{TraceId: s.trace.id, SpanId: s.id}
+}
+
+// SetName overrides the name exporters use for the Span, which is otherwise
+// its Func's ShortName. It's meant for giving Spans lower cardinality names
+// than their Func can, such as an HTTP router's matched route template
+// ("/users/{id}") rather than the request path. Stats are still kept by
+// Func.
+func (s *Span) SetName(name string) {
+	s.mtx.Lock()
+	s.setExt().name = name
+	s.mtx.Unlock()
+}
+
+// Name returns the name set with SetName, or the Func's ShortName.
+func (s *Span) Name() (name string) {
+	s.mtx.Lock()
+	name = s.getExt().name
+	s.mtx.Unlock()
+	if name == "" {
+		name = s.Func().ShortName()
+	}
+	return name
+}
+
 // Id returns the Span id.
 func (s *Span) Id() int64 { return s.id }
 
-// Func returns the Func that kicked off this Span.
-func (s *Span) Func() *Func { return s.f }
+// Func returns the Func that kicked off this Span, or the one set with
+// SetFunc.
+func (s *Span) Func() *Func {
+	if f := loadFunc(&s.moved); f != nil {
+		return f
+	}
+	return s.f
+}
+
+// SetFunc moves a running Span to f, for dispatchers that only work out
+// which operation they're running after the Span started, such as a generic
+// handler resolving to a specific command. The Span stops counting as
+// running in its old Func's stats (see FuncStats.Current) and starts
+// counting in f's, which also gets the Span's outcome when it finishes.
+// SpanObservers that saw the Span start with its old Func see it finish
+// with f. It returns false, leaving the Span alone, if the Span has
+// already finished or f belongs to a different Registry.
+func (s *Span) SetFunc(f *Func) (ok bool) {
+	var caller *Func
+	if s.parent != nil {
+		caller = s.parent.Func()
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.done || s.getExt().held != nil || f.scope.r != s.f.scope.r {
+		return false
+	}
+	// adjust the counts under mtx so endAt can't end the Span in between.
+	if old := s.Func(); old != f {
+		storeFunc(&s.moved, f)
+		atomic.AddInt64(&old.current, -1)
+		f.start(caller)
+	}
+	return true
+}
 
 // Trace returns the Trace this Span is associated with.
 func (s *Span) Trace() *Trace { return s.trace }
@@ -123,20 +861,309 @@ func (s *Span) Trace() *Trace { return s.trace }
 // Parent returns the Parent Span.
 func (s *Span) Parent() *Span { return s.parent }
 
+// HasParent returns true if the Span has a Parent Span.
+func (s *Span) HasParent() bool { return s.parent != nil }
+
+// ParentId returns the id of the Parent Span, or 0 if the Span is a root.
+func (s *Span) ParentId() int64 {
+	if s.parent == nil {
+		return 0
+	}
+	return s.parent.id
+}
+
+// SetKind sets the SpanKind of the Span. Spans start out as
+// SpanKindInternal.
+func (s *Span) SetKind(kind SpanKind) {
+	s.mtx.Lock()
+	s.setExt().kind = kind
+	s.mtx.Unlock()
+}
+
+// Kind returns the SpanKind of the Span. See SetKind.
+func (s *Span) Kind() (kind SpanKind) {
+	s.mtx.Lock()
+	kind = s.getExt().kind
+	s.mtx.Unlock()
+	return kind
+}
+
+// SetSamplingPriority sets the sampling priority of the Span's Trace. A
+// positive priority forces the Trace to be sampled. See
+// Trace.SetSamplingPriority.
+func (s *Span) SetSamplingPriority(priority int) {
+	s.trace.SetSamplingPriority(priority)
+}
+
 // Annotations returns any added annotations created through the Span Annotate
-// method
+// method, followed by any added through AnnotateLazy if the Span's Trace is
+// sampled.
 func (s *Span) Annotations() []Annotation {
 	s.mtx.Lock()
-	annotations := s.annotations // okay cause we only ever append to this slice
+	// annotations may be replaced in place by sampling, so copy them here
+	rv := append([]Annotation(nil), s.annotations...)
+	// okay cause we only ever append to lazyAnnotations
+	lazy := s.getExt().lazyAnnotations
+	s.mtx.Unlock()
+	return s.appendLazy(rv, lazy)
+}
+
+// appendLazy appends the given AnnotateLazy annotations to rv if the Span's
+// Trace is sampled. It calls their functions, so mtx must not be held.
+func (s *Span) appendLazy(rv []Annotation,
+	lazy []*lazyAnnotation) []Annotation {
+	if len(lazy) > 0 && s.trace.Sampled() {
+		for _, l := range lazy {
+			rv = append(rv, l.annotation())
+		}
+	}
+	return rv
+}
+
+type lazyAnnotation struct {
+	name string
+	fn   func() string
+	once sync.Once
+	val  string
+}
+
+func (l *lazyAnnotation) annotation() Annotation {
+	l.once.Do(func() {
+		l.val = l.fn()
+		l.fn = nil
+	})
+	return Annotation{Name: l.name, Value: l.val}
+}
+
+// AnnotateLazy adds an annotation whose value is expensive to compute, such
+// as a serialized request. fn is only called once something reads the
+// Span's Annotations, such as an exporter, and only if the Span's Trace is
+// sampled (see Trace.Sampled), so unsampled Traces don't pay for it. The
+// result is cached, so fn is called at most once. fn is called without any
+// of the Span's locks held, but it may run on any goroutine, even after the
+// Span has finished.
+func (s *Span) AnnotateLazy(name string, fn func() string) {
+	s.mtx.Lock()
+	ext := s.setExt()
+	ext.lazyAnnotations = append(ext.lazyAnnotations,
+		&lazyAnnotation{name: name, fn: fn})
 	s.mtx.Unlock()
-	return append([]Annotation(nil), annotations...)
 }
 
-// Annotate adds an annotation to the existing Span.
+// Annotate adds an annotation to the existing Span. If the Registry samples
+// annotations (see Registry.SetAnnotationSampling), the annotation may
+// replace an earlier one or be dropped. See also
+// Registry.SetFlushOnAnnotation.
 func (s *Span) Annotate(name, val string) {
+	if s.f.scope.r.flushesOn(name) {
+		// see SetFlushOnAnnotation
+		s.trace.requestFlush()
+	}
+	annotation := Annotation{Name: name, Value: val}
+	k := s.f.scope.r.AnnotationSampling()
+	now := s.f.scope.r.now()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	ext := s.setExt()
+	ext.lastActivity = now
+	if k <= 0 || len(s.annotations) < k || libraryAnnotations[name] {
+		s.annotations = append(s.annotations, annotation)
+		return
+	}
+	sampled := 0
+	for _, annotation := range s.annotations {
+		if !libraryAnnotations[annotation.Name] {
+			sampled++
+		}
+	}
+	if sampled < k {
+		s.annotations = append(s.annotations, annotation)
+		return
+	}
+	// reservoir sampling: either annotation or one we already have is dropped
+	seen := int64(sampled) + ext.droppedAnnots + 1
+	if j := s.trace.int63n(seen); j < int64(sampled) {
+		for i := range s.annotations {
+			if libraryAnnotations[s.annotations[i].Name] {
+				continue
+			}
+			if j == 0 {
+				s.annotations[i] = annotation
+				break
+			}
+			j--
+		}
+	}
+	ext.droppedAnnots++
+}
+
+// libraryAnnotations are the names of the annotations monkit itself adds,
+// which annotation sampling always keeps.
+var libraryAnnotations = map[string]bool{
+	"args.truncated":          true,
+	"attempts":                true,
+	"budget.used.pct":         true,
+	"ctx.err":                 true,
+	"deadline":                true,
+	"parent-already-finished": true,
+	"result":                  true,
+	"status":                  true,
+}
+
+// AnnotationCount returns how many annotations have been added to the Span,
+// including any that annotation sampling dropped (see DroppedAnnotations).
+func (s *Span) AnnotationCount() (rv int) {
+	s.mtx.Lock()
+	rv = len(s.annotations) + int(s.getExt().droppedAnnots)
+	s.mtx.Unlock()
+	return rv
+}
+
+// DroppedAnnotations returns how many annotations the Span didn't keep
+// because of annotation sampling. See Registry.SetAnnotationSampling.
+func (s *Span) DroppedAnnotations() int64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.getExt().droppedAnnots
+}
+
+// Observe records a one-off measurement, such as how many bytes or items the
+// Span processed, in a distribution kept per name on the Span's Func, so
+// measurements aggregate across all calls of the Func. See
+// Func.ObservedStats.
+func (s *Span) Observe(name string, value float64) {
+	s.Func().observe(name, value)
+}
+
+// AnnotateDuration records how long a sub-operation took, such as "db.time".
+// The duration is added as an annotation in human readable form, and set as
+// an attribute holding the number of nanoseconds so exporters don't have to
+// parse it back out.
+func (s *Span) AnnotateDuration(name string, d time.Duration) {
+	s.Annotate(name, d.String())
+	s.SetAttribute(name, int64(d))
+}
+
+// SetBaggageItem sets a baggage item on the Span's Trace, so it's visible to
+// every Span in the Trace and propagated along with it, and remembers that
+// this Span introduced it. It returns false if the Trace rejected the item.
+// See IntroducedBaggage and Trace.SetBaggageItem.
+func (s *Span) SetBaggageItem(key, val string) (ok bool) {
+	if !s.trace.SetBaggageItem(key, val) {
+		return false
+	}
+	s.mtx.Lock()
+	if ext := s.setExt(); ext.baggage == nil {
+		ext.baggage = map[string]string{key: val}
+	} else {
+		ext.baggage[key] = val
+	}
+	s.mtx.Unlock()
+	return true
+}
+
+// IntroducedBaggage returns the baggage items this Span set through
+// SetBaggageItem. It's meant for debugging where baggage came from; the
+// Trace's current baggage may have since been changed by other Spans.
+func (s *Span) IntroducedBaggage() map[string]string {
+	s.mtx.Lock()
+	baggage := s.getExt().baggage
+	rv := make(map[string]string, len(baggage))
+	for key, val := range baggage {
+		rv[key] = val
+	}
+	s.mtx.Unlock()
+	return rv
+}
+
+// SetAttribute attaches an arbitrary value to the Span under key. Unlike
+// Annotations, which are flat strings, attributes can hold structured data,
+// and exporters serialize them as nested JSON. Values should be safe to
+// encode with encoding/json and must not be modified afterwards.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	s.mtx.Lock()
+	if ext := s.setExt(); ext.attributes == nil {
+		ext.attributes = map[string]interface{}{key: value}
+	} else {
+		ext.attributes[key] = value
+	}
+	s.mtx.Unlock()
+}
+
+// Attributes returns a copy of the attributes set through SetAttribute.
+func (s *Span) Attributes() map[string]interface{} {
 	s.mtx.Lock()
-	s.annotations = append(s.annotations, Annotation{Name: name, Value: val})
+	attributes := s.getExt().attributes
+	rv := make(map[string]interface{}, len(attributes))
+	for key, val := range attributes {
+		rv[key] = val
+	}
 	s.mtx.Unlock()
+	return rv
+}
+
+// Event records that something named 'name' happened on the Span just now.
+func (s *Span) Event(name string) {
+	now := s.f.scope.r.now()
+	s.mtx.Lock()
+	ext := s.setExt()
+	ext.events = append(ext.events, SpanEvent{Name: name, Time: now})
+	ext.lastActivity = now
+	s.mtx.Unlock()
+}
+
+// LastActivity returns when the Span was last annotated (see Annotate) or
+// had an event (see Event), or when it started if neither has happened yet.
+// Monitors can flag running Spans without recent activity as possibly
+// stuck.
+func (s *Span) LastActivity() (rv time.Time) {
+	s.mtx.Lock()
+	rv = s.getExt().lastActivity
+	if rv.IsZero() {
+		rv = s.latestStart()
+	}
+	s.mtx.Unlock()
+	return rv
+}
+
+// Events returns the events recorded through the Span Event method, in the
+// order they happened.
+func (s *Span) Events() []SpanEvent {
+	s.mtx.Lock()
+	events := s.getExt().events // okay cause we only ever append to this slice
+	s.mtx.Unlock()
+	return append([]SpanEvent(nil), events...)
+}
+
+// StateDurations treats the Span's events as state transitions and returns
+// how long the Span spent in each state. A state lasts from its event until
+// the next event, and the last state lasts until the Span finishes (or until
+// now, if the Span is still running). Time before the first event isn't
+// counted. States that are entered more than once are summed. Since Event
+// timestamps events as they're added, events are always in order; use
+// Event at the moment a transition happens, not after the fact.
+//
+//   s := monkit.SpanFromCtx(ctx)
+//   s.Event("queued")
+//   ...
+//   s.Event("running")
+func (s *Span) StateDurations() map[string]time.Duration {
+	s.mtx.Lock()
+	events := s.getExt().events
+	done, finish := s.done, s.finished()
+	s.mtx.Unlock()
+	if !done {
+		finish = s.f.scope.r.now()
+	}
+	rv := make(map[string]time.Duration, len(events))
+	for i, event := range events {
+		end := finish
+		if i+1 < len(events) {
+			end = events[i+1].Time
+		}
+		rv[event.Name] += end.Sub(event.Time)
+	}
+	return rv
 }
 
 // Orphaned returns true if the Parent span ended before this Span did.
@@ -146,3 +1173,81 @@ func (s *Span) Orphaned() (rv bool) {
 	s.mtx.Unlock()
 	return rv
 }
+
+// MarshalJSON implements json.Marshaler. Running Spans report their duration
+// so far, and finished Spans report their final duration. The Span's state
+// is read all at once, so a concurrent Finish is either reflected in full or
+// not at all. Annotations are sorted with SortAnnotations. The Span's
+// context.Context is not included.
+func (s *Span) MarshalJSON() ([]byte, error) {
+	js := struct {
+		Id       int64  `json:"id"`
+		TraceId  int64  `json:"traceId"`
+		ParentId *int64 `json:"parentId,omitempty"`
+		Name     string `json:"name"`
+		Func     struct {
+			Package string `json:"package"`
+			Name    string `json:"name"`
+		} `json:"func"`
+		Kind        string                 `json:"kind"`
+		Start       int64                  `json:"start"`
+		DurationMs  float64                `json:"durationMs"`
+		Orphaned    bool                   `json:"orphaned"`
+		Done        bool                   `json:"done"`
+		Args        []string               `json:"args"`
+		Annotations [][]string             `json:"annotations"`
+		Attributes  map[string]interface{} `json:"attributes,omitempty"`
+		Tags        map[string]string      `json:"tags,omitempty"`
+	}{}
+	js.Id = s.id
+	js.TraceId = s.trace.Id()
+	if s.parent != nil {
+		parentId := s.parent.id
+		js.ParentId = &parentId
+	}
+	f := s.Func()
+	js.Func.Package = f.Scope().Name()
+	js.Func.Name = f.ShortName()
+	js.Args = s.Args()
+
+	s.mtx.Lock()
+	ext := s.getExt()
+	js.Name = ext.name
+	js.Kind = ext.kind.String()
+	start := s.latestStart()
+	js.Orphaned = s.orphaned
+	js.Done = s.done
+	finish := s.finished()
+	if len(ext.attributes) > 0 {
+		js.Attributes = make(map[string]interface{}, len(ext.attributes))
+		for key, val := range ext.attributes {
+			js.Attributes[key] = val
+		}
+	}
+	if len(ext.tags) > 0 {
+		js.Tags = make(map[string]string, len(ext.tags))
+		for key, val := range ext.tags {
+			js.Tags[key] = val
+		}
+	}
+	annotations := append([]Annotation(nil), s.annotations...)
+	lazy := ext.lazyAnnotations
+	s.mtx.Unlock()
+	annotations = s.appendLazy(annotations, lazy)
+	SortAnnotations(annotations)
+
+	if js.Name == "" {
+		js.Name = js.Func.Name
+	}
+	if !js.Done {
+		finish = s.f.scope.r.now()
+	}
+	js.Start = start.UnixNano()
+	js.DurationMs = float64(finish.Sub(start)) / float64(time.Millisecond)
+	js.Annotations = make([][]string, 0, len(annotations))
+	for _, annotation := range annotations {
+		js.Annotations = append(js.Annotations,
+			[]string{annotation.Name, annotation.Value})
+	}
+	return json.Marshal(js)
+}
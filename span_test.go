@@ -0,0 +1,2253 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSpanMarshalJSON(t *testing.T) {
+	f := NewRegistry().ScopeNamed("json").FuncNamed("work")
+	ctx := context.Background()
+	f.Task(&ctx, "arg")(nil)
+	s := SpanFromCtx(ctx)
+	s.Annotate("key", "val")
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out["id"].(float64) != float64(s.Id()) {
+		t.Fatalf("unexpected id: %v", out["id"])
+	}
+	if out["done"] != true {
+		t.Fatal("span should be done")
+	}
+	if _, ok := out["parentId"]; ok {
+		t.Fatal("root span should have no parent id")
+	}
+	if out["func"].(map[string]interface{})["name"] != "work" {
+		t.Fatalf("unexpected func: %v", out["func"])
+	}
+	if out["args"].([]interface{})[0] != `"arg"` {
+		t.Fatalf("unexpected args: %v", out["args"])
+	}
+	if len(out["annotations"].([]interface{})) != 1 {
+		t.Fatalf("unexpected annotations: %v", out["annotations"])
+	}
+	if out["name"] != "work" {
+		t.Fatalf("expected the Func's name, got %v", out["name"])
+	}
+
+	s.SetName("/users/{id}")
+	data, err = json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out["name"] != "/users/{id}" ||
+		out["name"] != NewSpanData(s, nil, false, s.finished()).Name {
+		t.Fatalf("expected the name set with SetName, got %v", out["name"])
+	}
+}
+
+func TestSpanConcurrentTree(t *testing.T) {
+	r := NewRegistry()
+	f := r.ScopeNamed("tree").FuncNamed("work")
+
+	var walk func(ctx context.Context, depth int)
+	walk = func(ctx context.Context, depth int) {
+		defer f.Task(&ctx, depth)(nil)
+		if depth == 0 {
+			return
+		}
+		done := make(chan struct{}, 3)
+		for i := 0; i < 3; i++ {
+			go func() {
+				// some children outlive their parents and get orphaned
+				walk(ctx, depth-1)
+				done <- struct{}{}
+			}()
+		}
+		<-done
+		SpanFromCtx(ctx).Children(func(*Span) {})
+	}
+
+	stop := make(chan struct{})
+	iterated := make(chan struct{})
+	go func() {
+		defer close(iterated)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				r.AllSpans(func(s *Span) { s.Children(func(*Span) {}) })
+			}
+		}
+	}()
+
+	finished := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		go func() {
+			walk(context.Background(), 5)
+			finished <- struct{}{}
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		<-finished
+	}
+	close(stop)
+	<-iterated
+}
+
+func BenchmarkTask(b *testing.B) {
+	f := NewRegistry().ScopeNamed("bench").FuncNamed("work")
+	parent := context.Background()
+	defer f.Task(&parent)(nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		ctx := parent
+		f.Task(&ctx, i, "arg")(nil)
+	}
+}
+
+func TestTaskVariantsDispatch(t *testing.T) {
+	f := NewRegistry().ScopeNamed("dispatch").FuncNamed("work")
+	if Task(f.Task).Func() != f || Task(f.TaskRecover).Func() != f {
+		t.Fatal("expected Task.Func to find the Func")
+	}
+	for name, task := range map[string]Task{
+		"TaskNamed": func(ctx *context.Context,
+			args ...interface{}) func(*error) {
+			return f.TaskNamed(ctx, nil, args...)
+		},
+		"TaskWithCaller": func(ctx *context.Context,
+			args ...interface{}) func(*error) {
+			return f.TaskWithCaller(ctx, 1, args...)
+		},
+		"TaskWithDeadline": func(ctx *context.Context,
+			args ...interface{}) func(*error) {
+			return f.TaskWithDeadline(ctx, time.Now(), args...)
+		},
+		"TaskAt": func(ctx *context.Context,
+			args ...interface{}) func(*error) {
+			return f.TaskAt(ctx, time.Now(), args...)
+		},
+	} {
+		if task.Func() != f {
+			t.Fatalf("%s: expected Task.Func to find the Func", name)
+		}
+	}
+	if f.Success() != 0 || f.Current() != 0 {
+		t.Fatal("expected no Spans to be started")
+	}
+}
+
+func TestSpanParentId(t *testing.T) {
+	f := NewRegistry().ScopeNamed("parent").FuncNamed("work")
+	ctx := context.Background()
+	defer f.Task(&ctx)(nil)
+	root := SpanFromCtx(ctx)
+	if root.HasParent() || root.ParentId() != 0 {
+		t.Fatal("root span should have no parent")
+	}
+
+	child := ctx
+	defer f.Task(&child)(nil)
+	if s := SpanFromCtx(child); !s.HasParent() || s.ParentId() != root.Id() {
+		t.Fatalf("expected parent id %d, got %d", root.Id(), s.ParentId())
+	}
+}
+
+func TestTaskRecover(t *testing.T) {
+	f := NewRegistry().ScopeNamed("recover").FuncNamed("work")
+	work := func() (err error) {
+		ctx := context.Background()
+		defer f.TaskRecover(&ctx)(&err)
+		panic("oh no")
+	}
+
+	err := work()
+	perr, ok := err.(*PanicError)
+	if !ok || perr.Value != "oh no" {
+		t.Fatalf("expected a PanicError, got %#v", err)
+	}
+	if f.Panics() != 1 {
+		t.Fatalf("expected 1 panic, got %d", f.Panics())
+	}
+}
+
+func TestIdsFromCtx(t *testing.T) {
+	if _, ok := TraceIdFromCtx(context.Background()); ok {
+		t.Fatal("plain context should have no trace id")
+	}
+	if _, ok := SpanIdFromCtx(context.Background()); ok {
+		t.Fatal("plain context should have no span id")
+	}
+
+	f := NewRegistry().ScopeNamed("ids").FuncNamed("work")
+	ctx := context.Background()
+	defer f.Task(&ctx)(nil)
+	s := SpanFromCtx(ctx)
+	if id, ok := TraceIdFromCtx(ctx); !ok || id != s.Trace().Id() {
+		t.Fatalf("unexpected trace id %d", id)
+	}
+	if id, ok := SpanIdFromCtx(ctx); !ok || id != s.Id() {
+		t.Fatalf("unexpected span id %d", id)
+	}
+}
+
+func TestSpanUnderlyingContext(t *testing.T) {
+	type key struct{}
+	f := NewRegistry().ScopeNamed("ctx").FuncNamed("work")
+	base := context.WithValue(context.Background(), key{}, "val")
+	ctx := base
+	defer f.Task(&ctx)(nil)
+
+	s := SpanFromCtx(ctx)
+	if s.UnderlyingContext() != base {
+		t.Fatal("expected the context the span was started with")
+	}
+	if s.UnderlyingContext() == context.Context(s) {
+		t.Fatal("underlying context should not be the span itself")
+	}
+}
+
+func TestSpanDefaultAnnotations(t *testing.T) {
+	r := NewRegistry()
+	r.SetDefaultAnnotations(func(s *Span) []Annotation {
+		return []Annotation{{Name: "host", Value: "test-host"}}
+	})
+	f := r.ScopeNamed("defaults").FuncNamed("work")
+
+	var spans []*Span
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		ctx := ctx
+		f.Task(&ctx)(nil)
+		spans = append(spans, SpanFromCtx(ctx))
+	}
+	child := ctx
+	done := f.Task(&child)
+	f.Task(&child)(nil)
+	spans = append(spans, SpanFromCtx(child))
+	done(nil)
+
+	for _, s := range spans {
+		annotations := s.Annotations()
+		if len(annotations) != 1 || annotations[0].Name != "host" ||
+			annotations[0].Value != "test-host" {
+			t.Fatalf("unexpected annotations: %v", annotations)
+		}
+	}
+
+	r.SetDefaultAnnotations(nil)
+	ctx = context.Background()
+	f.Task(&ctx)(nil)
+	if len(SpanFromCtx(ctx).Annotations()) != 0 {
+		t.Fatal("expected no annotations after removing the hook")
+	}
+}
+
+func TestSpanExtAllocatedLazily(t *testing.T) {
+	f := NewRegistry().ScopeNamed("ext").FuncNamed("work")
+	ctx := context.Background()
+	done := f.Task(&ctx, "arg")
+	child := ctx
+	f.Task(&child)(nil)
+	done(nil)
+	s := SpanFromCtx(ctx)
+	if s.ext != nil {
+		t.Fatal("expected a plain Span not to allocate its spanExt")
+	}
+
+	ctx = context.Background()
+	f.Task(&ctx)(nil)
+	s = SpanFromCtx(ctx)
+	s.Event("ping")
+	if s.ext == nil || len(s.Events()) != 1 {
+		t.Fatal("expected the event to be kept in the spanExt")
+	}
+}
+
+func TestSpanStateDurations(t *testing.T) {
+	f := NewRegistry().ScopeNamed("states").FuncNamed("work")
+	ctx := context.Background()
+	f.Task(&ctx)(nil)
+	s := SpanFromCtx(ctx)
+
+	// events are normally timestamped as they're added, so fake the timing
+	s.setExt().events = []SpanEvent{
+		{Name: "queued", Time: s.start},
+		{Name: "running", Time: s.start.Add(10 * time.Millisecond)},
+		{Name: "waiting", Time: s.start.Add(40 * time.Millisecond)},
+	}
+	s.elapsed = 100 * time.Millisecond
+
+	durations := s.StateDurations()
+	for state, expected := range map[string]time.Duration{
+		"queued":  10 * time.Millisecond,
+		"running": 30 * time.Millisecond,
+		"waiting": 60 * time.Millisecond,
+	} {
+		if durations[state] != expected {
+			t.Fatalf("expected %s to take %v, got %v", state, expected,
+				durations[state])
+		}
+	}
+}
+
+func TestSpanMaxChildren(t *testing.T) {
+	r := NewRegistry()
+	f := r.ScopeNamed("stream").FuncNamed("work")
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	root := SpanFromCtx(ctx)
+	root.SetMaxChildren(2)
+
+	var children []*Span
+	var dones []func(*error)
+	for i := 0; i < 4; i++ {
+		child := ctx
+		dones = append(dones, f.Task(&child))
+		children = append(children, SpanFromCtx(child))
+		time.Sleep(time.Millisecond) // keep start times distinct
+	}
+
+	if root.EvictedChildren() != 2 {
+		t.Fatalf("expected 2 evicted children, got %d", root.EvictedChildren())
+	}
+	for i, child := range children {
+		if child.Orphaned() != (i < 2) {
+			t.Fatalf("child %d: unexpected orphaned state %v", i, child.Orphaned())
+		}
+	}
+	var live int
+	root.Children(func(*Span) { live++ })
+	if live != 2 {
+		t.Fatalf("expected 2 live children, got %d", live)
+	}
+
+	// orphaned children still complete normally
+	for _, d := range dones {
+		d(nil)
+	}
+	done(nil)
+	if f.Success() != 5 {
+		t.Fatalf("expected 5 successes, got %d", f.Success())
+	}
+	var roots int
+	r.RootSpans(func(*Span) { roots++ })
+	if roots != 0 {
+		t.Fatalf("expected no running spans, got %d", roots)
+	}
+}
+
+func TestSpanRawArgs(t *testing.T) {
+	f := NewRegistry().ScopeNamed("args").FuncNamed("work")
+	ctx := context.Background()
+	f.Task(&ctx, int64(42), "name")(nil)
+
+	args := SpanFromCtx(ctx).RawArgs()
+	if len(args) != 2 {
+		t.Fatalf("unexpected args: %#v", args)
+	}
+	if id, ok := args[0].(int64); !ok || id != 42 {
+		t.Fatalf("expected int64 42, got %#v", args[0])
+	}
+	if name, ok := args[1].(string); !ok || name != "name" {
+		t.Fatalf("expected string name, got %#v", args[1])
+	}
+}
+
+func TestSpanKind(t *testing.T) {
+	f := NewRegistry().ScopeNamed("kinds").FuncNamed("work")
+	for _, kind := range []SpanKind{
+		SpanKindInternal, SpanKindClient, SpanKindServer, SpanKindProducer,
+		SpanKindConsumer} {
+		ctx := context.Background()
+		done := f.Task(&ctx)
+		s := SpanFromCtx(ctx)
+		if kind != SpanKindInternal {
+			if s.Kind() != SpanKindInternal {
+				t.Fatalf("expected new span to be internal, got %v", s.Kind())
+			}
+			s.SetKind(kind)
+		}
+		done(nil)
+
+		if data := NewSpanData(s, nil, false, s.finished()); data.Kind != kind {
+			t.Fatalf("expected %v, got %v", kind, data.Kind)
+		}
+		data, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out map[string]interface{}
+		if err := json.Unmarshal(data, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out["kind"] != kind.String() {
+			t.Fatalf("expected %v, got %v", kind, out["kind"])
+		}
+	}
+}
+
+func TestSpanFinish(t *testing.T) {
+	r := NewRegistry()
+	o := NewFuncCountObserver()
+	r.ObserveTraces(func(t *Trace) { t.ObserveSpans(o) })
+	scope := r.ScopeNamed("finish")
+	closure, method := scope.FuncNamed("closure"), scope.FuncNamed("method")
+
+	ctx := context.Background()
+	closure.Task(&ctx)(nil)
+
+	ctx = context.Background()
+	done := method.Task(&ctx)
+	s := SpanFromCtx(ctx)
+	s.Finish(nil)
+	s.Finish(fmt.Errorf("ignored"))
+	done(nil)
+
+	counts := o.Counts()
+	if counts["finish.closure"] != counts["finish.method"] {
+		t.Fatalf("expected identical observer effects, got %+v", counts)
+	}
+	if method.Success() != closure.Success() || method.Current() != 0 ||
+		len(method.Errors()) != 0 {
+		t.Fatalf("expected one success, got %d successes, %d current, %v",
+			method.Success(), method.Current(), method.Errors())
+	}
+	var roots int
+	r.RootSpans(func(*Span) { roots++ })
+	if roots != 0 {
+		t.Fatalf("expected no running spans, got %d", roots)
+	}
+}
+
+func TestSpanFinishNow(t *testing.T) {
+	r := NewRegistry()
+	o := &recordingObserver{}
+	r.ObserveTraces(func(t *Trace) { t.ObserveSpans(o) })
+	f := r.ScopeNamed("finish").FuncNamed("now")
+
+	ctx := context.Background()
+	f.Task(&ctx)
+	s := SpanFromCtx(ctx)
+	child := ctx
+	f.Task(&child)
+	s.FinishNow()
+	s.FinishNow()
+
+	if f.Success() != 1 || f.Current() != 1 {
+		t.Fatalf("expected one success, got %d successes, %d current",
+			f.Success(), f.Current())
+	}
+	if !SpanFromCtx(child).Orphaned() {
+		t.Fatal("expected the running child to be orphaned")
+	}
+	if len(o.finished) != 1 || o.finished[0] != s {
+		t.Fatal("expected observers to hear about the span finishing once")
+	}
+	SpanFromCtx(child).FinishNow()
+	var roots int
+	r.RootSpans(func(*Span) { roots++ })
+	if roots != 0 {
+		t.Fatalf("expected no running root spans, got %d", roots)
+	}
+}
+
+func TestSpanBaggage(t *testing.T) {
+	f := NewRegistry().ScopeNamed("baggage").FuncNamed("work")
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	root := SpanFromCtx(ctx)
+
+	child := ctx
+	childDone := f.Task(&child)
+	SpanFromCtx(child).SetBaggageItem("tenant", "acme")
+
+	grandchild := child
+	f.Task(&grandchild)(nil)
+	val := SpanFromCtx(grandchild).Trace().BaggageItem("tenant")
+	if val != "acme" {
+		t.Fatalf("expected baggage to propagate, got %q", val)
+	}
+	introduced := SpanFromCtx(child).IntroducedBaggage()
+	if introduced["tenant"] != "acme" {
+		t.Fatalf("expected child to be attributed, got %v", introduced)
+	}
+	if len(root.IntroducedBaggage()) != 0 ||
+		len(SpanFromCtx(grandchild).IntroducedBaggage()) != 0 {
+		t.Fatal("only the introducing span should be attributed")
+	}
+	childDone(nil)
+	done(nil)
+}
+
+func TestSpanRestart(t *testing.T) {
+	r := NewRegistry()
+	clock := newTestClock()
+	r.testClock = clock.Now
+	f := r.ScopeNamed("retry").FuncNamed("work")
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	s := SpanFromCtx(ctx)
+
+	clock.Advance(50 * time.Millisecond)
+	s.Restart()
+	if s.Duration() != 0 {
+		t.Fatalf("duration should start over after Restart, got %v",
+			s.Duration())
+	}
+	if s.AttemptStart().Sub(s.Start()) != 50*time.Millisecond {
+		t.Fatalf("expected only the attempt start to move, got %v and %v",
+			s.Start(), s.AttemptStart())
+	}
+	clock.Advance(20 * time.Millisecond)
+	s.Restart()
+	clock.Advance(10 * time.Millisecond)
+	done(nil)
+
+	if max := f.SuccessTimes().Query(1); max != 10*time.Millisecond {
+		t.Fatalf("func should only see the last attempt, got %v", max)
+	}
+	annotations := s.Annotations()
+	if len(annotations) != 1 || annotations[0] !=
+		(Annotation{Name: "attempts", Value: "3"}) {
+		t.Fatalf("unexpected annotations: %v", annotations)
+	}
+}
+
+func TestSpanBaggageBudget(t *testing.T) {
+	r := NewRegistry()
+	r.SetMaxBaggageBytes(16)
+	f := r.ScopeNamed("baggage").FuncNamed("work")
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	s := SpanFromCtx(ctx)
+
+	if !s.SetBaggageItem("user", "alice") { // 9 bytes
+		t.Fatal("item within budget should be accepted")
+	}
+	if s.SetBaggageItem("tenant", "acme") { // 19 bytes total
+		t.Fatal("item over budget should be rejected")
+	}
+	if !s.SetBaggageItem("user", "bob") { // replaces, 7 bytes
+		t.Fatal("replacing an item within budget should be accepted")
+	}
+	done(nil)
+
+	if baggage := s.Trace().Baggage(); len(baggage) != 1 ||
+		baggage["user"] != "bob" {
+		t.Fatalf("unexpected baggage: %v", baggage)
+	}
+	if _, ok := s.IntroducedBaggage()["tenant"]; ok {
+		t.Fatal("rejected items should not be attributed")
+	}
+	if r.RejectedBaggage() != 1 {
+		t.Fatalf("expected 1 rejection, got %d", r.RejectedBaggage())
+	}
+}
+
+func TestSpanBaggageContext(t *testing.T) {
+	f := NewRegistry().ScopeNamed("baggage").FuncNamed("work")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := f.Task(&ctx)
+	SpanFromCtx(ctx).SetBaggageItem("tenant", "acme")
+	detached := SpanFromCtx(ctx).BaggageContext()
+	done(nil)
+	cancel()
+
+	if SpanFromCtx(detached) != nil || detached.Err() != nil {
+		t.Fatal("expected a detached context")
+	}
+	if baggage := BaggageFromCtx(detached); baggage["tenant"] != "acme" {
+		t.Fatalf("expected baggage to survive the span, got %v", baggage)
+	}
+	if baggage := BaggageFromCtx(ctx); baggage["tenant"] != "acme" {
+		t.Fatalf("expected baggage from the span, got %v", baggage)
+	}
+	if baggage := BaggageFromCtx(context.Background()); len(baggage) != 0 {
+		t.Fatalf("expected no baggage, got %v", baggage)
+	}
+}
+
+func TestSpanFinishedParent(t *testing.T) {
+	for _, policy := range []FinishedParentPolicy{
+		AnnotateFinishedParent, DetachFinishedParent} {
+		r := NewRegistry()
+		r.SetFinishedParentPolicy(policy)
+		f := r.ScopeNamed("async").FuncNamed("work")
+		ctx := context.Background()
+		f.Task(&ctx)(nil)
+		parent := SpanFromCtx(ctx)
+
+		done := f.Task(&ctx)
+		child := SpanFromCtx(ctx)
+		annotations := child.Annotations()
+		if len(annotations) != 1 ||
+			annotations[0].Name != "parent-already-finished" {
+			t.Fatalf("unexpected annotations: %v", annotations)
+		}
+		if child.Trace() != parent.Trace() {
+			t.Fatal("child should stay in the parent's trace")
+		}
+		switch policy {
+		case AnnotateFinishedParent:
+			if child.Parent() != parent || !child.Orphaned() {
+				t.Fatal("expected an orphaned child of the finished span")
+			}
+		case DetachFinishedParent:
+			if child.Parent() != nil || child.Orphaned() {
+				t.Fatal("expected a new root span")
+			}
+		}
+		done(nil)
+	}
+}
+
+func TestTraceExportReady(t *testing.T) {
+	r := NewRegistry()
+	f := r.ScopeNamed("export").FuncNamed("work")
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	trace := SpanFromCtx(ctx).Trace()
+	ready := trace.ExportReady()
+
+	child := ctx
+	childDone := f.Task(&child)
+	done(nil)
+	select {
+	case <-ready:
+		t.Fatal("trace should not be ready with a span still running")
+	default:
+	}
+	if trace.ActiveSpans() != 1 {
+		t.Fatalf("expected 1 active span, got %d", trace.ActiveSpans())
+	}
+
+	childDone(nil)
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatal("trace should be ready after the last span finished")
+	}
+
+	// traces that never complete are released on shutdown
+	ctx = context.Background()
+	f.Task(&ctx)
+	ready = SpanFromCtx(ctx).Trace().ExportReady()
+	r.Shutdown()
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatal("shutdown should close pending export ready channels")
+	}
+}
+
+func TestSpanAttributes(t *testing.T) {
+	type request struct {
+		Method string `json:"method"`
+		Bytes  int    `json:"bytes"`
+	}
+	f := NewRegistry().ScopeNamed("attrs").FuncNamed("work")
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	s := SpanFromCtx(ctx)
+	s.SetAttribute("request", request{Method: "GET", Bytes: 12})
+	done(nil)
+
+	if _, ok := s.Attributes()["request"].(request); !ok {
+		t.Fatalf("unexpected attributes: %v", s.Attributes())
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Attributes struct {
+			Request request `json:"request"`
+		} `json:"attributes"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Attributes.Request != (request{Method: "GET", Bytes: 12}) {
+		t.Fatalf("unexpected json: %s", data)
+	}
+}
+
+func TestRegistryTimeResolution(t *testing.T) {
+	r := NewRegistry()
+	defer r.Shutdown()
+	resolution := 10 * time.Millisecond
+	r.SetTimeResolution(resolution)
+	f := r.ScopeNamed("clock").FuncNamed("work")
+
+	ctx := context.Background()
+	start := time.Now()
+	done := f.Task(&ctx)
+	time.Sleep(50 * time.Millisecond)
+	done(nil)
+	elapsed := time.Since(start)
+
+	measured := f.SuccessTimes().Query(1)
+	// both ends can be off by up to a tick, plus scheduling slop
+	diff := elapsed - measured
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > 2*resolution+10*time.Millisecond {
+		t.Fatalf("measured %v, but %v elapsed", measured, elapsed)
+	}
+
+	// Span accessors use the same clock, so they never go negative
+	ctx = context.Background()
+	defer f.Task(&ctx)(nil)
+	if d := SpanFromCtx(ctx).Duration(); d < 0 || d > resolution {
+		t.Fatalf("unexpected duration %v", d)
+	}
+
+	// changing the resolution doesn't pile up shutdown hooks
+	hooks := len(r.shutdownHooks)
+	r.SetTimeResolution(resolution)
+	r.SetTimeResolution(0)
+	r.SetTimeResolution(resolution)
+	if len(r.shutdownHooks) != hooks {
+		t.Fatalf("expected %d shutdown hooks, got %d", hooks,
+			len(r.shutdownHooks))
+	}
+}
+
+func benchmarkSpan(b *testing.B, resolution time.Duration) {
+	r := NewRegistry()
+	defer r.Shutdown()
+	r.SetTimeResolution(resolution)
+	f := r.ScopeNamed("clock").FuncNamed("work")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ctx := context.Background()
+		f.Task(&ctx)(nil)
+	}
+}
+
+func BenchmarkSpanPreciseClock(b *testing.B) { benchmarkSpan(b, 0) }
+
+func BenchmarkSpanCoarseClock(b *testing.B) {
+	benchmarkSpan(b, 5*time.Millisecond)
+}
+
+func TestSpanMergeRemote(t *testing.T) {
+	f := NewRegistry().ScopeNamed("client").FuncNamed("call")
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	s := SpanFromCtx(ctx)
+
+	start := time.Now()
+	s.MergeRemote(SpanData{
+		Id:          7,
+		Package:     "server",
+		Name:        "handle",
+		Start:       start,
+		Finish:      start.Add(25 * time.Millisecond),
+		Annotations: []Annotation{{Name: "rows", Value: "3"}},
+	})
+	done(nil)
+
+	found := map[string]string{}
+	for _, annotation := range s.Annotations() {
+		found[annotation.Name] = annotation.Value
+	}
+	for name, expected := range map[string]string{
+		"remote.func":     "server.handle",
+		"remote.id":       "7",
+		"remote.duration": "25ms",
+		"remote.rows":     "3",
+	} {
+		if found[name] != expected {
+			t.Fatalf("expected %s to be %q, got %v", name, expected, found)
+		}
+	}
+}
+
+func TestTaskWithDeadline(t *testing.T) {
+	f := NewRegistry().ScopeNamed("deadline").FuncNamed("work")
+	var s *Span
+	work := func(ctx context.Context) (err error) {
+		defer f.TaskWithDeadline(&ctx,
+			time.Now().Add(10*time.Millisecond))(&err)
+		s = SpanFromCtx(ctx)
+		if _, ok := ctx.Deadline(); !ok {
+			t.Fatal("expected the body to see a deadline")
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if err := work(context.Background()); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	annotations := s.Annotations()
+	if len(annotations) != 2 || annotations[0] !=
+		(Annotation{Name: "deadline", Value: "exceeded"}) ||
+		annotations[1] != (Annotation{
+			Name: "budget.used.pct", Value: "100.0"}) {
+		t.Fatalf("unexpected annotations: %v", annotations)
+	}
+
+	// finishing before the deadline cancels the derived context
+	ctx := context.Background()
+	f.TaskWithDeadline(&ctx, time.Now().Add(time.Hour))(nil)
+	if SpanFromCtx(ctx).UnderlyingContext().Err() != context.Canceled {
+		t.Fatal("expected the derived context to be canceled")
+	}
+	for _, annotation := range SpanFromCtx(ctx).Annotations() {
+		if annotation.Name == "deadline" {
+			t.Fatal("expected no deadline annotation")
+		}
+	}
+}
+
+func TestSpanChildCount(t *testing.T) {
+	f := NewRegistry().ScopeNamed("fanout").FuncNamed("work")
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	s := SpanFromCtx(ctx)
+
+	var dones []func(*error)
+	for i := 0; i < 3; i++ {
+		child := ctx
+		dones = append(dones, f.Task(&child))
+		if s.ChildCount() != i+1 {
+			t.Fatalf("expected %d children, got %d", i+1, s.ChildCount())
+		}
+	}
+	for i, childDone := range dones {
+		childDone(nil)
+		if s.ChildCount() != 2-i {
+			t.Fatalf("expected %d children, got %d", 2-i, s.ChildCount())
+		}
+	}
+	done(nil)
+}
+
+func TestRegistryDeterministicIds(t *testing.T) {
+	r := NewRegistry()
+	r.SetDeterministicIds(true)
+	f := r.ScopeNamed("golden").FuncNamed("work")
+
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	var ids []int64
+	ids = append(ids, SpanFromCtx(ctx).Id())
+	for i := 0; i < 2; i++ {
+		child := ctx
+		f.Task(&child)(nil)
+		ids = append(ids, SpanFromCtx(child).Id())
+	}
+	resumed := SpanFromCtx(ctx).Defer()()
+	resumed.Finish(nil)
+	ids = append(ids, resumed.Id())
+	done(nil)
+
+	for i, id := range ids {
+		if id != int64(i+1) {
+			t.Fatalf("expected ids 1, 2, 3, 4, got %v", ids)
+		}
+	}
+	if SpanFromCtx(ctx).Trace().Id() != 1 {
+		t.Fatalf("expected trace id 1, got %d", SpanFromCtx(ctx).Trace().Id())
+	}
+}
+
+func TestSpanSchedulingDelay(t *testing.T) {
+	r := NewRegistry()
+	clock := newTestClock()
+	r.testClock = clock.Now
+	f := r.ScopeNamed("delay").FuncNamed("work")
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	if SpanFromCtx(ctx).SchedulingDelay() != 0 {
+		t.Fatal("root spans should have no scheduling delay")
+	}
+
+	clock.Advance(20 * time.Millisecond)
+	child := ctx
+	f.Task(&child)(nil)
+	if delay := SpanFromCtx(child).SchedulingDelay(); delay !=
+		20*time.Millisecond {
+		t.Fatalf("expected 20ms of delay, got %v", delay)
+	}
+	done(nil)
+}
+
+func TestSpanAnnotateDuration(t *testing.T) {
+	ctx := context.Background()
+	NewRegistry().ScopeNamed("dur").FuncNamed("work").Task(&ctx)(nil)
+	s := SpanFromCtx(ctx)
+	s.AnnotateDuration("db.time", 1500*time.Millisecond)
+
+	annotations := s.Annotations()
+	if len(annotations) != 1 ||
+		annotations[0] != (Annotation{Name: "db.time", Value: "1.5s"}) {
+		t.Fatalf("unexpected annotations: %v", annotations)
+	}
+	if ns := s.Attributes()["db.time"]; ns != int64(1500*time.Millisecond) {
+		t.Fatalf("unexpected attribute: %#v", ns)
+	}
+}
+
+func TestFuncTaskAt(t *testing.T) {
+	f := NewRegistry().ScopeNamed("backfill").FuncNamed("work")
+	start := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	ctx := context.Background()
+	f.TaskAt(&ctx, start)
+	child := ctx
+	f.TaskAt(&child, start.Add(time.Second))
+	SpanFromCtx(child).FinishAt(nil, start.Add(3*time.Second))
+	s := SpanFromCtx(ctx)
+	s.FinishAt(nil, start.Add(5*time.Second))
+
+	if !s.Start().Equal(start) {
+		t.Fatalf("expected start %v, got %v", start, s.Start())
+	}
+	if max := f.SuccessTimes().Query(1); max != 5*time.Second {
+		t.Fatalf("expected the longest span to take 5s, got %v", max)
+	}
+	if SpanFromCtx(child).SchedulingDelay() != time.Second {
+		t.Fatalf("unexpected scheduling delay %v",
+			SpanFromCtx(child).SchedulingDelay())
+	}
+	if f.Success() != 2 {
+		t.Fatalf("expected 2 successes, got %d", f.Success())
+	}
+}
+
+func TestRegistryOnOrphanRateLimit(t *testing.T) {
+	r := NewRegistry()
+	defer r.Shutdown()
+	clock := newTestClock()
+	r.testClock = clock.Now
+	r.SetOrphanRate(5)
+	var mtx sync.Mutex
+	var calls, summaries, suppressed int64
+	r.OnOrphan(func(s *Span, n int64) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if s == nil {
+			summaries += 1
+		} else {
+			calls += 1
+		}
+		suppressed += n
+	})
+	check := func(expectedCalls, expectedSummaries,
+		expectedSuppressed int64) {
+		t.Helper()
+		mtx.Lock()
+		defer mtx.Unlock()
+		if calls != expectedCalls || summaries != expectedSummaries ||
+			suppressed != expectedSuppressed {
+			t.Fatalf("expected %d calls, %d summaries and %d suppressed, "+
+				"got %d, %d and %d", expectedCalls, expectedSummaries,
+				expectedSuppressed, calls, summaries, suppressed)
+		}
+	}
+	f := r.ScopeNamed("orphans").FuncNamed("work")
+
+	orphanChildren := func(n int) {
+		ctx := context.Background()
+		done := f.Task(&ctx)
+		for i := 0; i < n; i++ {
+			child := ctx
+			f.Task(&child)
+		}
+		done(nil)
+	}
+
+	orphanChildren(100)
+	check(5, 0, 0)
+	if r.SuppressedOrphans() != 95 {
+		t.Fatalf("expected 95 suppressed, got %d", r.SuppressedOrphans())
+	}
+
+	// one token refills every 200ms, and the next call reports the backlog
+	clock.Advance(250 * time.Millisecond)
+	orphanChildren(1)
+	check(6, 0, 95)
+
+	// a burst that ends while calls are suppressed is reported by the
+	// summary
+	orphanChildren(3)
+	r.flushOrphans()
+	check(6, 1, 98)
+	r.flushOrphans()
+	check(6, 1, 98)
+}
+
+func TestRegistrySlowOrphanRate(t *testing.T) {
+	r := NewRegistry()
+	defer r.Shutdown()
+	r.testClock = newTestClock().Now
+	r.SetOrphanRate(0.5)
+	var calls int
+	r.OnOrphan(func(s *Span, n int64) { calls++ })
+	f := r.ScopeNamed("orphans").FuncNamed("work")
+
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	child := ctx
+	f.Task(&child)
+	done(nil)
+	if calls != 1 {
+		t.Fatalf("expected the first orphan to be reported, got %d calls",
+			calls)
+	}
+}
+
+func TestClassifyContextErrors(t *testing.T) {
+	r := NewRegistry()
+	f := r.ScopeNamed("ctxerr").FuncNamed("work")
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	ctx := canceled
+	f.Task(&ctx)(nil)
+	if len(SpanFromCtx(ctx).Annotations()) != 0 || f.ContextErrors() != 0 {
+		t.Fatal("context errors shouldn't be classified by default")
+	}
+
+	r.SetClassifyContextErrors(true)
+	ctx = canceled
+	f.Task(&ctx)(nil)
+	annotations := SpanFromCtx(ctx).Annotations()
+	if len(annotations) != 1 || annotations[0] != (Annotation{
+		Name: "ctx.err", Value: context.Canceled.Error()}) {
+		t.Fatalf("unexpected annotations: %v", annotations)
+	}
+	if f.ContextErrors() != 1 || f.Success() != 2 {
+		t.Fatalf("expected 1 context error and 2 successes, got %d and %d",
+			f.ContextErrors(), f.Success())
+	}
+
+	// real errors are left alone
+	ctx = canceled
+	err := context.Canceled
+	f.Task(&ctx)(&err)
+	if f.ContextErrors() != 1 {
+		t.Fatalf("expected 1 context error, got %d", f.ContextErrors())
+	}
+
+	// TaskWithDeadline's own cancel doesn't count
+	ctx = context.Background()
+	f.TaskWithDeadline(&ctx, time.Now().Add(time.Hour))(nil)
+	for _, annotation := range SpanFromCtx(ctx).Annotations() {
+		if annotation.Name == "ctx.err" {
+			t.Fatalf("unexpected annotation: %v", annotation)
+		}
+	}
+	if f.ContextErrors() != 1 {
+		t.Fatalf("expected 1 context error, got %d", f.ContextErrors())
+	}
+}
+
+func TestRegistryMaxLiveTraces(t *testing.T) {
+	r := NewRegistry()
+	r.SetMaxLiveTraces(2)
+	var observed int
+	r.ObserveTraces(func(t *Trace) { observed += 1 })
+	f := r.ScopeNamed("shed").FuncNamed("work")
+
+	var dones []func(*error)
+	var traces []*Trace
+	for i := 0; i < 5; i++ {
+		ctx := context.Background()
+		dones = append(dones, f.Task(&ctx))
+		traces = append(traces, SpanFromCtx(ctx).Trace())
+	}
+	if observed != 2 || r.LiveTraces() != 2 || r.ShedTraces() != 3 {
+		t.Fatalf("expected 2 observed, 2 live and 3 shed traces, got %d, %d "+
+			"and %d", observed, r.LiveTraces(), r.ShedTraces())
+	}
+	for i, trace := range traces {
+		if trace.Shed() != (i >= 2) {
+			t.Fatalf("trace %d: unexpected shed state", i)
+		}
+	}
+	if f.Current() != 5 {
+		t.Fatalf("shed traces should still run, got %d running", f.Current())
+	}
+
+	// finishing the live traces makes room for new ones
+	for _, done := range dones {
+		done(nil)
+	}
+	if r.LiveTraces() != 0 {
+		t.Fatalf("expected no live traces, got %d", r.LiveTraces())
+	}
+	ctx := context.Background()
+	f.Task(&ctx)(nil)
+	if SpanFromCtx(ctx).Trace().Shed() || observed != 3 {
+		t.Fatal("expected the new trace to be admitted")
+	}
+
+	// shed traces don't inherit sampling
+	ctx = context.Background()
+	defer f.Task(&ctx)(nil)
+	SpanFromCtx(ctx).Trace().SetSampled(true)
+	r.SetMaxLiveTraces(1)
+	reset := ctx
+	f.ResetTrace(&reset)(nil)
+	if trace := SpanFromCtx(reset).Trace(); !trace.Shed() || trace.Sampled() {
+		t.Fatal("expected a shed, unsampled trace")
+	}
+}
+
+func TestRegistryShedTraceLimits(t *testing.T) {
+	r := NewRegistry()
+	r.SetMaxLiveTraces(1)
+	r.SetMaxBaggageBytes(2)
+	f := r.ScopeNamed("shed").FuncNamed("work")
+
+	live := context.Background()
+	defer f.Task(&live)(nil)
+	ctx := context.Background()
+	defer f.Task(&ctx)(nil)
+	trace := SpanFromCtx(ctx).Trace()
+	if !trace.Shed() {
+		t.Fatal("expected the second trace to be shed")
+	}
+	if trace.SetBaggageItem("key", "val") {
+		t.Fatal("shed traces should honor the baggage budget")
+	}
+	ready := trace.ExportReady()
+	r.Shutdown()
+	select {
+	case <-ready:
+	default:
+		t.Fatal("expected Shutdown to close ExportReady")
+	}
+}
+
+func TestSpanAnnotateLazy(t *testing.T) {
+	f := NewRegistry().ScopeNamed("lazy").FuncNamed("work")
+	calls := 0
+	payload := func() string {
+		calls += 1
+		return `{"big":"payload"}`
+	}
+
+	ctx := context.Background()
+	f.Task(&ctx)(nil)
+	unsampled := SpanFromCtx(ctx)
+	unsampled.AnnotateLazy("request", payload)
+	if len(unsampled.Annotations()) != 0 || calls != 0 {
+		t.Fatal("lazy annotations shouldn't be evaluated on unsampled traces")
+	}
+
+	ctx = context.Background()
+	f.Task(&ctx)(nil)
+	sampled := SpanFromCtx(ctx)
+	sampled.Trace().SetSampled(true)
+	sampled.Annotate("eager", "value")
+	sampled.AnnotateLazy("request", payload)
+	for i := 0; i < 2; i++ {
+		annotations := sampled.Annotations()
+		if len(annotations) != 2 || annotations[1] != (Annotation{
+			Name: "request", Value: `{"big":"payload"}`}) {
+			t.Fatalf("unexpected annotations: %v", annotations)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected the thunk to be called once, got %d", calls)
+	}
+}
+
+func TestTraceHadError(t *testing.T) {
+	f := NewRegistry().ScopeNamed("errs").FuncNamed("work")
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	middle := ctx
+	doneMiddle := f.Task(&middle)
+	leaf := middle
+	f.Task(&leaf)(nil)
+	trace := SpanFromCtx(ctx).Trace()
+	if trace.HadError() {
+		t.Fatal("no errors yet")
+	}
+
+	leaf = middle
+	err := errors.New("leaf failed")
+	f.Task(&leaf)(&err)
+	doneMiddle(nil)
+	done(nil)
+	if !trace.HadError() {
+		t.Fatal("expected the leaf's error to mark the trace")
+	}
+}
+
+func TestSpanBudgetAnnotation(t *testing.T) {
+	f := NewRegistry().ScopeNamed("budget").FuncNamed("work")
+	budgetUsed := func(s *Span) (string, bool) {
+		for _, annotation := range s.Annotations() {
+			if annotation.Name == "budget.used.pct" {
+				return annotation.Value, true
+			}
+		}
+		return "", false
+	}
+
+	ctx := context.Background()
+	f.Task(&ctx)(nil)
+	if _, ok := budgetUsed(SpanFromCtx(ctx)); ok {
+		t.Fatal("spans without a deadline shouldn't be annotated")
+	}
+
+	// imported spans are measured from their own start
+	start := time.Now().Add(-3 * time.Hour)
+	parent, cancel := context.WithDeadline(context.Background(),
+		start.Add(4*time.Hour))
+	defer cancel()
+	ctx = parent
+	f.TaskAt(&ctx, start)
+	SpanFromCtx(ctx).FinishAt(nil, start.Add(time.Hour))
+	val, ok := budgetUsed(SpanFromCtx(ctx))
+	if pct, err := strconv.ParseFloat(val, 64); !ok || err != nil || pct != 25 {
+		t.Fatalf("expected 25%% of the budget used, got %q", val)
+	}
+
+	// as are spans that finish past their deadline
+	ctx = parent
+	f.TaskAt(&ctx, start)
+	SpanFromCtx(ctx).FinishAt(nil, start.Add(5*time.Hour))
+	val, ok = budgetUsed(SpanFromCtx(ctx))
+	if !ok || val != "100.0" {
+		t.Fatalf("expected all of the budget used, got %q", val)
+	}
+}
+
+func TestSpanBudgetIgnoresWallClock(t *testing.T) {
+	r := NewRegistry()
+	// a wall clock far from real time, such as a test's fixed clock
+	fixed := time.Now().Add(2 * time.Hour)
+	r.SetWallClock(func() time.Time { return fixed })
+	// and a Registry clock far from it too
+	r.testClock = newTestClock().Now
+	f := r.ScopeNamed("budget").FuncNamed("work")
+
+	parent, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	check := func(s *Span) {
+		for _, annotation := range s.Annotations() {
+			if annotation.Name != "budget.used.pct" {
+				continue
+			}
+			if pct, err := strconv.ParseFloat(annotation.Value, 64); err != nil ||
+				pct < 0 || pct > 1 {
+				t.Fatalf("expected almost none of the budget used, got %q",
+					annotation.Value)
+			}
+			return
+		}
+		t.Fatal("expected a budget annotation")
+	}
+
+	ctx := parent
+	f.Task(&ctx)(nil)
+	check(SpanFromCtx(ctx))
+
+	// the same when ending the Span is held by Defer
+	ctx = parent
+	done := f.Task(&ctx)
+	s := SpanFromCtx(ctx)
+	resume := s.Defer()
+	done(nil)
+	resume().Finish(nil)
+	check(s)
+}
+
+func TestSpanSummaryLockFree(t *testing.T) {
+	f := NewRegistry().ScopeNamed("summary").FuncNamed("work")
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	child := ctx
+	f.Task(&child, "arg")
+	s := SpanFromCtx(child)
+
+	// with the lock held, none of these may block
+	s.mtx.Lock()
+	read := make(chan SpanSummary)
+	go func() {
+		s.Id()
+		s.Func()
+		s.Trace()
+		s.Parent()
+		s.Args()
+		read <- s.Summary()
+	}()
+	var summary SpanSummary
+	select {
+	case summary = <-read:
+	case <-time.After(time.Second):
+		t.Fatal("immutable field accessors took the span's lock")
+	}
+	s.mtx.Unlock()
+	if summary.Id != s.Id() || summary.ParentId != SpanFromCtx(ctx).Id() ||
+		summary.Trace != s.Trace() || summary.Func != f {
+		t.Fatalf("unexpected summary: %+v", summary)
+	}
+
+	// hammer Summary while the span is mutated. run with -race.
+	stop := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				if s.Summary().Id != summary.Id {
+					panic("summary changed")
+				}
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		s.Annotate("i", strconv.Itoa(i))
+		s.SetAttribute("i", i)
+		s.Restart()
+	}
+	s.Finish(nil)
+	done(nil)
+	close(stop)
+	<-finished
+	if !s.Summary().Start.Equal(summary.Start) {
+		t.Fatal("restarting shouldn't change the summary's start")
+	}
+}
+
+func TestSpanSetName(t *testing.T) {
+	f := NewRegistry().ScopeNamed("http").FuncNamed("ServeHTTP")
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	s := SpanFromCtx(ctx)
+	if s.Name() != "ServeHTTP" {
+		t.Fatalf("expected the func name, got %q", s.Name())
+	}
+	s.SetName("GET /users/{id}")
+	done(nil)
+
+	data := NewSpanData(s, nil, false, time.Now())
+	if data.FullName() != "http.GET /users/{id}" {
+		t.Fatalf("unexpected name %q", data.FullName())
+	}
+	if f.Success() != 1 {
+		t.Fatal("stats should still be kept by func")
+	}
+}
+
+func TestSpanSetFunc(t *testing.T) {
+	r := NewRegistry()
+	dispatch := r.ScopeNamed("rpc").FuncNamed("Dispatch")
+	get := r.ScopeNamed("rpc").FuncNamed("Get")
+	ctx := context.Background()
+	done := dispatch.Task(&ctx)
+	s := SpanFromCtx(ctx)
+	if s.SetFunc(NewRegistry().ScopeNamed("rpc").FuncNamed("Get")) {
+		t.Fatal("spans shouldn't move to other registries")
+	}
+	if !s.SetFunc(get) || s.Func() != get {
+		t.Fatal("expected the span to move")
+	}
+	if dispatch.Current() != 0 || get.Current() != 1 || get.Highwater() != 1 {
+		t.Fatalf("unexpected current counts: %d, %d",
+			dispatch.Current(), get.Current())
+	}
+	done(nil)
+
+	if dispatch.Success() != 0 || get.Success() != 1 || get.Current() != 0 {
+		t.Fatal("expected the outcome to go to the new func")
+	}
+	if s.SetFunc(dispatch) {
+		t.Fatal("finished spans shouldn't move")
+	}
+}
+
+func TestSpanKey(t *testing.T) {
+	f := NewRegistry().ScopeNamed("keys").FuncNamed("work")
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	a, b := SpanFromCtx(ctx), SpanFromCtx(context.Context(SpanFromCtx(ctx)))
+	child := ctx
+	f.Task(&child)(nil)
+	done(nil)
+
+	seen := map[SpanKey]bool{a.Key(): true}
+	if a.Key() != b.Key() || !seen[b.Key()] {
+		t.Fatal("expected references to the same span to have equal keys")
+	}
+	if seen[SpanFromCtx(child).Key()] {
+		t.Fatal("expected different spans to have different keys")
+	}
+	if key := a.Key(); key.TraceId != a.Trace().Id() || key.SpanId != a.Id() {
+		t.Fatalf("unexpected key %+v", key)
+	}
+}
+
+func TestRegistryArgSizeLimit(t *testing.T) {
+	r := NewRegistry()
+	f := r.ScopeNamed("args").FuncNamed("work")
+	big := make([]int, 1000)
+	ctx := context.Background()
+	f.Task(&ctx, big, "small")(nil)
+	s := SpanFromCtx(ctx)
+	full := fmt.Sprintf("%#v", big)
+	if args := s.Args(); args[0] != full {
+		t.Fatal("args shouldn't be truncated by default")
+	}
+
+	r.SetArgSizeLimit(20)
+	args := s.Args()
+	expected := fmt.Sprintf("%s<%d bytes elided>", full[:20], len(full)-20)
+	if len(args) != 2 || args[0] != expected || args[1] != `"small"` {
+		t.Fatalf("unexpected args: %q", args)
+	}
+}
+
+func TestRegistryMaxArgs(t *testing.T) {
+	r := NewRegistry()
+	r.SetMaxArgs(2)
+	f := r.ScopeNamed("args").FuncNamed("work")
+
+	ctx := context.Background()
+	f.Task(&ctx, "a", "b", "c", "d")(nil)
+	s := SpanFromCtx(ctx)
+	if args := s.Args(); len(args) != 2 || args[1] != `"b"` {
+		t.Fatalf("unexpected args %v", args)
+	}
+	annotations := s.Annotations()
+	if len(annotations) != 1 || annotations[0].Name != "args.truncated" ||
+		annotations[0].Value != "2" {
+		t.Fatalf("unexpected annotations %v", annotations)
+	}
+
+	named := context.Background()
+	f.TaskNamed(&named, []string{"x", "y", "z"}, 1, 2, 3)(nil)
+	if args := SpanFromCtx(named).NamedArgs(); len(args) != 2 ||
+		args["y"] != "2" {
+		t.Fatalf("unexpected named args %v", args)
+	}
+
+	few := context.Background()
+	f.Task(&few, "a")(nil)
+	if len(SpanFromCtx(few).Annotations()) != 0 {
+		t.Fatal("spans within the limit shouldn't be annotated")
+	}
+}
+
+func TestSpanAdoptChild(t *testing.T) {
+	r := NewRegistry()
+	f := r.ScopeNamed("adopt").FuncNamed("work")
+	start := func() (*Span, func(*error)) {
+		ctx := context.Background()
+		done := f.Task(&ctx)
+		return SpanFromCtx(ctx), done
+	}
+
+	root, doneRoot := start()
+	middle, doneMiddle := start()
+	leaf, doneLeaf := start()
+	if err := root.AdoptChild(middle); err != nil {
+		t.Fatal(err)
+	}
+	if err := middle.AdoptChild(leaf); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.AdoptChild(leaf); err == nil {
+		t.Fatal("expected an error adopting an adopted span")
+	}
+	if err := leaf.AdoptChild(root); err == nil {
+		t.Fatal("expected an error adopting an ancestor")
+	}
+	ctx := context.Context(root)
+	f.Task(&ctx)
+	if err := middle.AdoptChild(SpanFromCtx(ctx)); err == nil {
+		t.Fatal("expected an error adopting a span with a parent")
+	}
+	SpanFromCtx(ctx).Finish(nil)
+
+	var children []*Span
+	root.Children(func(s *Span) { children = append(children, s) })
+	if len(children) != 1 || children[0] != middle {
+		t.Fatalf("unexpected root children: %v", children)
+	}
+	children = nil
+	middle.Children(func(s *Span) { children = append(children, s) })
+	if len(children) != 1 || children[0] != leaf {
+		t.Fatalf("unexpected middle children: %v", children)
+	}
+
+	doneLeaf(nil)
+	if middle.ChildCount() != 0 {
+		t.Fatal("finished adopted children should be removed")
+	}
+	doneRoot(nil)
+	if !middle.Orphaned() {
+		t.Fatal("adopted children should be orphaned like any other")
+	}
+	doneMiddle(nil)
+	r.RootSpans(func(s *Span) { t.Fatalf("unexpected running span %d", s.Id()) })
+}
+
+func TestRegistryAnnotationSampling(t *testing.T) {
+	r := NewRegistry()
+	r.SetAnnotationSampling(100)
+	ctx := context.Background()
+	r.ScopeNamed("annotations").FuncNamed("batch").Task(&ctx)(nil)
+	s := SpanFromCtx(ctx)
+	for i := 0; i < 10000; i++ {
+		s.Annotate("item", strconv.Itoa(i))
+	}
+
+	annotations := s.Annotations()
+	if len(annotations) != 100 || s.DroppedAnnotations() != 9900 {
+		t.Fatalf("kept %d annotations, dropped %d", len(annotations),
+			s.DroppedAnnotations())
+	}
+	seen := map[string]bool{}
+	late := 0
+	for _, annotation := range annotations {
+		i, err := strconv.Atoi(annotation.Value)
+		if err != nil || seen[annotation.Value] {
+			t.Fatalf("unexpected annotation %v", annotation)
+		}
+		seen[annotation.Value] = true
+		if i >= 5000 {
+			late++
+		}
+	}
+	if late == 0 || late == 100 {
+		t.Fatalf("sample isn't representative: %d of 100 are late", late)
+	}
+
+	// monkit's own annotations are never sampled away
+	ctx = context.Background()
+	r.ScopeNamed("annotations").FuncNamed("batch").Task(&ctx)(nil)
+	s = SpanFromCtx(ctx)
+	s.Annotate("status", "500")
+	for i := 0; i < 1000; i++ {
+		s.Annotate("item", strconv.Itoa(i))
+	}
+	s.Restart()
+	annotations = s.Annotations()
+	if len(annotations) != 102 || annotations[0].Name != "status" ||
+		annotations[101].Name != "attempts" {
+		t.Fatalf("expected status, 100 items and attempts, got %d: %v",
+			len(annotations), annotations[0])
+	}
+}
+
+func TestSpanMarshalJSONStable(t *testing.T) {
+	f := NewRegistry().ScopeNamed("json").FuncNamed("work")
+	ctx := context.Background()
+	f.Task(&ctx)(nil)
+	s := SpanFromCtx(ctx)
+	s.Annotate("b", "1")
+	s.Annotate("a", "2")
+	s.Annotate("b", "3")
+	s.SetAttribute("z", 1)
+	s.SetAttribute("y", 2)
+
+	first, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(first),
+		`"annotations":[["a","2"],["b","1"],["b","3"]]`) {
+		t.Fatalf("annotations aren't sorted: %s", first)
+	}
+	data := NewSpanData(s, nil, false, time.Now())
+	firstLine, err := marshalSpanLine(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		again, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(again) != string(first) {
+			t.Fatalf("unstable output:\n%s\n%s", first, again)
+		}
+		line, err := marshalSpanLine(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(line) != string(firstLine) {
+			t.Fatalf("unstable output:\n%s\n%s", firstLine, line)
+		}
+	}
+}
+
+func TestSpanDeferTimeout(t *testing.T) {
+	r := NewRegistry()
+	if r.DeferTimeout() != DefaultDeferTimeout {
+		t.Fatalf("unexpected default timeout %v", r.DeferTimeout())
+	}
+	r.SetDeferTimeout(time.Millisecond)
+	f := r.ScopeNamed("handoff").FuncNamed("produce")
+
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	parent := SpanFromCtx(ctx)
+	resume := parent.Defer()
+	errTest := errors.New("gave up")
+	done(&errTest)
+
+	// the continuation never resumes, so the held finish happens once the
+	// timeout fires
+	for deadline := time.Now().Add(5 * time.Second); !parent.isDone(); {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the timeout to release the span")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if f.Errors()["System Error"] != 1 {
+		t.Fatalf("expected the held error to be recorded, got %v",
+			f.Errors())
+	}
+
+	child := resume()
+	child.Finish(nil)
+	if !child.HasParent() || !child.Orphaned() {
+		t.Fatal("resuming after the timeout should start an orphan")
+	}
+}
+
+func TestSpanDeferHandoff(t *testing.T) {
+	r := NewRegistry()
+	f := r.ScopeNamed("handoff").FuncNamed("produce")
+	var orphans int
+	r.OnOrphan(func(s *Span, suppressed int64) { orphans++ })
+
+	work := make(chan func() *Span)
+	proceed := make(chan struct{})
+	resumed := make(chan *Span)
+	go func() {
+		resume := <-work
+		<-proceed
+		child := resume()
+		resumed <- child
+		<-proceed
+		child.Finish(nil)
+		close(resumed)
+	}()
+
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	parent := SpanFromCtx(ctx)
+	work <- parent.Defer()
+	done(nil) // the producer returns before the worker starts
+	proceed <- struct{}{}
+
+	child := <-resumed
+	if !child.HasParent() || child.ParentId() != parent.Id() {
+		t.Fatal("resumed span should be a child of the deferring span")
+	}
+	if child.Func().ShortName() != "produce.resume" {
+		t.Fatalf("unexpected func %q", child.Func().ShortName())
+	}
+	if parent.isDone() {
+		t.Fatal("span shouldn't finish while a continuation holds it")
+	}
+	proceed <- struct{}{}
+	<-resumed
+
+	if child.Orphaned() || orphans != 0 {
+		t.Fatal("resumed span shouldn't be orphaned")
+	}
+	parent.mtx.Lock()
+	finished, finish := parent.done, parent.finished()
+	parent.mtx.Unlock()
+	if !finished || finish.After(child.Start()) {
+		t.Fatal("span should have finished with its original finish time")
+	}
+	r.RootSpans(func(s *Span) { t.Fatalf("unexpected running span %d", s.Id()) })
+}
+
+type wrappedPanic struct {
+	traceId int64
+	fn      string
+	rec     interface{}
+}
+
+func TestRegistryPanicWrapper(t *testing.T) {
+	r := NewRegistry()
+	outer := r.ScopeNamed("panics").FuncNamed("outer")
+	inner := r.ScopeNamed("panics").FuncNamed("inner")
+	r.SetPanicWrapper(func(s *Span, rec interface{}) interface{} {
+		if _, ok := rec.(*wrappedPanic); ok {
+			return rec
+		}
+		s.Annotate("panic", fmt.Sprint(rec))
+		return &wrappedPanic{traceId: s.Trace().Id(),
+			fn: s.Func().ShortName(), rec: rec}
+	})
+
+	var innerSpan *Span
+	rec := func() (rec interface{}) {
+		defer func() { rec = recover() }()
+		ctx := context.Background()
+		defer outer.Task(&ctx)(nil)
+		func() {
+			defer inner.Task(&ctx)(nil)
+			innerSpan = SpanFromCtx(ctx)
+			panic("boom")
+		}()
+		return nil
+	}()
+
+	wrapped, ok := rec.(*wrappedPanic)
+	if !ok || wrapped.fn != "inner" || wrapped.rec != "boom" ||
+		wrapped.traceId != innerSpan.Trace().Id() {
+		t.Fatalf("unexpected panic value %#v", rec)
+	}
+	annotations := innerSpan.Annotations()
+	if len(annotations) != 1 || annotations[0].Value != "boom" {
+		t.Fatalf("unexpected annotations %v", annotations)
+	}
+
+	r.SetPanicWrapper(nil)
+	rec = func() (rec interface{}) {
+		defer func() { rec = recover() }()
+		ctx := context.Background()
+		defer inner.Task(&ctx)(nil)
+		panic("boom")
+	}()
+	if rec != "boom" {
+		t.Fatalf("expected the original panic value, got %#v", rec)
+	}
+}
+
+func TestSpanTags(t *testing.T) {
+	r := NewRegistry()
+	f := r.ScopeNamed("tags").FuncNamed("query")
+	ctx := context.Background()
+	f.Task(&ctx)(nil)
+	s := SpanFromCtx(ctx)
+	s.SetTag("region", "us-east")
+	s.Annotate("query", "select 1")
+
+	if tags := s.Tags(); len(tags) != 1 || tags["region"] != "us-east" {
+		t.Fatalf("unexpected tags %v", tags)
+	}
+	annotations := s.Annotations()
+	if len(annotations) != 1 || annotations[0].Name != "query" {
+		t.Fatalf("unexpected annotations %v", annotations)
+	}
+	line, err := marshalSpanLine(NewSpanData(s, nil, false, time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Tags        map[string]string `json:"tags"`
+		Annotations [][]string        `json:"annotations"`
+	}
+	if err := json.Unmarshal(line, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Tags) != 1 || out.Tags["region"] != "us-east" ||
+		len(out.Annotations) != 1 || out.Annotations[0][0] != "query" {
+		t.Fatalf("tags and annotations should be exported separately: %s",
+			line)
+	}
+
+	r.SetMaxTagValues(2)
+	for _, test := range []struct{ region, expected string }{
+		{"us-east", "us-east"},
+		{"us-west", "us-west"},
+		{"eu", OverflowTagValue},
+		{"us-east", "us-east"},
+	} {
+		s.SetTag("region", test.region)
+		if actual := s.Tags()["region"]; actual != test.expected {
+			t.Fatalf("%s: expected %q, got %q", test.region, test.expected,
+				actual)
+		}
+	}
+	if r.OverflowedTags() != 1 {
+		t.Fatalf("expected 1 overflowed tag, got %d", r.OverflowedTags())
+	}
+}
+
+func TestRegistryAdoptTrace(t *testing.T) {
+	r := NewRegistry()
+	f := r.ScopeNamed("workflow").FuncNamed("step")
+	var observed []*Trace
+	r.ObserveTraces(func(t *Trace) { observed = append(observed, t) })
+
+	trace := r.AdoptTrace(1234, true)
+	for i := 0; i < 2; i++ {
+		ctx := context.Background()
+		f.Task(&ctx)(nil)
+		s := SpanFromCtx(ctx)
+		if s.Trace() != trace || s.Trace().Id() != 1234 ||
+			!s.Trace().Sampled() {
+			t.Fatalf("root span didn't join the adopted trace: %d",
+				s.Trace().Id())
+		}
+	}
+	if len(observed) != 1 || observed[0] != trace {
+		t.Fatalf("expected the adopted trace to be observed once: %v",
+			observed)
+	}
+
+	ctx := context.Background()
+	f.ResetTrace(&ctx)(nil)
+	if SpanFromCtx(ctx).Trace() == trace {
+		t.Fatal("ResetTrace should still start a new trace")
+	}
+
+	r.ReleaseAdoptedTrace()
+	ctx = context.Background()
+	f.Task(&ctx)(nil)
+	if SpanFromCtx(ctx).Trace() == trace {
+		t.Fatal("root spans shouldn't join a released trace")
+	}
+}
+
+func TestRegistryCurrentSpan(t *testing.T) {
+	r := NewRegistry()
+	f := r.ScopeNamed("goroutine").FuncNamed("work")
+	ctx := context.Background()
+	defer f.Task(&ctx)(nil)
+	parent := SpanFromCtx(ctx)
+
+	r.SetCurrentSpan(parent)
+	if r.CurrentSpan() != nil {
+		t.Fatal("goroutine-local spans should be off by default")
+	}
+
+	r.SetGoroutineLocalSpans(true)
+	restore := r.SetCurrentSpan(parent)
+	child := context.Background()
+	f.Task(&child)(nil)
+	if s := SpanFromCtx(child); s.Parent() != parent ||
+		s.Trace() != parent.Trace() {
+		t.Fatal("context-free span should be a child of the current span")
+	}
+
+	other := make(chan *Span)
+	go func() { other <- r.CurrentSpan() }()
+	if <-other != nil {
+		t.Fatal("current span shouldn't leak to other goroutines")
+	}
+
+	restore()
+	if r.CurrentSpan() != nil {
+		t.Fatal("restore should clear the current span")
+	}
+	root := context.Background()
+	f.Task(&root)(nil)
+	if SpanFromCtx(root).HasParent() {
+		t.Fatal("span should be a root once the current span is restored")
+	}
+}
+
+func TestSpanFinishWithResult(t *testing.T) {
+	r := NewRegistry()
+	f := r.ScopeNamed("result").FuncNamed("read")
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	s := SpanFromCtx(ctx)
+	s.FinishWithResult(nil, "12 rows")
+	s.FinishWithResult(errors.New("late"), "0 rows")
+	s.Finish(errors.New("late"))
+	done(nil)
+
+	annotations := s.Annotations()
+	if len(annotations) != 1 || annotations[0] != (Annotation{
+		Name: "result", Value: "12 rows"}) {
+		t.Fatalf("unexpected annotations %v", annotations)
+	}
+	if !s.isDone() || f.Success() != 1 || len(f.Errors()) != 0 {
+		t.Fatal("span should have finished exactly once, successfully")
+	}
+
+	// the result of an end that doesn't count is never added
+	ctx = context.Background()
+	f.Task(&ctx)(nil)
+	s = SpanFromCtx(ctx)
+	s.FinishWithResult(nil, "12 rows")
+	if annotations := s.Annotations(); len(annotations) != 0 {
+		t.Fatalf("unexpected annotations %v", annotations)
+	}
+
+	// racing ends add at most one result, and only with the end that counts
+	for i := 0; i < 100; i++ {
+		ctx = context.Background()
+		f.Task(&ctx)
+		s = SpanFromCtx(ctx)
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() { defer wg.Done(); s.Finish(errors.New("first")) }()
+		go func() { defer wg.Done(); s.FinishWithResult(nil, "12 rows") }()
+		wg.Wait()
+		results := 0
+		for _, annotation := range s.Annotations() {
+			if annotation.Name == "result" {
+				results++
+			}
+		}
+		code, _ := s.Status()
+		if (code == StatusCodeError) != (results == 0) || results > 1 {
+			t.Fatalf("unexpected result annotations %v with status %v",
+				s.Annotations(), code)
+		}
+	}
+}
+
+func TestFuncTaskNamed(t *testing.T) {
+	f := NewRegistry().ScopeNamed("named").FuncNamed("get")
+	ctx := context.Background()
+	f.TaskNamed(&ctx, []string{"bucket", "key"}, "photos", "cat.jpg", 3)(nil)
+	args := SpanFromCtx(ctx).NamedArgs()
+	expected := map[string]string{
+		"bucket": `"photos"`, "key": `"cat.jpg"`, "arg2": "3"}
+	if len(args) != len(expected) {
+		t.Fatalf("unexpected args %v", args)
+	}
+	for name, val := range expected {
+		if args[name] != val {
+			t.Fatalf("unexpected args %v", args)
+		}
+	}
+
+	ctx = context.Background()
+	f.Task(&ctx, "photos")(nil)
+	if args := SpanFromCtx(ctx).NamedArgs(); len(args) != 1 ||
+		args["arg0"] != `"photos"` {
+		t.Fatalf("unexpected args %v", args)
+	}
+}
+
+func TestRegistryLinkByKey(t *testing.T) {
+	r := NewRegistry()
+	f := r.ScopeNamed("orders").FuncNamed("handle")
+
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	placed := SpanFromCtx(ctx)
+	r.LinkByKey("order-1", placed)
+	err := errors.New("declined")
+	done(&err)
+
+	ctx = context.Background()
+	done = f.Task(&ctx)
+	defer done(nil)
+	shipped := SpanFromCtx(ctx)
+	r.LinkByKey("order-1", shipped)
+	r.LinkByKey("order-2", shipped)
+
+	spans := r.SpansForKey("order-1")
+	if len(spans) != 2 || spans[0].Id != placed.Id() ||
+		spans[1].Id != shipped.Id() {
+		t.Fatalf("unexpected spans %v", spans)
+	}
+	if spans[0].TraceId == spans[1].TraceId {
+		t.Fatal("expected spans from separate traces")
+	}
+	if spans[0].Err == nil || spans[0].Finish.IsZero() {
+		t.Fatal("finished span should be reported as it finished")
+	}
+	if !spans[1].Finish.IsZero() {
+		t.Fatal("running span should have no finish time")
+	}
+	if len(r.SpansForKey("order-3")) != 0 {
+		t.Fatal("expected no spans for an unknown key")
+	}
+
+	r.SetCorrelationLimits(time.Hour, 1)
+	if len(r.SpansForKey("order-1")) != 0 ||
+		len(r.SpansForKey("order-2")) != 1 {
+		t.Fatal("least recently linked key should be forgotten")
+	}
+}
+
+func TestSpanPauseResume(t *testing.T) {
+	r := NewRegistry()
+	clock := newTestClock()
+	r.testClock = clock.Now
+	f := r.ScopeNamed("pause").FuncNamed("acquire")
+	ctx := context.Background()
+	defer f.Task(&ctx)(nil)
+	s := SpanFromCtx(ctx)
+
+	clock.Advance(5 * time.Millisecond)
+	s.Resume() // not paused, so this does nothing
+	s.Pause()
+	clock.Advance(50 * time.Millisecond)
+	s.Pause() // already paused, so this does nothing
+	if active := s.ActiveDuration(); active != 5*time.Millisecond {
+		t.Fatalf("paused time should be excluded while paused: %v", active)
+	}
+	s.Resume()
+	clock.Advance(10 * time.Millisecond)
+
+	if active := s.ActiveDuration(); active != 15*time.Millisecond {
+		t.Fatalf("unexpected active duration %v", active)
+	}
+	if duration := s.Duration(); duration != 65*time.Millisecond {
+		t.Fatalf("duration should include paused time: %v", duration)
+	}
+}
+
+func startWithCaller(f *Func, depth int) *Span {
+	ctx := context.Background()
+	f.TaskWithCaller(&ctx, depth)(nil)
+	return SpanFromCtx(ctx)
+}
+
+func TestFuncTaskWithCaller(t *testing.T) {
+	f := NewRegistry().ScopeNamed("stack").FuncNamed("work")
+	s := startWithCaller(f, 2)
+	if len(s.CreationStack()) != 2 {
+		t.Fatalf("expected 2 frames, got %d", len(s.CreationStack()))
+	}
+	frames := strings.Split(strings.TrimSpace(
+		FramesString(s.CreationStack())), "\n")
+	if len(frames) != 2 ||
+		!strings.Contains(frames[0], ".startWithCaller ") ||
+		!strings.Contains(frames[1], ".TestFuncTaskWithCaller ") {
+		t.Fatalf("unexpected frames %q", frames)
+	}
+
+	ctx := context.Background()
+	f.Task(&ctx)(nil)
+	if SpanFromCtx(ctx).CreationStack() != nil {
+		t.Fatal("stacks should only be captured on request")
+	}
+}
+
+type startObserver func(s *Span)
+
+func (o startObserver) Start(s *Span) { o(s) }
+
+func (o startObserver) Finish(s *Span, err error, panicked bool,
+	finish time.Time) {
+}
+
+func TestTaskOptionsBeforeObservers(t *testing.T) {
+	r := NewRegistry()
+	var names map[string]string
+	var stack []uintptr
+	var cancel func()
+	r.ObserveTraces(func(t *Trace) {
+		t.ObserveSpans(startObserver(func(s *Span) {
+			names = s.NamedArgs()
+			stack = s.CreationStack()
+			s.mtx.Lock()
+			cancel = s.getExt().cancel
+			s.mtx.Unlock()
+		}))
+	})
+	f := r.ScopeNamed("options").FuncNamed("work")
+
+	ctx := context.Background()
+	f.TaskNamed(&ctx, []string{"key"}, "cat.jpg")(nil)
+	if names["key"] != `"cat.jpg"` {
+		t.Fatalf("observer saw args %v", names)
+	}
+	ctx = context.Background()
+	f.TaskWithCaller(&ctx, 1)(nil)
+	if len(stack) != 1 {
+		t.Fatalf("observer saw %d frames", len(stack))
+	}
+	ctx = context.Background()
+	f.TaskWithDeadline(&ctx, time.Now().Add(time.Hour))(nil)
+	if cancel == nil {
+		t.Fatal("observer saw no cancel")
+	}
+}
+
+func TestTraceToMermaid(t *testing.T) {
+	r := NewRegistry()
+	api, db := r.ScopeNamed("api"), r.ScopeNamed("db;shard#1")
+	root := context.Background()
+	defer api.FuncNamed("handle").Task(&root)(nil)
+	query := root
+	defer db.FuncNamed("query: users").Task(&query)(nil)
+	render := root
+	defer api.FuncNamed("render").Task(&render)(nil)
+	nested := query
+	defer db.FuncNamed("scan").Task(&nested)(nil)
+
+	var buf bytes.Buffer
+	if err := TraceToMermaid(SpanFromCtx(root), &buf); err != nil {
+		t.Fatal(err)
+	}
+	text := `(?:[A-Za-z0-9 ._/()\x80-\x{10ffff}]|#\d+;)+`
+	participant := regexp.MustCompile(`^    participant p\d+ as ` + text + `$`)
+	message := regexp.MustCompile(`^    p\d+->>p\d+: ` + text + `$`)
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if lines[0] != "sequenceDiagram" {
+		t.Fatalf("unexpected diagram:\n%s", buf.String())
+	}
+	participants, messages := 0, 0
+	for _, line := range lines[1:] {
+		switch {
+		case participant.MatchString(line):
+			participants++
+		case message.MatchString(line):
+			messages++
+		default:
+			t.Fatalf("invalid line %q in:\n%s", line, buf.String())
+		}
+	}
+	if participants != 2 || messages != 3 {
+		t.Fatalf("expected 2 participants and 3 messages, got:\n%s",
+			buf.String())
+	}
+	if !strings.Contains(buf.String(), "as db#59;shard#35;1\n") {
+		t.Fatalf("expected escaped scope name, got:\n%s", buf.String())
+	}
+}
+
+func TestGroup(t *testing.T) {
+	r := NewRegistry()
+	worker := r.ScopeNamed("group").FuncNamed("worker")
+	ctx := context.Background()
+	defer r.ScopeNamed("group").FuncNamed("origin").Task(&ctx)(nil)
+	origin := SpanFromCtx(ctx)
+
+	g, gctx := NewGroup(ctx, worker)
+	var mtx sync.Mutex
+	spans := map[*Span]bool{}
+	for i := 0; i < 5; i++ {
+		i := i
+		g.Go(func(ctx context.Context) error {
+			mtx.Lock()
+			spans[SpanFromCtx(ctx)] = true
+			mtx.Unlock()
+			if i == 3 {
+				return errors.New("failed")
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err == nil || err.Error() != "failed" {
+		t.Fatalf("expected the goroutine's error, got %v", err)
+	}
+	if gctx.Err() == nil {
+		t.Fatal("expected the group's context to be canceled")
+	}
+
+	if len(spans) != 5 {
+		t.Fatalf("expected 5 distinct spans, got %d", len(spans))
+	}
+	for s := range spans {
+		if s.Parent() != origin || s.Func() != worker ||
+			s.Trace() != origin.Trace() {
+			t.Fatalf("span %d isn't a child of the origin", s.Id())
+		}
+	}
+	errs := int64(0)
+	for _, count := range worker.Errors() {
+		errs += count
+	}
+	if worker.Success() != 4 || errs != 1 || worker.Current() != 0 {
+		t.Fatalf("unexpected stats: %d successes, errors %v",
+			worker.Success(), worker.Errors())
+	}
+}
+
+func TestSpanRemainingBudget(t *testing.T) {
+	f := NewRegistry().ScopeNamed("budget").FuncNamed("work")
+	ctx := context.Background()
+	defer f.Task(&ctx)(nil)
+	if _, ok := SpanFromCtx(ctx).RemainingBudget(); ok {
+		t.Fatal("expected no budget without a deadline")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	defer f.Task(&ctx)(nil)
+	s := SpanFromCtx(ctx)
+	first, ok := s.RemainingBudget()
+	if !ok || first <= 0 || first > time.Minute {
+		t.Fatalf("unexpected budget %v", first)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if second, _ := s.RemainingBudget(); second >= first {
+		t.Fatalf("expected the budget to decrease, got %v then %v",
+			first, second)
+	}
+}
+
+func TestSpanLastActivity(t *testing.T) {
+	r := NewRegistry()
+	r.SetAnnotationSampling(2)
+	f := r.ScopeNamed("activity").FuncNamed("work")
+	ctx := context.Background()
+	defer f.Task(&ctx)(nil)
+	s := SpanFromCtx(ctx)
+	if !s.LastActivity().Equal(s.Start()) || s.AnnotationCount() != 0 {
+		t.Fatal("expected activity to start out at the span's start")
+	}
+
+	time.Sleep(time.Millisecond)
+	s.Annotate("step", "1")
+	annotated := s.LastActivity()
+	if !annotated.After(s.Start()) || s.AnnotationCount() != 1 {
+		t.Fatalf("expected annotating to advance activity, got %v",
+			annotated)
+	}
+	time.Sleep(time.Millisecond)
+	s.Event("waiting")
+	if !s.LastActivity().After(annotated) {
+		t.Fatal("expected events to advance activity")
+	}
+
+	s.Annotate("step", "2")
+	s.Annotate("step", "3")
+	if s.AnnotationCount() != 3 || len(s.Annotations()) != 2 {
+		t.Fatalf("expected 3 annotations counted, got %d",
+			s.AnnotationCount())
+	}
+}
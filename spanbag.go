@@ -14,16 +14,81 @@
 
 package monkit
 
-// spanBag is a bag data structure (can add 0 or more references to a span,
-// where every add needs to be matched with an equivalent remove). spanBag has
-// a fast path for dealing with cases where the bag only has one element (the
-// common case). spanBag is not threadsafe
-type spanBag struct {
+// SpanBag is a bag data structure (can add 0 or more references to a span,
+// where every add needs to be matched with an equivalent remove). A Span
+// keeps its running children in one. SpanBags are not threadsafe; the Span
+// owning a SpanBag serializes calls to it. Custom implementations can be
+// installed with Registry.SetSpanBagFactory.
+type SpanBag interface {
+	Add(s *Span)
+	Remove(s *Span)
+	// Iterate calls cb for every element. Elements that were added more than
+	// once may or may not be visited more than once
+	Iterate(cb func(*Span))
+	// Len returns the number of elements, counting duplicates
+	Len() int
+	// Oldest returns the element with the earliest start time, or nil if the
+	// bag is empty
+	Oldest() *Span
+}
+
+// SpanBagFactory creates the collection a Span uses to keep track of its
+// running children. See Registry.SetSpanBagFactory.
+type SpanBagFactory func() SpanBag
+
+var (
+	// InlineSpanBags is the default SpanBagFactory. Its bags keep the first
+	// child inline and spill the rest into a map, which makes the common case
+	// of Spans with at most one running child cheap.
+	InlineSpanBags SpanBagFactory = func() SpanBag { return &inlineSpanBag{} }
+
+	// SliceSpanBags creates slice-backed bags. They're compact and fast to
+	// iterate, but removing a child is linear in the number of children, so
+	// they suit Spans with a handful of children.
+	SliceSpanBags SpanBagFactory = func() SpanBag { return &sliceSpanBag{} }
+
+	// MapSpanBags creates map-backed bags with constant time removal, for
+	// Spans with thousands of concurrently running children.
+	MapSpanBags SpanBagFactory = func() SpanBag { return &mapSpanBag{} }
+)
+
+// SetSpanBagFactory changes how Spans keep track of their running children.
+// A Span creates its SpanBag when its first child starts, so the factory
+// applies to Spans that haven't had a child yet, including ones that are
+// already running. A nil factory restores the default, InlineSpanBags.
+func (r *Registry) SetSpanBagFactory(factory SpanBagFactory) {
+	r.spanBagFactory.Store(spanBagFactoryRef{factory: factory})
+}
+
+type spanBagFactoryRef struct {
+	factory SpanBagFactory
+}
+
+func (r *Registry) newSpanBag() SpanBag {
+	ref, _ := r.spanBagFactory.Load().(spanBagFactoryRef)
+	if ref.factory == nil {
+		return &inlineSpanBag{}
+	}
+	return ref.factory()
+}
+
+func oldestSpan(b SpanBag) (oldest *Span) {
+	b.Iterate(func(s *Span) {
+		if oldest == nil || s.start.Before(oldest.start) {
+			oldest = s
+		}
+	})
+	return oldest
+}
+
+// inlineSpanBag has a fast path for dealing with cases where the bag only has
+// one element (the common case).
+type inlineSpanBag struct {
 	first *Span
 	rest  map[*Span]int32
 }
 
-func (b *spanBag) Add(s *Span) {
+func (b *inlineSpanBag) Add(s *Span) {
 	if b.first == nil {
 		b.first = s
 		return
@@ -34,7 +99,7 @@ func (b *spanBag) Add(s *Span) {
 	b.rest[s] += 1
 }
 
-func (b *spanBag) Remove(s *Span) {
+func (b *inlineSpanBag) Remove(s *Span) {
 	if b.first == s {
 		b.first = nil
 		return
@@ -48,8 +113,7 @@ func (b *spanBag) Remove(s *Span) {
 	}
 }
 
-// Iterate returns all elements
-func (b *spanBag) Iterate(cb func(*Span)) {
+func (b *inlineSpanBag) Iterate(cb func(*Span)) {
 	if b.first != nil {
 		cb(b.first)
 	}
@@ -57,3 +121,81 @@ func (b *spanBag) Iterate(cb func(*Span)) {
 		cb(s)
 	}
 }
+
+func (b *inlineSpanBag) Len() (n int) {
+	if b.first != nil {
+		n = 1
+	}
+	for _, count := range b.rest {
+		n += int(count)
+	}
+	return n
+}
+
+func (b *inlineSpanBag) Oldest() *Span { return oldestSpan(b) }
+
+type sliceSpanBag struct {
+	spans []*Span
+}
+
+func (b *sliceSpanBag) Add(s *Span) {
+	b.spans = append(b.spans, s)
+}
+
+func (b *sliceSpanBag) Remove(s *Span) {
+	for i := len(b.spans) - 1; i >= 0; i-- {
+		if b.spans[i] == s {
+			last := len(b.spans) - 1
+			b.spans[i] = b.spans[last]
+			b.spans[last] = nil
+			b.spans = b.spans[:last]
+			return
+		}
+	}
+}
+
+func (b *sliceSpanBag) Iterate(cb func(*Span)) {
+	for _, s := range b.spans {
+		cb(s)
+	}
+}
+
+func (b *sliceSpanBag) Len() int { return len(b.spans) }
+
+func (b *sliceSpanBag) Oldest() *Span { return oldestSpan(b) }
+
+type mapSpanBag struct {
+	counts map[*Span]int32
+	n      int
+}
+
+func (b *mapSpanBag) Add(s *Span) {
+	if b.counts == nil {
+		b.counts = map[*Span]int32{}
+	}
+	b.counts[s] += 1
+	b.n += 1
+}
+
+func (b *mapSpanBag) Remove(s *Span) {
+	count, ok := b.counts[s]
+	if !ok {
+		return
+	}
+	if count <= 1 {
+		delete(b.counts, s)
+	} else {
+		b.counts[s] = count - 1
+	}
+	b.n -= 1
+}
+
+func (b *mapSpanBag) Iterate(cb func(*Span)) {
+	for s := range b.counts {
+		cb(s)
+	}
+}
+
+func (b *mapSpanBag) Len() int { return b.n }
+
+func (b *mapSpanBag) Oldest() *Span { return oldestSpan(b) }
@@ -0,0 +1,142 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+var spanBagFactories = []struct {
+	name    string
+	factory SpanBagFactory
+}{
+	{"inline", InlineSpanBags},
+	{"slice", SliceSpanBags},
+	{"map", MapSpanBags},
+}
+
+func testSpans(n int) []*Span {
+	spans := make([]*Span, n)
+	start := time.Unix(0, 0)
+	for i := range spans {
+		spans[i] = &Span{id: int64(i), start: start.Add(time.Duration(i))}
+	}
+	return spans
+}
+
+func bagContents(b SpanBag) map[*Span]bool {
+	rv := map[*Span]bool{}
+	b.Iterate(func(s *Span) { rv[s] = true })
+	return rv
+}
+
+func TestSpanBags(t *testing.T) {
+	for _, impl := range spanBagFactories {
+		b := impl.factory()
+		spans := testSpans(4)
+		if b.Len() != 0 || b.Oldest() != nil {
+			t.Fatalf("%s: expected an empty bag", impl.name)
+		}
+
+		b.Add(spans[2])
+		b.Add(spans[1])
+		b.Add(spans[3])
+		b.Add(spans[1])
+		if b.Len() != 4 {
+			t.Fatalf("%s: expected 4 elements, got %d", impl.name, b.Len())
+		}
+		if b.Oldest() != spans[1] {
+			t.Fatalf("%s: wrong oldest element", impl.name)
+		}
+
+		b.Remove(spans[1])
+		contents := bagContents(b)
+		if b.Len() != 3 || len(contents) != 3 || !contents[spans[1]] {
+			t.Fatalf("%s: duplicate should survive one remove", impl.name)
+		}
+		b.Remove(spans[1])
+		b.Remove(spans[0]) // never added
+		contents = bagContents(b)
+		if b.Len() != 2 || len(contents) != 2 || contents[spans[1]] {
+			t.Fatalf("%s: unexpected contents after removes", impl.name)
+		}
+		if b.Oldest() != spans[2] {
+			t.Fatalf("%s: wrong oldest element", impl.name)
+		}
+
+		b.Remove(spans[2])
+		b.Remove(spans[3])
+		if b.Len() != 0 || len(bagContents(b)) != 0 {
+			t.Fatalf("%s: expected an empty bag", impl.name)
+		}
+	}
+}
+
+func TestRegistrySetSpanBagFactory(t *testing.T) {
+	r := NewRegistry()
+	r.SetSpanBagFactory(MapSpanBags)
+	f := r.ScopeNamed("bags").FuncNamed("work")
+
+	ctx := context.Background()
+	done := f.Task(&ctx)
+	child1, child2 := ctx, ctx
+	done1 := f.Task(&child1)
+	done2 := f.Task(&child2)
+	parent := SpanFromCtx(ctx)
+	if _, ok := parent.children.(*mapSpanBag); !ok {
+		t.Fatalf("expected a map-backed bag, got %T", parent.children)
+	}
+	if parent.ChildCount() != 2 {
+		t.Fatalf("expected 2 children, got %d", parent.ChildCount())
+	}
+	done1(nil)
+	done2(nil)
+	done(nil)
+	if parent.ChildCount() != 0 {
+		t.Fatalf("expected no children, got %d", parent.ChildCount())
+	}
+
+	r.SetSpanBagFactory(nil)
+	ctx = context.Background()
+	done = f.Task(&ctx)
+	child1 = ctx
+	f.Task(&child1)(nil)
+	if _, ok := SpanFromCtx(ctx).children.(*inlineSpanBag); !ok {
+		t.Fatal("expected the default bag")
+	}
+	done(nil)
+}
+
+func BenchmarkSpanBags(b *testing.B) {
+	for _, impl := range spanBagFactories {
+		for _, n := range []int{1, 10, 1000} {
+			spans := testSpans(n)
+			b.Run(fmt.Sprintf("%s/%d", impl.name, n), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					bag := impl.factory()
+					for _, s := range spans {
+						bag.Add(s)
+					}
+					for _, s := range spans {
+						bag.Remove(s)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"strconv"
+	"time"
+)
+
+// SpanData is a snapshot of a finished Span. Unlike a Span, it holds no
+// references to the Span tree, Trace, or context, so it can be retained or
+// exported long after the Span finished.
+type SpanData struct {
+	Id       int64
+	ParentId int64 // zero for root Spans
+	TraceId  int64
+
+	Package string
+	Name    string
+	Kind    SpanKind
+
+	Start    time.Time
+	Finish   time.Time
+	Orphaned bool
+
+	// WallStart is the Span's Span.WallStart, moved along with Start if
+	// the Span was restarted. See WallTimes.
+	WallStart time.Time
+
+	Err      error
+	Panicked bool
+
+	// InProgress is set on snapshots of Spans that are still running, in
+	// which case Finish is when the snapshot was taken. See
+	// Span.EnablePeriodicExport.
+	InProgress bool
+
+	Status        StatusCode
+	StatusMessage string
+
+	Args        []string
+	Annotations []Annotation
+	Links       []SpanLink
+	Attributes  map[string]interface{}
+	Tags        map[string]string
+}
+
+// NewSpanData takes a snapshot of a Span. It's expected to be called from a
+// SpanObserver's Finish method, with the same arguments. Start is the Span's
+// Span.AttemptStart, so restarted Spans only cover their last attempt.
+func NewSpanData(s *Span, err error, panicked bool,
+	finish time.Time) *SpanData {
+	status, statusMessage := s.Status()
+	start := s.AttemptStart()
+	return &SpanData{
+		Id:            s.Id(),
+		ParentId:      s.ParentId(),
+		TraceId:       s.Trace().Id(),
+		Package:       s.Func().Scope().Name(),
+		Name:          s.Name(),
+		Kind:          s.Kind(),
+		Start:         start,
+		Finish:        finish,
+		WallStart:     s.WallStart().Add(start.Sub(s.Start())),
+		Orphaned:      s.Orphaned(),
+		Err:           err,
+		Panicked:      panicked,
+		Status:        status,
+		StatusMessage: statusMessage,
+		Args:          s.Args(),
+		Annotations:   s.Annotations(),
+		Links:         s.Links(),
+		Attributes:    s.Attributes(),
+		Tags:          s.Tags(),
+	}
+}
+
+// FullName returns the name of the Span's Func including the package.
+func (d *SpanData) FullName() string {
+	return d.Package + "." + d.Name
+}
+
+// Duration returns how long the Span ran.
+func (d *SpanData) Duration() time.Duration {
+	return d.Finish.Sub(d.Start)
+}
+
+// WallTimes returns when the Span started and finished according to the
+// Registry's wall clock (see Registry.SetWallClock), which is what exporters
+// should use for absolute timestamps. Without a WallStart, it falls back to
+// Start and Finish.
+func (d *SpanData) WallTimes() (start, finish time.Time) {
+	if d.WallStart.IsZero() {
+		return d.Start, d.Finish
+	}
+	return d.WallStart, d.WallStart.Add(d.Duration())
+}
+
+// MergeRemote folds a SpanData reported by a remote process, such as the
+// server side of an RPC, into s as Annotations prefixed with "remote.", for a
+// single process view of a distributed operation when there's no tracing
+// backend to stitch traces together. The remote Span's function, id, timing,
+// error, and Annotations are recorded.
+func (s *Span) MergeRemote(remote SpanData) {
+	s.Annotate("remote.func", remote.FullName())
+	s.Annotate("remote.id", strconv.FormatInt(remote.Id, 10))
+	s.Annotate("remote.duration", remote.Duration().String())
+	if remote.Err != nil {
+		s.Annotate("remote.error", remote.Err.Error())
+	}
+	if remote.Panicked {
+		s.Annotate("remote.panicked", "true")
+	}
+	for _, annotation := range remote.Annotations {
+		s.Annotate("remote."+annotation.Name, annotation.Value)
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+// SpanKind describes the role a Span plays in a request, which exporters such
+// as Zipkin and OpenTelemetry need to render traces correctly. See
+// Span.SetKind.
+type SpanKind int32
+
+const (
+	// SpanKindInternal Spans are local work. This is the default.
+	SpanKindInternal SpanKind = iota
+	// SpanKindClient Spans are outbound requests to a remote service.
+	SpanKindClient
+	// SpanKindServer Spans handle inbound requests from a remote client.
+	SpanKindServer
+	// SpanKindProducer Spans enqueue messages for asynchronous processing.
+	SpanKindProducer
+	// SpanKindConsumer Spans process messages from SpanKindProducer Spans.
+	SpanKindConsumer
+)
+
+// String returns the lowercase name of the SpanKind, such as "client".
+func (k SpanKind) String() string {
+	switch k {
+	case SpanKindClient:
+		return "client"
+	case SpanKindServer:
+		return "server"
+	case SpanKindProducer:
+		return "producer"
+	case SpanKindConsumer:
+		return "consumer"
+	default:
+		return "internal"
+	}
+}
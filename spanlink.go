@@ -0,0 +1,83 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+// LinkRelationship describes how a linked Span relates to the Span holding
+// the link.
+type LinkRelationship int
+
+const (
+	// LinkRelated links are plain associations with no causal meaning,
+	// like OpenTelemetry links. See Span.AddLink.
+	LinkRelated LinkRelationship = iota
+	// LinkFollowsFrom links point at a Span that caused this one but didn't
+	// wait for it, like a message producer or a callback's originator. See
+	// Span.FollowsFrom.
+	LinkFollowsFrom
+)
+
+// String returns "related" or "follows_from".
+func (r LinkRelationship) String() string {
+	if r == LinkFollowsFrom {
+		return "follows_from"
+	}
+	return "related"
+}
+
+// SpanLink references another Span, possibly in another Trace. Links are
+// separate from the parent/child relationship, which is always set up by the
+// Task that starts a Span.
+type SpanLink struct {
+	TraceId      int64
+	SpanId       int64
+	Relationship LinkRelationship
+}
+
+// AddLink records a LinkRelated link from s to other.
+func (s *Span) AddLink(other *Span) {
+	s.addLink(other, LinkRelated)
+}
+
+// FollowsFrom records that s follows from other: other caused s but doesn't
+// wait for it to finish. This fits fire-and-forget continuations, such as
+// work pulled off a queue or run in a callback:
+//
+//   func handle(ctx context.Context, msg *Message) (err error) {
+//     defer mon.Task()(&ctx)(&err)
+//     monkit.SpanFromCtx(ctx).FollowsFrom(msg.Producer)
+//     ...
+//   }
+func (s *Span) FollowsFrom(other *Span) {
+	s.addLink(other, LinkFollowsFrom)
+}
+
+func (s *Span) addLink(other *Span, relationship LinkRelationship) {
+	link := SpanLink{
+		TraceId:      other.Trace().Id(),
+		SpanId:       other.Id(),
+		Relationship: relationship}
+	s.mtx.Lock()
+	ext := s.setExt()
+	ext.links = append(ext.links, link)
+	s.mtx.Unlock()
+}
+
+// Links returns the links added through AddLink and FollowsFrom.
+func (s *Span) Links() []SpanLink {
+	s.mtx.Lock()
+	links := s.getExt().links // okay cause we only ever append to this slice
+	s.mtx.Unlock()
+	return append([]SpanLink(nil), links...)
+}
@@ -0,0 +1,176 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SpanStore is a storage backend for finished Spans. See
+// Registry.SetSpanStore.
+type SpanStore interface {
+	Store(data SpanData) error
+}
+
+// FileSpanStore is a SpanStore that appends every Span to a file as a single
+// line of JSON, in the same format as JSONLogObserver. Construct with
+// NewFileSpanStore.
+type FileSpanStore struct {
+	mtx sync.Mutex
+	fh  *os.File
+}
+
+// NewFileSpanStore opens (or creates) the file at path for appending.
+func NewFileSpanStore(path string) (*FileSpanStore, error) {
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSpanStore{fh: fh}, nil
+}
+
+// Store implements the SpanStore interface.
+func (s *FileSpanStore) Store(data SpanData) error {
+	buf, err := marshalSpanLine(&data)
+	if err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	_, err = s.fh.Write(buf)
+	return err
+}
+
+// Close closes the underlying file.
+func (s *FileSpanStore) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.fh.Close()
+}
+
+type spanStoreExporter struct {
+	// sync/atomic things
+	failed int64
+
+	store    SpanStore
+	exporter *BatchExporter
+}
+
+func (e *spanStoreExporter) flush(batch []SpanData) error {
+	// Store errors aren't returned, since retrying the batch would store the
+	// spans that did succeed twice.
+	for _, data := range batch {
+		if err := e.store.Store(data); err != nil {
+			atomic.AddInt64(&e.failed, 1)
+		}
+	}
+	return nil
+}
+
+// spanStoreObserver hands finished Spans to whichever SpanStore is set when
+// they finish, rather than the one that was set when their Trace started,
+// which may have been stopped since.
+type spanStoreObserver struct {
+	r *Registry
+}
+
+func (o spanStoreObserver) Start(s *Span) {}
+
+func (o spanStoreObserver) Finish(s *Span, err error, panicked bool,
+	finish time.Time) {
+	// hold storeMtx so the store can't be stopped until the Span is buffered
+	o.r.storeMtx.RLock()
+	defer o.r.storeMtx.RUnlock()
+	if o.r.store != nil {
+		o.r.store.exporter.Finish(s, err, panicked, finish)
+	}
+}
+
+// SetSpanStore makes Spans get handed to store once they finish. Spans are
+// buffered and stored from a background goroutine in batches, so a slow
+// store never blocks a Span from finishing; if the store falls too far
+// behind, Spans are dropped instead (see SpanStoreDropped). Only Spans of
+// Traces that start while a store is set are stored, but they go to the
+// store that is set when they finish.
+//
+// Replacing the store, or passing nil, first stores any Spans still buffered
+// for the old one. Registry.Shutdown does the same. Spans that finish once
+// there's no store are not stored.
+func (r *Registry) SetSpanStore(store SpanStore) {
+	var next *spanStoreExporter
+	if store != nil {
+		next = &spanStoreExporter{store: store}
+		next.exporter = NewBatchExporter(next.flush, 100, time.Second)
+	}
+	r.storeMtx.Lock()
+	prev := r.store
+	r.setSpanStoreLocked(next)
+	r.storeMtx.Unlock()
+	r.stopSpanStore(prev)
+	if next != nil {
+		r.onShutdown(func() {
+			r.storeMtx.Lock()
+			current := r.store == next
+			if current {
+				r.setSpanStoreLocked(nil)
+			}
+			r.storeMtx.Unlock()
+			if current {
+				r.stopSpanStore(next)
+			}
+		})
+	}
+}
+
+// setSpanStoreLocked expects storeMtx to be held.
+func (r *Registry) setSpanStoreLocked(next *spanStoreExporter) {
+	r.store = next
+	if next != nil && r.storeCancel == nil {
+		r.storeCancel = r.ObserveTraces(func(t *Trace) {
+			t.ObserveSpans(spanStoreObserver{r: r})
+		})
+	} else if next == nil && r.storeCancel != nil {
+		r.storeCancel()
+		r.storeCancel = nil
+	}
+}
+
+// stopSpanStore expects e to be swapped out already, so that no more Spans
+// can be buffered for it.
+func (r *Registry) stopSpanStore(e *spanStoreExporter) {
+	if e == nil {
+		return
+	}
+	e.exporter.Stop()
+	atomic.AddInt64(&r.storeDropped,
+		e.exporter.DroppedCount()+atomic.LoadInt64(&e.failed))
+}
+
+// SpanStoreDropped returns how many Spans never made it into a SpanStore,
+// either because too many were buffered or because SpanStore.Store returned
+// an error.
+func (r *Registry) SpanStoreDropped() int64 {
+	dropped := atomic.LoadInt64(&r.storeDropped)
+	r.storeMtx.RLock()
+	if r.store != nil {
+		dropped += r.store.exporter.DroppedCount() +
+			atomic.LoadInt64(&r.store.failed)
+	}
+	r.storeMtx.RUnlock()
+	return dropped
+}
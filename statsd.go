@@ -0,0 +1,163 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultStatsDPacketSize keeps StatsD packets under a typical Ethernet MTU
+// once IP and UDP headers are added.
+const DefaultStatsDPacketSize = 1432
+
+var statsdReplacer = strings.NewReplacer(
+	":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_", "/", "_")
+
+// StatsDObserver is a SpanObserver that sends a timer and a counter to a
+// StatsD server for every finished Span, keyed by the Span's Func:
+//
+//   <prefix><func>.duration:<ms>|ms|#status:<status>
+//   <prefix><func>.calls:1|c|#status:<status>
+//
+// where status is success, error, or panic, tagged DogStatsD style. Metrics
+// are batched into packets of up to DefaultStatsDPacketSize bytes, which are
+// sent when full and at least every 100ms. Construct with
+// NewStatsDObserver, and Close when done.
+type StatsDObserver struct {
+	conn      net.Conn
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+
+	// protected by mtx
+	mtx    sync.Mutex
+	prefix string
+	buf    []byte
+	err    error
+}
+
+// NewStatsDObserver creates a StatsDObserver sending UDP packets to addr,
+// such as "localhost:8125".
+func NewStatsDObserver(addr string) (*StatsDObserver, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	o := &StatsDObserver{
+		conn:    conn,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go o.run(100 * time.Millisecond)
+	return o, nil
+}
+
+// SetPrefix sets a prefix for every metric name, such as "myapp.".
+func (o *StatsDObserver) SetPrefix(prefix string) {
+	o.mtx.Lock()
+	o.prefix = prefix
+	o.mtx.Unlock()
+}
+
+func (o *StatsDObserver) run(interval time.Duration) {
+	defer close(o.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-o.stop:
+			return
+		case <-ticker.C:
+			o.Flush()
+		}
+	}
+}
+
+// Start implements the SpanObserver interface.
+func (o *StatsDObserver) Start(s *Span) {}
+
+// Finish implements the SpanObserver interface.
+func (o *StatsDObserver) Finish(s *Span, err error, panicked bool,
+	finish time.Time) {
+	status := "success"
+	if panicked {
+		status = "panic"
+	} else if err != nil {
+		status = "error"
+	}
+	key := statsdReplacer.Replace(s.Func().FullName())
+	ms := strconv.FormatFloat(
+		float64(finish.Sub(s.AttemptStart()))/float64(time.Millisecond), 'f', -1, 64)
+
+	o.mtx.Lock()
+	o.appendLocked(o.prefix + key + ".duration:" + ms + "|ms|#status:" + status)
+	o.appendLocked(o.prefix + key + ".calls:1|c|#status:" + status)
+	o.mtx.Unlock()
+}
+
+// appendLocked expects mtx to be held.
+func (o *StatsDObserver) appendLocked(line string) {
+	if len(o.buf) > 0 && len(o.buf)+1+len(line) > DefaultStatsDPacketSize {
+		o.flushLocked()
+	}
+	if len(o.buf) > 0 {
+		o.buf = append(o.buf, '\n')
+	}
+	o.buf = append(o.buf, line...)
+}
+
+// Flush sends any buffered metrics immediately.
+func (o *StatsDObserver) Flush() {
+	o.mtx.Lock()
+	o.flushLocked()
+	o.mtx.Unlock()
+}
+
+// flushLocked expects mtx to be held.
+func (o *StatsDObserver) flushLocked() {
+	if len(o.buf) == 0 {
+		return
+	}
+	_, err := o.conn.Write(o.buf)
+	if err != nil && o.err == nil {
+		o.err = err
+	}
+	o.buf = o.buf[:0]
+}
+
+// Err returns the first error encountered sending metrics, if any. StatsD is
+// fire and forget, so this is only for diagnostics.
+func (o *StatsDObserver) Err() error {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return o.err
+}
+
+// Close flushes any buffered metrics and closes the connection. Calling it
+// again does nothing and returns the same error.
+func (o *StatsDObserver) Close() error {
+	o.closeOnce.Do(func() {
+		close(o.stop)
+		<-o.stopped
+		o.Flush()
+		o.closeErr = o.conn.Close()
+	})
+	return o.closeErr
+}
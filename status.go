@@ -0,0 +1,141 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// The classes StatusClass sorts protocol status codes into.
+const (
+	StatusSuccess     = "success"
+	StatusClientError = "client-error"
+	StatusServerError = "server-error"
+)
+
+// StatusClass classifies an RPC status code as StatusSuccess,
+// StatusClientError, or StatusServerError. Codes of 100 and up are HTTP
+// statuses, where 4xx is a client error and 5xx is a server error. Smaller
+// codes are gRPC codes, where OK is a success, codes that blame the request
+// (such as InvalidArgument, NotFound, or PermissionDenied) are client errors,
+// and the rest (such as Internal or Unavailable) are server errors.
+func StatusClass(code int) string {
+	if code >= 100 {
+		switch {
+		case code >= 500:
+			return StatusServerError
+		case code >= 400:
+			return StatusClientError
+		default:
+			return StatusSuccess
+		}
+	}
+	switch code {
+	case 0: // OK
+		return StatusSuccess
+	case 1, // Canceled
+		3,  // InvalidArgument
+		5,  // NotFound
+		6,  // AlreadyExists
+		7,  // PermissionDenied
+		9,  // FailedPrecondition
+		11, // OutOfRange
+		16: // Unauthenticated
+		return StatusClientError
+	default:
+		return StatusServerError
+	}
+}
+
+// StatusError is how a failing status set with Span.AnnotateStatus is
+// reported to the Span's Func. Its class, rather than the class of the
+// underlying error, is what FuncStats.Errors counts.
+type StatusError struct {
+	Code  int
+	Class string
+	// Err is the error the task returned, if any.
+	Err error
+}
+
+func (e *StatusError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("status %d (%s): %v", e.Code, e.Class, e.Err)
+	}
+	return fmt.Sprintf("status %d (%s)", e.Code, e.Class)
+}
+
+// AnnotateStatus records the protocol status code (HTTP or gRPC) the Span's
+// task responded with, as a "status" Annotation. When the Span finishes, a
+// status that StatusClass considers a failure is counted in the Func's stats
+// under its class (client-error or server-error), even if the task itself
+// returned no error. This lets SLOs tell client faults from server faults.
+func (s *Span) AnnotateStatus(code int) {
+	s.mtx.Lock()
+	ext := s.setExt()
+	ext.status = code
+	ext.hasStatus = true
+	s.mtx.Unlock()
+	s.Annotate("status", strconv.Itoa(code))
+}
+
+// StatusCode is an explicit outcome for a Span, along the lines of
+// OpenTelemetry's span status. See Span.SetStatus.
+type StatusCode int
+
+const (
+	// StatusCodeUnset means no status was set.
+	StatusCodeUnset StatusCode = iota
+	// StatusCodeOk means the operation definitely succeeded, even if the
+	// task returned a (benign) error.
+	StatusCodeOk
+	// StatusCodeError means the operation failed.
+	StatusCodeError
+)
+
+// String returns "unset", "ok", or "error".
+func (c StatusCode) String() string {
+	switch c {
+	case StatusCodeOk:
+		return "ok"
+	case StatusCodeError:
+		return "error"
+	default:
+		return "unset"
+	}
+}
+
+// SetStatus sets an explicit outcome for the Span, with a human readable
+// message. If no status is set by the time the Span finishes with an error
+// or a panic, the status is set to StatusCodeError with the error's message.
+// A status that was set explicitly is kept as is, so setting StatusCodeOk
+// before returning an expected error keeps exporters from flagging the Span.
+func (s *Span) SetStatus(code StatusCode, message string) {
+	s.mtx.Lock()
+	ext := s.setExt()
+	ext.statusCode = code
+	ext.statusMessage = message
+	s.mtx.Unlock()
+}
+
+// Status returns the status set with SetStatus, or automatically when the
+// Span finished.
+func (s *Span) Status() (code StatusCode, message string) {
+	s.mtx.Lock()
+	ext := s.getExt()
+	code, message = ext.statusCode, ext.statusMessage
+	s.mtx.Unlock()
+	return code, message
+}
@@ -0,0 +1,118 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SpanStreamEventType says whether a SpanStreamEvent is for a Span starting
+// or finishing.
+type SpanStreamEventType int
+
+const (
+	// SpanStarted events are sent when a Span starts. Their SpanData has no
+	// Finish time.
+	SpanStarted SpanStreamEventType = iota
+	// SpanFinished events are sent when a Span finishes.
+	SpanFinished
+)
+
+// SpanStreamEvent is sent to Registry.Subscribe subscribers.
+type SpanStreamEvent struct {
+	Type SpanStreamEventType
+	Span *SpanData
+}
+
+// SubscribeBufferSize is how many events each Registry.Subscribe channel
+// buffers before events start getting dropped.
+const SubscribeBufferSize = 1024
+
+type spanStream struct {
+	// sync/atomic things
+	dropped int64
+
+	mtx         sync.RWMutex
+	subscribers map[chan SpanStreamEvent]struct{}
+	cancel      func()
+}
+
+func (ss *spanStream) Start(s *Span) {
+	ss.send(SpanStreamEvent{
+		Type: SpanStarted,
+		Span: NewSpanData(s, nil, false, time.Time{})})
+}
+
+func (ss *spanStream) Finish(s *Span, err error, panicked bool,
+	finish time.Time) {
+	ss.send(SpanStreamEvent{
+		Type: SpanFinished,
+		Span: NewSpanData(s, err, panicked, finish)})
+}
+
+func (ss *spanStream) send(ev SpanStreamEvent) {
+	ss.mtx.RLock()
+	for ch := range ss.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			atomic.AddInt64(&ss.dropped, 1)
+		}
+	}
+	ss.mtx.RUnlock()
+}
+
+// Subscribe returns a channel of start and finish events for every Span on
+// Traces that start from now on, for things like live trace viewers. Slow
+// subscribers never block Spans: once a subscriber's channel holds
+// SubscribeBufferSize events, further events for it are dropped and counted
+// (see DroppedStreamEvents). Call unsubscribe to stop receiving events; it
+// closes the channel.
+func (r *Registry) Subscribe() (events <-chan SpanStreamEvent,
+	unsubscribe func()) {
+	ch := make(chan SpanStreamEvent, SubscribeBufferSize)
+	ss := r.stream
+	ss.mtx.Lock()
+	if ss.subscribers == nil {
+		ss.subscribers = map[chan SpanStreamEvent]struct{}{}
+	}
+	ss.subscribers[ch] = struct{}{}
+	if ss.cancel == nil {
+		ss.cancel = r.ObserveTraces(func(t *Trace) { t.ObserveSpans(ss) })
+	}
+	ss.mtx.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			ss.mtx.Lock()
+			delete(ss.subscribers, ch)
+			if len(ss.subscribers) == 0 && ss.cancel != nil {
+				ss.cancel()
+				ss.cancel = nil
+			}
+			close(ch)
+			ss.mtx.Unlock()
+		})
+	}
+}
+
+// DroppedStreamEvents returns how many events were dropped because a
+// Subscribe channel was full.
+func (r *Registry) DroppedStreamEvents() int64 {
+	return atomic.LoadInt64(&r.stream.dropped)
+}
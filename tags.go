@@ -0,0 +1,93 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"sync/atomic"
+)
+
+// OverflowTagValue replaces tag values past a Registry's tag value limit.
+// See Registry.SetMaxTagValues.
+const OverflowTagValue = "_other"
+
+// SetTag sets a tag on the Span. Tags are a separate namespace from
+// Annotations, meant for low-cardinality metadata such as a region or
+// environment, which exporters can map to indexed fields, while Annotations
+// can hold high-cardinality data such as query strings, better suited to
+// searchable logs. The Registry can cap how many distinct values each tag
+// takes; see Registry.SetMaxTagValues.
+func (s *Span) SetTag(key, value string) {
+	value = s.f.scope.r.guardTag(key, value)
+	s.mtx.Lock()
+	if ext := s.setExt(); ext.tags == nil {
+		ext.tags = map[string]string{key: value}
+	} else {
+		ext.tags[key] = value
+	}
+	s.mtx.Unlock()
+}
+
+// Tags returns a copy of the tags set through SetTag.
+func (s *Span) Tags() map[string]string {
+	s.mtx.Lock()
+	tags := s.getExt().tags
+	rv := make(map[string]string, len(tags))
+	for key, val := range tags {
+		rv[key] = val
+	}
+	s.mtx.Unlock()
+	return rv
+}
+
+// SetMaxTagValues guards against accidentally high-cardinality tags, such
+// as a user id set as a tag, by limiting how many distinct values each tag
+// key can take across all Spans of the Registry to n. Once a key has n
+// values, any other value is replaced with OverflowTagValue and counted in
+// OverflowedTags. Zero or less means no limit, which is the default.
+func (r *Registry) SetMaxTagValues(n int) {
+	atomic.StoreInt64(&r.maxTagValues, int64(n))
+}
+
+// OverflowedTags returns how many tag values were replaced with
+// OverflowTagValue. See SetMaxTagValues.
+func (r *Registry) OverflowedTags() int64 {
+	return atomic.LoadInt64(&r.overflowedTags)
+}
+
+func (r *Registry) guardTag(key, value string) string {
+	max := atomic.LoadInt64(&r.maxTagValues)
+	if max <= 0 {
+		return value
+	}
+	r.tagMtx.Lock()
+	defer r.tagMtx.Unlock()
+	values := r.tagValues[key]
+	if _, ok := values[value]; ok {
+		return value
+	}
+	if int64(len(values)) >= max {
+		atomic.AddInt64(&r.overflowedTags, 1)
+		return OverflowTagValue
+	}
+	if values == nil {
+		values = map[string]struct{}{}
+		if r.tagValues == nil {
+			r.tagValues = map[string]map[string]struct{}{}
+		}
+		r.tagValues[key] = values
+	}
+	values[value] = struct{}{}
+	return value
+}
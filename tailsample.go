@@ -0,0 +1,243 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SamplingMode determines when a Registry's Traces are sampled. See
+// Registry.SetSamplingMode.
+type SamplingMode int
+
+const (
+	// HeadSampling hands Spans to SpanObservers as they start and finish, so
+	// sampling decisions (see Trace.SetSampled) are made up front, usually
+	// when the root Span starts. It's cheap, but it misses Traces that only
+	// turn out to be interesting later, such as ones that fail.
+	HeadSampling SamplingMode = iota
+
+	// TailSampling buffers a Trace's Spans until none of them are running,
+	// then keeps the Trace if it's already sampled, had an error (see
+	// Trace.HadError), or had a Span slower than the Registry's tail latency
+	// threshold. Kept Traces are marked sampled and their Spans are handed to
+	// SpanObservers in the order they happened. Other Traces are marked
+	// unsampled and SpanObservers never hear about their Spans. Spans that
+	// join the Trace later, such as adopted or remote ones, are buffered and
+	// decided the same way once they've all finished in turn. Registry
+	// Shutdown doesn't force a decision on Traces that are still running.
+	TailSampling
+)
+
+// DefaultMaxTailBufferedSpans is how many Spans a new Registry buffers at
+// most in TailSampling mode. See Registry.SetMaxTailBufferedSpans.
+const DefaultMaxTailBufferedSpans = 10000
+
+// SetSamplingMode switches between HeadSampling, the default, and
+// TailSampling. It only affects Traces started afterwards.
+func (r *Registry) SetSamplingMode(mode SamplingMode) {
+	atomic.StoreInt32(&r.samplingMode, int32(mode))
+}
+
+// SamplingMode returns the mode set with SetSamplingMode.
+func (r *Registry) SamplingMode() SamplingMode {
+	return SamplingMode(atomic.LoadInt32(&r.samplingMode))
+}
+
+// SetTailLatencyThreshold makes TailSampling keep every Trace with a Span
+// that took at least d. Zero or less, the default, keeps Traces based on
+// errors alone.
+func (r *Registry) SetTailLatencyThreshold(d time.Duration) {
+	atomic.StoreInt64(&r.tailLatency, int64(d))
+}
+
+// SetMaxTailBufferedSpans bounds how many Spans TailSampling holds on to
+// across all of the Registry's running Traces, which defaults to
+// DefaultMaxTailBufferedSpans. When a Trace would go over the limit, it
+// falls back to HeadSampling: its buffered Spans are handed to
+// SpanObservers right away, its later Spans as they happen, and its current
+// sampling decision stands. Such Traces are counted (see TailOverflows).
+// Zero or less means no limit.
+func (r *Registry) SetMaxTailBufferedSpans(n int) {
+	atomic.StoreInt64(&r.maxTailSpans, int64(n))
+}
+
+// TailBufferedSpans returns how many Spans TailSampling currently holds.
+func (r *Registry) TailBufferedSpans() int64 {
+	return atomic.LoadInt64(&r.tailSpans)
+}
+
+// TailOverflows returns how many Traces fell back to HeadSampling because of
+// SetMaxTailBufferedSpans.
+func (r *Registry) TailOverflows() int64 {
+	return atomic.LoadInt64(&r.tailOverflows)
+}
+
+func (r *Registry) reserveTailSpan() bool {
+	for {
+		buffered := atomic.LoadInt64(&r.tailSpans)
+		if max := atomic.LoadInt64(&r.maxTailSpans); max > 0 &&
+			buffered >= max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&r.tailSpans, buffered, buffered+1) {
+			return true
+		}
+	}
+}
+
+// tailEvent is a buffered call to a SpanObserver.
+type tailEvent struct {
+	observer SpanObserver
+	s        *Span
+	start    bool
+	err      error
+	panicked bool
+	finish   time.Time
+}
+
+func (ev *tailEvent) deliver() {
+	if ev.start {
+		observeStart(ev.observer, ev.s)
+	} else {
+		observeFinish(ev.observer, ev.s, ev.err, ev.panicked, ev.finish)
+	}
+}
+
+// tailBuffer holds a Trace's SpanObserver calls in TailSampling mode until
+// the Trace's sampling decision is made.
+type tailBuffer struct {
+	r *Registry
+
+	// deliverMtx serializes decisions, so SpanObservers hear about events
+	// in order.
+	deliverMtx sync.Mutex
+
+	mtx         sync.Mutex
+	events      []tailEvent
+	spans       int64 // reserved with reserveTailSpan
+	slowest     time.Duration
+	overflowed  bool
+	passthrough bool
+}
+
+// tailObserver stands in for a Span's SpanObservers in TailSampling mode.
+type tailObserver struct {
+	buffer   *tailBuffer
+	observer SpanObserver
+}
+
+func (o *tailObserver) Start(s *Span) {
+	o.buffer.add(tailEvent{observer: o.observer, s: s, start: true})
+}
+
+func (o *tailObserver) Finish(s *Span, err error, panicked bool,
+	finish time.Time) {
+	o.buffer.add(tailEvent{observer: o.observer, s: s, err: err,
+		panicked: panicked, finish: finish})
+}
+
+func (b *tailBuffer) add(ev tailEvent) {
+	var d time.Duration
+	if !ev.start {
+		// before locking b, since AttemptStart locks the Span.
+		d = ev.finish.Sub(ev.s.AttemptStart())
+	}
+	b.mtx.Lock()
+	if b.passthrough {
+		b.mtx.Unlock()
+		ev.deliver()
+		return
+	}
+	if d > b.slowest {
+		b.slowest = d
+	}
+	b.events = append(b.events, ev)
+	overflow := false
+	if ev.start && !b.overflowed {
+		if b.r.reserveTailSpan() {
+			b.spans++
+		} else {
+			b.overflowed, overflow = true, true
+		}
+	}
+	b.mtx.Unlock()
+	if overflow {
+		atomic.AddInt64(&b.r.tailOverflows, 1)
+		b.fallback()
+	}
+}
+
+// take removes the buffered events and releases their reservations.
+func (b *tailBuffer) take() (events []tailEvent, slowest time.Duration,
+	overflowed bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	events, slowest, overflowed = b.events, b.slowest, b.overflowed
+	b.events, b.slowest = nil, 0
+	atomic.AddInt64(&b.r.tailSpans, -b.spans)
+	b.spans = 0
+	return events, slowest, overflowed
+}
+
+// complete makes the sampling decision for the events buffered since the
+// last one. It's called every time all of t's Spans have finished, so Spans
+// that join t afterwards, such as adopted or remote ones, get decided too.
+func (b *tailBuffer) complete(t *Trace) {
+	b.deliverMtx.Lock()
+	defer b.deliverMtx.Unlock()
+	events, slowest, overflowed := b.take()
+	if len(events) == 0 {
+		return
+	}
+	if !overflowed {
+		threshold := time.Duration(atomic.LoadInt64(&b.r.tailLatency))
+		keep := t.Sampled() || t.HadError() ||
+			(threshold > 0 && slowest >= threshold)
+		t.SetSampled(keep)
+		if !keep {
+			return
+		}
+	}
+	for i := range events {
+		events[i].deliver()
+	}
+}
+
+// fallback hands the buffered events to their SpanObservers and switches to
+// passing events straight through, after SetMaxTailBufferedSpans was hit.
+func (b *tailBuffer) fallback() {
+	b.deliverMtx.Lock()
+	defer b.deliverMtx.Unlock()
+	for {
+		events, _, _ := b.take()
+		if len(events) == 0 {
+			b.mtx.Lock()
+			// events added since take are for the next round.
+			if len(b.events) == 0 {
+				b.passthrough = true
+				b.mtx.Unlock()
+				return
+			}
+			b.mtx.Unlock()
+			continue
+		}
+		for i := range events {
+			events[i].deliver()
+		}
+	}
+}
@@ -15,7 +15,9 @@
 package monkit
 
 import (
+	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,7 +28,9 @@ type SpanObserver interface {
 	Start(s *Span)
 
 	// Finish is called when a Span finishes, along with an error if any, whether
-	// or not it panicked, and what time it finished.
+	// or not it panicked, and what time it finished. Finish is only ever called
+	// for Spans the observer has already seen Start for, so an observer
+	// registered while a Span is running will not hear about that Span at all.
 	Finish(s *Span, err error, panicked bool, finish time.Time)
 }
 
@@ -38,7 +42,7 @@ type spanObserverTuple struct {
 }
 
 func (l *spanObserverTuple) Start(s *Span) {
-	l.car.Start(s)
+	observeStart(l.car, s)
 	cdr := loadSpanObserverTuple(&l.cdr)
 	if cdr != nil {
 		cdr.Start(s)
@@ -47,7 +51,7 @@ func (l *spanObserverTuple) Start(s *Span) {
 
 func (l *spanObserverTuple) Finish(s *Span, err error, panicked bool,
 	finish time.Time) {
-	l.car.Finish(s, err, panicked, finish)
+	observeFinish(l.car, s, err, panicked, finish)
 	cdr := loadSpanObserverTuple(&l.cdr)
 	if cdr != nil {
 		cdr.Finish(s, err, panicked, finish)
@@ -60,14 +64,35 @@ func (l *spanObserverTuple) Finish(s *Span, err error, panicked bool,
 // like a stack frame.
 type Trace struct {
 	// sync/atomic things
+	active        int64
+	spans         int64
+	samplerSeed   uint64 // the Registry's, see SampleSpan
 	spanObservers *spanObserverTuple
+	sampled       int32
+	priority      int32
+	hadError      int32
+	flush         int32
 
 	// immutable things from construction
 	id int64
 
 	// protected by mtx
-	mtx  sync.Mutex
-	vals map[interface{}]interface{}
+	mtx      sync.Mutex
+	registry *Registry
+	vals     map[interface{}]interface{}
+	baggage  map[string]string
+	ready    chan struct{}
+	complete bool
+	retained []*TraceRetention
+	live     bool // counted by the Registry's SetMaxLiveTraces
+	shed     bool
+
+	// set before any Spans start
+	tail *tailBuffer // see TailSampling
+
+	// protected by rngMtx, which is never held while taking another lock
+	rngMtx sync.Mutex
+	rng    *rand.Rand // see SampleSpan
 }
 
 // NewTrace creates a new Trace.
@@ -80,14 +105,19 @@ func (t *Trace) getObserver() SpanObserver {
 	if observers == nil {
 		return nil
 	}
+	var observer SpanObserver = observers
 	if loadSpanObserverTuple(&observers.cdr) == nil {
-		return observers.car
+		observer = observers.car
 	}
-	return observers
+	if t.tail != nil {
+		return &tailObserver{buffer: t.tail, observer: observer}
+	}
+	return observer
 }
 
 // ObserveSpans lets you register a SpanObserver for all future Spans on the
-// Trace. The returned cancel method will remove your observer from the trace.
+// Trace. Spans that are already running are not reported. The returned cancel
+// method will remove your observer from the trace.
 func (t *Trace) ObserveSpans(observer SpanObserver) (cancel func()) {
 	for {
 		existing := loadSpanObserverTuple(&t.spanObservers)
@@ -124,6 +154,218 @@ func removeObserverFrom(parent **spanObserverTuple, ref *spanObserverTuple) (
 // Id returns the id of the Trace
 func (t *Trace) Id() int64 { return t.id }
 
+// FormatId returns the id of the Trace rendered in the given style. See
+// FormatId.
+func (t *Trace) FormatId(style IdStyle) string { return FormatId(t.id, style) }
+
+// Sampled returns whether a sampler has selected this Trace for collection.
+// monkit itself doesn't act on this flag; it's for SpanObservers that export
+// or store traces to consult. See SetSampled.
+func (t *Trace) Sampled() bool {
+	return atomic.LoadInt32(&t.sampled) != 0
+}
+
+// SetSampled sets whether this Trace should be collected. See Sampled.
+func (t *Trace) SetSampled(sampled bool) {
+	var val int32
+	if sampled {
+		val = 1
+	}
+	atomic.StoreInt32(&t.sampled, val)
+}
+
+// inheritSampled marks t as sampled if t was started from a Span on a
+// different, sampled Trace, such as when async work is split off into its own
+// Trace, so that related work is sampled consistently. An explicit sampling
+// priority on t takes precedence, and shed Traces (see Shed) stay unsampled.
+func (t *Trace) inheritSampled(from *Trace) {
+	if t.Shed() {
+		return
+	}
+	if from != t && from.Sampled() && t.SamplingPriority() == 0 {
+		t.SetSampled(true)
+	}
+}
+
+// SetSamplingPriority lets upstream systems force this Trace to be sampled.
+// A positive priority marks the Trace as sampled (see SetSampled) regardless
+// of what a sampler decides. Zero or a negative priority leaves the decision
+// to the sampler.
+func (t *Trace) SetSamplingPriority(priority int) {
+	atomic.StoreInt32(&t.priority, int32(priority))
+	if priority > 0 {
+		t.SetSampled(true)
+	}
+}
+
+// SamplingPriority returns the priority set with SetSamplingPriority.
+func (t *Trace) SamplingPriority() int {
+	return int(atomic.LoadInt32(&t.priority))
+}
+
+// SampleSpan makes a sampling decision with the given rate (between 0 and
+// 1) for a Span of the Trace, such as whether to record something expensive
+// about it. Decisions are drawn from a random number generator seeded from
+// the Trace id and the Registry's sampler seed (see
+// Registry.SetSamplerSeed), so replaying a Trace with the same id and the
+// same sequence of Spans makes the same decisions, which makes sampling
+// reproducible while debugging. Annotation sampling (see
+// Registry.SetAnnotationSampling) draws from it too.
+func (t *Trace) SampleSpan(rate float64) bool {
+	t.rngMtx.Lock()
+	sampled := t.rand().Float64() < rate
+	t.rngMtx.Unlock()
+	return sampled
+}
+
+// int63n is like rand.Int63n, but draws from the Trace's random number
+// generator. See SampleSpan.
+func (t *Trace) int63n(n int64) int64 {
+	t.rngMtx.Lock()
+	v := t.rand().Int63n(n)
+	t.rngMtx.Unlock()
+	return v
+}
+
+// rand expects rngMtx to be held.
+func (t *Trace) rand() *rand.Rand {
+	if t.rng == nil {
+		seed := atomic.LoadUint64(&t.samplerSeed)
+		src := xorshift64(mixId(t.id, seed) | 1) // xorshift can't start at 0
+		t.rng = rand.New(&src)
+	}
+	return t.rng
+}
+
+// HadError returns whether any Span in the Trace has finished with an error
+// or a panic so far, so exporters can mark the whole Trace as errored. Spans
+// with a non-success status (see Span.AnnotateStatus) count as errors too.
+func (t *Trace) HadError() bool {
+	return atomic.LoadInt32(&t.hadError) != 0
+}
+
+func (t *Trace) setHadError() {
+	atomic.StoreInt32(&t.hadError, 1)
+}
+
+// FlushRequested returns whether a Span of the Trace was annotated with the
+// Registry's flush annotation (see Registry.SetFlushOnAnnotation), so
+// exporters should export its Spans right away instead of batching them.
+// BatchExporter does so.
+func (t *Trace) FlushRequested() bool {
+	return atomic.LoadInt32(&t.flush) != 0
+}
+
+func (t *Trace) requestFlush() {
+	t.SetSamplingPriority(1)
+	atomic.StoreInt32(&t.flush, 1)
+}
+
+// ActiveSpans returns how many of the Trace's Spans are currently running.
+func (t *Trace) ActiveSpans() int64 {
+	return atomic.LoadInt64(&t.active)
+}
+
+// SpanCount returns how many Spans have been started in the Trace so far.
+func (t *Trace) SpanCount() int64 {
+	return atomic.LoadInt64(&t.spans)
+}
+
+func (t *Trace) spanStarted() {
+	atomic.AddInt64(&t.active, 1)
+	atomic.AddInt64(&t.spans, 1)
+}
+
+func (t *Trace) spanFinished() {
+	if atomic.AddInt64(&t.active, -1) == 0 {
+		if t.tail != nil {
+			// every time, unlike markComplete. see TailSampling.
+			t.tail.complete(t)
+		}
+		t.markComplete(false)
+	}
+}
+
+// ExportReady returns a channel that is closed once the Trace's root Span has
+// finished and no other Spans in the Trace are still running, after every
+// SpanObserver has been told about the last Span finishing. Exporters that
+// need whole trees can wait on it before serializing the Trace. To avoid
+// leaking waiters on Traces that never complete, the channel is also closed
+// when the Trace's Registry is Shutdown. Spans started after the channel is
+// closed don't reopen it.
+func (t *Trace) ExportReady() <-chan struct{} {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.ready == nil {
+		t.ready = make(chan struct{})
+		if t.complete ||
+			(t.registry != nil && !t.registry.watchExportReady(t)) {
+			t.complete = true
+			close(t.ready)
+		}
+	}
+	return t.ready
+}
+
+func (t *Trace) completed() bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.complete
+}
+
+// markComplete closes ExportReady once. shutdown is set when it's the
+// Registry shutting down rather than the Trace completing, in which case the
+// Trace's size isn't final, so it isn't recorded.
+func (t *Trace) markComplete(shutdown bool) {
+	t.mtx.Lock()
+	if t.complete {
+		t.mtx.Unlock()
+		return
+	}
+	t.complete = true
+	ready, registry, live := t.ready, t.registry, t.live
+	t.live = false
+	t.mtx.Unlock()
+	if registry != nil {
+		if live {
+			registry.releaseLiveTrace()
+		}
+		if !shutdown {
+			registry.observeTraceSize(t.SpanCount())
+		}
+	}
+	if ready != nil {
+		close(ready)
+		if registry != nil {
+			registry.unwatchExportReady(t)
+		}
+	}
+}
+
+func (t *Trace) addRetention(tr *TraceRetention) {
+	t.mtx.Lock()
+	t.retained = append(t.retained, tr)
+	t.mtx.Unlock()
+}
+
+// Rebase rewrites the Trace id of every Span of this Trace retained by a
+// TraceRetention to newTraceId, such as when stitching a client-submitted
+// Trace into a server-assigned one. It's only valid once the Trace has
+// completed: it returns false if no TraceRetention holds the completed Trace.
+// The Trace itself keeps its original id, but Spans retained after the
+// rebase, such as orphans finishing late, get the new id.
+func (t *Trace) Rebase(newTraceId int64) (ok bool) {
+	t.mtx.Lock()
+	retained := append([]*TraceRetention(nil), t.retained...)
+	t.mtx.Unlock()
+	for _, tr := range retained {
+		if tr.rebase(t, newTraceId) {
+			ok = true
+		}
+	}
+	return ok
+}
+
 // Get returns a value associated with a key on a trace. See Set.
 func (t *Trace) Get(key interface{}) (val interface{}) {
 	t.mtx.Lock()
@@ -144,3 +386,72 @@ func (t *Trace) Set(key, val interface{}) {
 	}
 	t.mtx.Unlock()
 }
+
+// SetBaggageItem sets a baggage item on the Trace. Unlike values set with Set,
+// baggage items are strings meant to be propagated along with the Trace to
+// other processes. If the Trace belongs to a Registry with a baggage budget
+// and the item would put the Trace over it, the item is rejected and
+// SetBaggageItem returns false. See Registry.SetMaxBaggageBytes and
+// Span.SetBaggageItem.
+func (t *Trace) SetBaggageItem(key, val string) (ok bool) {
+	t.mtx.Lock()
+	if t.registry != nil {
+		if max := t.registry.MaxBaggageBytes(); max > 0 {
+			size := len(key) + len(val)
+			for k, v := range t.baggage {
+				if k != key {
+					size += len(k) + len(v)
+				}
+			}
+			if size > max {
+				t.mtx.Unlock()
+				t.registry.rejectBaggage()
+				return false
+			}
+		}
+	}
+	if t.baggage == nil {
+		t.baggage = map[string]string{key: val}
+	} else {
+		t.baggage[key] = val
+	}
+	t.mtx.Unlock()
+	return true
+}
+
+func (t *Trace) setRegistry(r *Registry) {
+	t.mtx.Lock()
+	if t.registry == nil {
+		t.registry = r
+		atomic.StoreUint64(&t.samplerSeed, atomic.LoadUint64(&r.samplerSeed))
+	}
+	t.mtx.Unlock()
+}
+
+// Shed returns whether tracing was shed for this Trace because the Registry
+// already had too many live Traces. See Registry.SetMaxLiveTraces.
+func (t *Trace) Shed() (shed bool) {
+	t.mtx.Lock()
+	shed = t.shed
+	t.mtx.Unlock()
+	return shed
+}
+
+// BaggageItem returns the baggage item set for key, or the empty string.
+func (t *Trace) BaggageItem(key string) (val string) {
+	t.mtx.Lock()
+	val = t.baggage[key]
+	t.mtx.Unlock()
+	return val
+}
+
+// Baggage returns a copy of all of the Trace's baggage items.
+func (t *Trace) Baggage() map[string]string {
+	t.mtx.Lock()
+	rv := make(map[string]string, len(t.baggage))
+	for key, val := range t.baggage {
+		rv[key] = val
+	}
+	t.mtx.Unlock()
+	return rv
+}
@@ -0,0 +1,105 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monkit
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// defaultTraceSizeBuckets is shared by every Registry until
+// SetTraceSizeBuckets is called, so it must never be modified.
+var defaultTraceSizeBuckets = []int64{
+	1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// DefaultTraceSizeBuckets returns a copy of the upper bounds of the buckets
+// of the Registry's histogram of Trace sizes, in Spans. See
+// SetTraceSizeBuckets.
+func DefaultTraceSizeBuckets() []int64 {
+	return append([]int64(nil), defaultTraceSizeBuckets...)
+}
+
+// traceSizes is a histogram of how many Spans completed Traces had.
+type traceSizes struct {
+	mtx    sync.Mutex
+	bounds []int64
+	counts []int64
+}
+
+// SetTraceSizeBuckets replaces the upper bounds of the buckets of the
+// Registry's histogram of how many Spans each Trace has when it completes
+// (see Trace.SpanCount and Trace.ExportReady), which must be sorted in
+// increasing order; otherwise an error is returned and the buckets are left
+// alone. Sizes past the last bound are counted in an implicit +Inf bucket.
+// Existing bucket counts are discarded. The histogram is reported by Stats,
+// cumulatively like FuncStats' latency buckets, as
+// trace_spans_bucket{le="..."}.
+func (r *Registry) SetTraceSizeBuckets(bounds []int64) error {
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i] <= bounds[i-1] {
+			return fmt.Errorf("monkit: trace size buckets out of order: %v",
+				bounds)
+		}
+	}
+	bounds = append([]int64(nil), bounds...)
+	r.traceSizes.mtx.Lock()
+	r.traceSizes.bounds = bounds
+	r.traceSizes.counts = make([]int64, len(bounds)+1)
+	r.traceSizes.mtx.Unlock()
+	return nil
+}
+
+func (r *Registry) observeTraceSize(spans int64) {
+	h := &r.traceSizes
+	h.mtx.Lock()
+	if h.counts == nil {
+		h.bounds = defaultTraceSizeBuckets
+		h.counts = make([]int64, len(h.bounds)+1)
+	}
+	i := sort.Search(len(h.bounds), func(i int) bool {
+		return spans <= h.bounds[i]
+	})
+	h.counts[i] += 1
+	h.mtx.Unlock()
+}
+
+func (r *Registry) traceSizeStats(prefix string,
+	cb func(name string, val float64)) {
+	h := &r.traceSizes
+	h.mtx.Lock()
+	bounds := h.bounds
+	counts := append([]int64(nil), h.counts...)
+	h.mtx.Unlock()
+	if counts == nil {
+		bounds = defaultTraceSizeBuckets
+		counts = make([]int64, len(bounds)+1)
+	}
+
+	report := func(name string, val float64) {
+		if strings.HasPrefix(name, prefix) {
+			cb(name, val)
+		}
+	}
+	cumulative := int64(0)
+	for i, bound := range bounds {
+		cumulative += counts[i]
+		report(fmt.Sprintf(`trace_spans_bucket{le="%d"}`, bound),
+			float64(cumulative))
+	}
+	cumulative += counts[len(bounds)]
+	report(`trace_spans_bucket{le="+Inf"}`, float64(cumulative))
+}
@@ -0,0 +1,41 @@
+// Copyright (C) 2016 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !go1.7
+
+package monkit
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+)
+
+// FramesString renders a call stack, such as one returned by
+// Span.CreationStack, one "function file:line" frame per line. Before Go 1.7
+// there's no runtime.CallersFrames, so inlined calls don't get frames of
+// their own.
+func FramesString(pcs []uintptr) string {
+	var b bytes.Buffer
+	for _, pc := range pcs {
+		// pc is a return address, so look up the call instruction before it
+		f := runtime.FuncForPC(pc - 1)
+		if f == nil {
+			continue
+		}
+		file, line := f.FileLine(pc - 1)
+		fmt.Fprintf(&b, "%s %s:%d\n", f.Name(), file, line)
+	}
+	return b.String()
+}